@@ -0,0 +1,298 @@
+package grasure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+//Append appends the data read from `r` until EOF to file `filename`, and returns the number of bytes appended.
+//
+//Only the partially filled last stripe is read and encoded again, the following stripes are randomly distributed
+//and placed after the existing blocks of every disk, as adjustDist does.
+//The blocks are written through the journal, so the file is either appended completely or left as it was.
+//The file hash is resumed from its state recorded in fileInfo.HashState, so the file is never read to keep it,
+//while a file without one, e.g., written in place, keeps having no hash.
+//Like Update, up to m disks may be unavailable, leaving the blocks destined for them stale.
+//In versioning mode, the appended content is encoded as a new version instead, see rewriteVersion.
+func (e *Erasure) Append(filename string, r io.Reader) (int64, error) {
+	return e.AppendWithContext(context.Background(), filename, r)
+}
+
+//AppendWithContext is like Append, but stops encoding once `ctx` is done, leaving the file as it was.
+func (e *Erasure) AppendWithContext(ctx context.Context, filename string, r io.Reader) (int64, error) {
+	return e.appendFile(ctx, fileKey(filename), r)
+}
+
+//appendFile appends the data read from `r` until EOF to the file of key `baseFileName`
+func (e *Erasure) appendFile(ctx context.Context, baseFileName string, r io.Reader) (int64, error) {
+	if intFi, ok := e.fileMap.Load(baseFileName); ok && (e.Versioning || intFi.(*fileInfo).Pack != nil) {
+		return e.appendVersion(ctx, intFi.(*fileInfo), r)
+	}
+	w, err := e.newAppendWriter(ctx, baseFileName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		w.abort()
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if !e.Quiet {
+		log.Println(fileName(w.fi.FileName), " successfully appended ", n, "bytes")
+	}
+	return n, nil
+}
+
+//newAppendWriter returns a writer encoding after the end of file `baseFileName`, with the data of its last stripe buffered.
+func (e *Erasure) newAppendWriter(ctx context.Context, baseFileName string) (*fileWriter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	//the last stripe is encoded again, so its pending parity deltas are merged beforehand
+	if err := e.mergeParityLogOf(baseFileName); err != nil {
+		return nil, err
+	}
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return nil, errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	c := e.codecOf(fi)
+	ifs, alive := e.openBlobs(baseFileName, os.O_RDONLY)
+	defer closeBlobs(ifs)
+	if e.DiskNum-alive > c.M {
+		return nil, errTooFewDisksAlive
+	}
+	//the appended version is described by a copy, which takes effect once the journal is committed
+	newFi := &fileInfo{
+		FileName:      fi.FileName,
+		FileSize:      fi.FileSize,
+		Distribution:  append([][]int(nil), fi.Distribution...),
+		Offsets:       fi.Offsets,
+		BlockSums:     append([][]uint32(nil), fi.BlockSums...),
+		VersionID:     fi.VersionID,
+		Versions:      fi.Versions,
+		Mode:          fi.Mode,
+		ModTime:       time.Now(),
+		K:             fi.K,
+		M:             fi.M,
+		BlockSize:     fi.BlockSize,
+		blockToOffset: append([][]int(nil), fi.blockToOffset...),
+	}
+	//stripes of files encoded without checksums keep having none
+	for len(newFi.BlockSums) < len(newFi.Distribution) {
+		newFi.BlockSums = append(newFi.BlockSums, nil)
+	}
+	w := &fileWriter{
+		e:        e,
+		ctx:      ctx,
+		fi:       newFi,
+		c:        c,
+		h:        resumeHash(fi),
+		blobBuf:  makeArr2DByte(e.ConStripes, int(c.dataStripeSize)),
+		countSum: e.nextOffsets(fi),
+		stripeNo: len(fi.Distribution),
+	}
+	//the last stripe is partially filled, its data are buffered to be encoded along with the appended ones
+	if tail := fi.FileSize % c.dataStripeSize; tail != 0 {
+		w.stripeNo--
+		splitData, err := e.readDataBlocks(fi, ifs, w.stripeNo, 0, c.K-1, make([]byte, c.allStripeSize))
+		if err != nil {
+			return nil, err
+		}
+		bs := e.blockSizeOf(fi, w.stripeNo)
+		for i := 0; i < c.K; i++ {
+			copy(w.blobBuf[0][int64(i)*bs:], splitData[i])
+		}
+		w.buffered = tail
+		//the row is shared with the current version, so it's replaced rather than overwritten
+		newFi.BlockSums[w.stripeNo] = nil
+	}
+	//the stripes encoded again are no longer stale, unless on unavailable disks
+	w.rl = newRepairList(fi, w.stripeNo)
+	jn, err := e.newJournal(baseFileName, c.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	w.jn = jn
+	return w, nil
+}
+
+//commitAppend commits the journal of an append and publishes the appended version of the file.
+func (w *fileWriter) commitAppend() error {
+	e := w.e
+	fi := w.fi
+	fi.RepairList = w.rl.list()
+	if w.h != nil {
+		setHash(fi, w.h)
+	}
+	//the commit point, from now on the append survives crashes
+	if w.err == nil {
+		w.err = w.jn.commit(fi)
+	}
+	if w.err != nil {
+		w.jn.discard()
+		return w.err
+	}
+	e.unzipFileInfo(fi)
+	return e.publish(fi)
+}
+
+//setHash records the hash `h` of the whole content of `fi`, along with its state for appending to resume
+func setHash(fi *fileInfo, h hash.Hash) {
+	fi.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	fi.HashState = nil
+	if m, ok := h.(encoding.BinaryMarshaler); ok {
+		fi.HashState, _ = m.MarshalBinary()
+	}
+}
+
+//resumeHash returns the hash of the content of `fi` resumed from its state,
+//or nil if it has none, e.g., the file is written in place or encoded before the state is recorded
+func resumeHash(fi *fileInfo) hash.Hash {
+	if fi.Hash == "" || len(fi.HashState) == 0 {
+		return nil
+	}
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(fi.HashState); err != nil {
+		return nil
+	}
+	return h
+}
+
+//Truncate changes the size of file `filename` to `size`.
+//
+//A larger size appends zeros to the file.
+//A smaller size drops the stripes past it, encodes the new last stripe again shortened to fit its tail,
+//and releases the freed blocks at the end of every BLOB.
+//Like Append, the change goes through the journal, or makes a new version in versioning mode,
+//and up to m disks may be unavailable. Shrinking drops the file hash rather than reading the file kept to compute it again.
+func (e *Erasure) Truncate(filename string, size int64) error {
+	baseFileName := fileKey(filename)
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	if size < 0 {
+		return errNegativeOffset
+	}
+	if size == fi.FileSize {
+		return nil
+	}
+	if size > fi.FileSize {
+		_, err := e.appendFile(context.Background(), baseFileName, io.LimitReader(zeroReader{}, size-fi.FileSize))
+		return err
+	}
+	if e.Versioning || fi.Pack != nil {
+		return e.rewriteVersion(context.Background(), fi, func(data io.ReaderAt) io.Reader {
+			return io.NewSectionReader(data, 0, size)
+		})
+	}
+	if err := e.mergeParityLogOf(baseFileName); err != nil {
+		return err
+	}
+	intFi, _ = e.fileMap.Load(baseFileName)
+	fi = intFi.(*fileInfo)
+	c := e.codecOf(fi)
+	ifs, alive := e.openBlobs(baseFileName, os.O_RDONLY)
+	defer closeBlobs(ifs)
+	if e.DiskNum-alive > c.M {
+		return errTooFewDisksAlive
+	}
+	newStripeNum := int(ceilFracInt64(size, c.dataStripeSize))
+	newFi := &fileInfo{
+		FileName:      fi.FileName,
+		FileSize:      size,
+		Distribution:  append([][]int(nil), fi.Distribution[:newStripeNum]...),
+		Offsets:       fi.Offsets[:min(len(fi.Offsets), newStripeNum)],
+		BlockSums:     append([][]uint32(nil), fi.BlockSums[:min(len(fi.BlockSums), newStripeNum)]...),
+		VersionID:     fi.VersionID,
+		Versions:      fi.Versions,
+		Mode:          fi.Mode,
+		ModTime:       time.Now(),
+		TailBlockSize: c.tailBlockSize(size),
+		K:             fi.K,
+		M:             fi.M,
+		BlockSize:     fi.BlockSize,
+	}
+	for len(newFi.BlockSums) < newStripeNum {
+		newFi.BlockSums = append(newFi.BlockSums, nil)
+	}
+	//the last stripe is encoded again if partially filled, so it's no longer stale unless on unavailable disks
+	keptStripes := newStripeNum
+	if size%c.dataStripeSize != 0 {
+		keptStripes--
+	}
+	rl := newRepairList(fi, keptStripes)
+	e.unzipFileInfo(newFi)
+	jn, err := e.newJournal(baseFileName, c.BlockSize)
+	if err != nil {
+		return err
+	}
+	if tail := size % c.dataStripeSize; tail != 0 {
+		stripeNo := newStripeNum - 1
+		splitData, err := e.readDataBlocks(fi, ifs, stripeNo, 0, c.K-1, make([]byte, c.allStripeSize))
+		if err != nil {
+			jn.discard()
+			return err
+		}
+		stripe := make([]byte, c.dataStripeSize)
+		bs := e.blockSizeOf(fi, stripeNo)
+		for i := 0; i < c.K; i++ {
+			copy(stripe[int64(i)*bs:], splitData[i])
+		}
+		stripe = stripe[:int64(c.K)*newFi.TailBlockSize]
+		for i := tail; i < int64(len(stripe)); i++ {
+			stripe[i] = 0
+		}
+		encodeData, err := c.encodeData(stripe)
+		if err != nil {
+			jn.discard()
+			return err
+		}
+		newFi.BlockSums[stripeNo] = nil
+		e.setBlockSums(newFi, stripeNo, encodeData)
+		for i := range encodeData {
+			if err := e.logBlock(jn, rl, newFi, stripeNo, i, encodeData[i]); err != nil {
+				jn.discard()
+				return err
+			}
+		}
+	}
+	//unzipped again to mark the blocks left stale
+	newFi.RepairList = rl.list()
+	e.unzipFileInfo(newFi)
+	if err := jn.commit(newFi); err != nil {
+		jn.discard()
+		return err
+	}
+	closeBlobs(ifs)
+	if err := e.publish(newFi); err != nil {
+		return err
+	}
+	if !e.Quiet {
+		log.Println(filename, " successfully truncated to ", size, "bytes")
+	}
+	return nil
+}
+
+//zeroReader reads endless zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
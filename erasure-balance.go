@@ -0,0 +1,156 @@
+package grasure
+
+import (
+	"sort"
+
+	"github.com/DurantVivado/reedsolomon"
+)
+
+//balanceLoad returns the most load-balanced scheme, i.e., the k surviving blocks to read in every stripe,
+//so that the maximum number of blocks read from a single disk is minimized within every batch of `ConStripes` stripes.
+//
+//It's used by degraded reading and recovery, whose latency is bounded by the hottest surviving disk.
+//The scheme is owned by the caller, as reads of the same file may run concurrently.
+func (e *Erasure) balanceLoad(fi *fileInfo) ([][]int, error) {
+	stripeNum := len(fi.Distribution)
+	scheme := make([][]int, stripeNum)
+	for first := 0; first < stripeNum; first += e.ConStripes {
+		num := min(e.ConStripes, stripeNum-first)
+		batch, err := e.balanceBatch(fi, first, num)
+		if err != nil {
+			return nil, err
+		}
+		copy(scheme[first:], batch)
+	}
+	return scheme, nil
+}
+
+//balanceBatch chooses k surviving blocks for stripes [first, first+num).
+//
+//The smallest feasible maximum load is found by binary search, each candidate load is checked by
+//assigning blocks along augmenting paths, like a bipartite matching between stripes and disks.
+//Data blocks are preferred among equally balanced choices, so that less decoding is needed.
+func (e *Erasure) balanceBatch(fi *fileInfo, first, num int) ([][]int, error) {
+	k, m := e.shardsOf(fi)
+	//the surviving blocks of every stripe
+	cands := make([][]int, num)
+	aliveDisks := make(map[int]bool)
+	for s := 0; s < num; s++ {
+		//slow disks are avoided if possible
+		fast := make([]int, 0, k+m)
+		for i := 0; i < k+m; i++ {
+			if e.isBlockAlive(fi, first+s, i) {
+				cands[s] = append(cands[s], i)
+				if e.isBlockFast(fi, first+s, i) {
+					fast = append(fast, i)
+				}
+			}
+		}
+		if len(cands[s]) < k {
+			return nil, reedsolomon.ErrTooFewShards
+		}
+		if len(fast) >= k {
+			cands[s] = fast
+		}
+		for _, i := range cands[s] {
+			aliveDisks[fi.Distribution[first+s][i]] = true
+		}
+	}
+	//every stripe reads a disk at most once, so a load of num is always feasible
+	lo, hi := ceilFracInt(k*num, len(aliveDisks)), num
+	var best [][]bool
+	var bestLoad []int
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		if chosen, load, ok := e.assignBlocks(fi, first, cands, mid); ok {
+			best, bestLoad, hi = chosen, load, mid-1
+		} else {
+			lo = mid + 1
+		}
+	}
+	limit := hi + 1
+	//swap the chosen parity blocks for data blocks if the load allows
+	for s := range cands {
+		for p, ip := range cands[s] {
+			if ip < k || !best[s][p] {
+				continue
+			}
+			for d, id := range cands[s] {
+				diskId := fi.Distribution[first+s][id]
+				if id >= k || best[s][d] || bestLoad[diskId] >= limit {
+					continue
+				}
+				best[s][p], best[s][d] = false, true
+				bestLoad[fi.Distribution[first+s][ip]]--
+				bestLoad[diskId]++
+				break
+			}
+		}
+	}
+	scheme := make([][]int, num)
+	for s := range cands {
+		for c, i := range cands[s] {
+			if best[s][c] {
+				scheme[s] = append(scheme[s], i)
+			}
+		}
+		sort.Ints(scheme[s])
+	}
+	return scheme, nil
+}
+
+//assignBlocks tries to choose k candidate blocks for every stripe with no disk serving more than `limit` blocks.
+//
+//chosen[s][c] tells if cands[s][c] is chosen, and load counts the blocks read from every disk.
+func (e *Erasure) assignBlocks(fi *fileInfo, first int, cands [][]int, limit int) ([][]bool, []int, bool) {
+	k, _ := e.shardsOf(fi)
+	chosen := make([][]bool, len(cands))
+	for s := range cands {
+		chosen[s] = make([]bool, len(cands[s]))
+	}
+	load := make([]int, e.DiskNum)
+	diskOf := func(s, c int) int {
+		return fi.Distribution[first+s][cands[s][c]]
+	}
+	//augment finds one more block for stripe s, possibly by making other stripes move off a full disk
+	var augment func(s int, visited []bool) bool
+	augment = func(s int, visited []bool) bool {
+		for c := range cands[s] {
+			d := diskOf(s, c)
+			if chosen[s][c] || visited[d] {
+				continue
+			}
+			visited[d] = true
+			if load[d] < limit {
+				chosen[s][c] = true
+				load[d]++
+				return true
+			}
+			//the disk is full, try to release one of its blocks
+			for s2 := range cands {
+				if s2 == s {
+					continue
+				}
+				for c2 := range cands[s2] {
+					if !chosen[s2][c2] || diskOf(s2, c2) != d {
+						continue
+					}
+					if augment(s2, visited) {
+						chosen[s2][c2] = false
+						chosen[s][c] = true
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	for s := range cands {
+		for u := 0; u < k; u++ {
+			if !augment(s, make([]bool, e.DiskNum)) {
+				return nil, nil, false
+			}
+		}
+	}
+	return chosen, load, true
+}
@@ -0,0 +1,85 @@
+package grasure
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+//crcTable is the CRC32C (Castagnoli) table used for block checksums
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+//blockSum returns the checksum of a block
+func blockSum(block []byte) uint32 {
+	return crc32.Checksum(block, crcTable)
+}
+
+//setBlockSums records the checksums of all blocks of stripe `stripeNo`.
+//It's not safe to grow fi.BlockSums concurrently, so callers grow it with growBlockSums beforehand.
+func (e *Erasure) setBlockSums(fi *fileInfo, stripeNo int, blocks [][]byte) {
+	if fi.BlockSums[stripeNo] == nil {
+		fi.BlockSums[stripeNo] = make([]uint32, len(blocks))
+	}
+	for i := range blocks {
+		fi.BlockSums[stripeNo][i] = blockSum(blocks[i])
+	}
+}
+
+//growBlockSums resizes fi.BlockSums to `stripeNum` rows, the new rows are zero
+func (e *Erasure) growBlockSums(fi *fileInfo, stripeNum int) {
+	if stripeNum <= len(fi.BlockSums) {
+		fi.BlockSums = fi.BlockSums[:stripeNum]
+		return
+	}
+	k, m := e.shardsOf(fi)
+	for len(fi.BlockSums) < stripeNum {
+		fi.BlockSums = append(fi.BlockSums, make([]uint32, k+m))
+	}
+}
+
+//checkBlock tells if block `i` of stripe `stripeNo` matches its recorded checksum.
+//
+//Files encoded before checksums were introduced have none, and always pass, so do stripes with a nil row.
+func (fi *fileInfo) checkBlock(stripeNo, i int, block []byte) bool {
+	if stripeNo >= len(fi.BlockSums) || fi.BlockSums[stripeNo] == nil {
+		return true
+	}
+	return fi.BlockSums[stripeNo][i] == blockSum(block)
+}
+
+//readBlock reads block `i` of stripe `stripeNo` into `dst` and checks it against the recorded checksum.
+//The latency is recorded into the disk statistics.
+//
+//A mismatched block is marked blkFail and errBlockCorrupted is returned.
+//A parity block is patched with its pending delta after the check, see erasure-paritylog.go.
+func (e *Erasure) readBlock(fi *fileInfo, ifs []*os.File, stripeNo, i int, dst []byte) error {
+	diskId := fi.Distribution[stripeNo][i]
+	offset := fi.blockToOffset[stripeNo][i]
+	disk := e.diskInfos[diskId]
+	c := e.codecOf(fi)
+	var pl *parityLog
+	if i >= c.K {
+		if pl = e.pendingParity(fi.FileName); pl != nil {
+			pl.mu.RLock()
+			defer pl.mu.RUnlock()
+		}
+	}
+	start := time.Now()
+	if disk.slowDown > 0 {
+		time.Sleep(disk.slowDown)
+	}
+	_, err := ifs[diskId].ReadAt(dst, int64(offset)*c.BlockSize)
+	disk.recordLatency(time.Since(start))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !fi.checkBlock(stripeNo, i, dst) {
+		fi.blockInfos[stripeNo][i].bstat = blkFail
+		return errBlockCorrupted
+	}
+	if pl != nil {
+		pl.patch(diskId, offset, dst)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package grasure
+
+import (
+	"github.com/DurantVivado/reedsolomon"
+)
+
+//Every file is striped with its own erasure parameters recorded in its file info, so files of different needs
+//share the system: e.g., a "hot" class of 4+2 and 64KiB blocks for frequently accessed files,
+//and an "archive" class of 12+4 and 1MiB blocks for cold ones.
+//
+//The classes are named in the config, see DefineClass, and new files are encoded with Class, or the parameters of
+//the system if it's empty. Files encoded before classes record no parameters, and have those of the system.
+//Reading, updating and recovering a file use its parameters, along with an encoder cached by (k, m).
+
+//StorageClass is a named set of erasure parameters files are encoded with
+type StorageClass struct {
+	// the number of data blocks in a stripe
+	K int `json:"dataShards"`
+
+	// the number of parity blocks in a stripe
+	M int `json:"parityShards"`
+
+	// the block size
+	BlockSize int64 `json:"blockSize"`
+}
+
+//codec holds the erasure parameters a file is striped with, and the encoder of them
+type codec struct {
+	K         int
+	M         int
+	BlockSize int64
+
+	// the data stripe size, equal to k*bs
+	dataStripeSize int64
+
+	// the data plus parity stripe size, equal to (k+m)*bs
+	allStripeSize int64
+
+	enc reedsolomon.Encoder
+}
+
+//DefineClass defines storage class `name` of `k` data blocks and `m` parity blocks of `blockSize` bytes,
+//replacing the former definition if any. The files encoded with the former one keep their parameters.
+//
+//Like encoding, the config is not written, call WriteConfig afterwards.
+func (e *Erasure) DefineClass(name string, k, m int, blockSize int64) error {
+	if err := e.checkParams(k, m, blockSize); err != nil {
+		return err
+	}
+	if _, err := e.encoderOf(k, m); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Classes == nil {
+		e.Classes = make(map[string]*StorageClass)
+	}
+	e.Classes[name] = &StorageClass{K: k, M: m, BlockSize: blockSize}
+	return nil
+}
+
+//checkParams tells if `k`+`m` blocks of `blockSize` bytes fit the system
+func (e *Erasure) checkParams(k, m int, blockSize int64) error {
+	if k <= 0 || m <= 0 {
+		return reedsolomon.ErrInvShardNum
+	}
+	//The reedsolomon library only implements GF(2^8) and will be improved later
+	if k+m > 256 {
+		return reedsolomon.ErrMaxShardNum
+	}
+	if k+m > e.DiskNum {
+		return errTooFewDisksAlive
+	}
+	if blockSize <= 0 {
+		return errInvalidBlockSize
+	}
+	return nil
+}
+
+//encoderOf returns the encoder of `k` data blocks and `m` parity blocks, which is created once and cached
+func (e *Erasure) encoderOf(k, m int) (reedsolomon.Encoder, error) {
+	key := [2]int{k, m}
+	if enc, ok := e.encoders.Load(key); ok {
+		return enc.(reedsolomon.Encoder), nil
+	}
+	enc, err := reedsolomon.New(k, m,
+		reedsolomon.WithAutoGoroutines(int(e.BlockSize)),
+		reedsolomon.WithCauchyMatrix(),
+		reedsolomon.WithInversionCache(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := e.encoders.LoadOrStore(key, enc)
+	return actual.(reedsolomon.Encoder), nil
+}
+
+//newCodec returns the codec of the given parameters
+func (e *Erasure) newCodec(k, m int, blockSize int64) (*codec, error) {
+	enc, err := e.encoderOf(k, m)
+	if err != nil {
+		return nil, err
+	}
+	return &codec{
+		K:              k,
+		M:              m,
+		BlockSize:      blockSize,
+		dataStripeSize: int64(k) * blockSize,
+		allStripeSize:  int64(k+m) * blockSize,
+		enc:            enc,
+	}, nil
+}
+
+//sysCodec returns the codec of the system parameters
+func (e *Erasure) sysCodec() *codec {
+	return &codec{
+		K:              e.K,
+		M:              e.M,
+		BlockSize:      e.BlockSize,
+		dataStripeSize: e.dataStripeSize,
+		allStripeSize:  e.allStripeSize,
+		enc:            e.enc,
+	}
+}
+
+//classCodec returns the codec of storage class `class`, or of the system parameters if it's empty
+func (e *Erasure) classCodec(class string) (*codec, error) {
+	if class == "" {
+		return e.sysCodec(), nil
+	}
+	e.mu.RLock()
+	sc, ok := e.Classes[class]
+	e.mu.RUnlock()
+	if !ok {
+		return nil, errClassNotFound
+	}
+	return e.newCodec(sc.K, sc.M, sc.BlockSize)
+}
+
+//codecOf returns the codec file `fi` is striped with.
+//
+//The encoder of a file's parameters is created once they're checked by DefineClass or ReadConfig,
+//so failing to create it here means the config is broken, and the system parameters are used then.
+func (e *Erasure) codecOf(fi *fileInfo) *codec {
+	if fi.K == 0 {
+		return e.sysCodec()
+	}
+	c, err := e.newCodec(fi.K, fi.M, fi.BlockSize)
+	if err != nil {
+		return e.sysCodec()
+	}
+	return c
+}
+
+//shardsOf returns the number of data and parity blocks of every stripe of `fi`
+func (e *Erasure) shardsOf(fi *fileInfo) (k, m int) {
+	if fi.K == 0 {
+		return e.K, e.M
+	}
+	return fi.K, fi.M
+}
+
+//setParams records the parameters of `c` into `fi`
+func (c *codec) setParams(fi *fileInfo) {
+	fi.K, fi.M, fi.BlockSize = c.K, c.M, c.BlockSize
+}
@@ -0,0 +1,224 @@
+package grasure
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+//DirSummary reports how the files of a directory tree went in EncodeDir or ReadDirTo
+type DirSummary struct {
+	//the files done, by their names in the system, sorted
+	Succeeded []string
+
+	//the files failed along with the errors, by their names in the system
+	Failed map[string]error
+
+	//how many bytes the files done hold
+	Bytes int64
+
+	mu sync.Mutex
+}
+
+//done records the result of file `name` of `size` bytes
+func (s *DirSummary) done(name string, size int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.Failed[name] = err
+		return
+	}
+	s.Succeeded = append(s.Succeeded, name)
+	s.Bytes += size
+}
+
+//treeBudget shares `ConStripes` stripes among the files of a tree processed concurrently,
+//a file takes as many stripes as it has, up to ConStripes, so small files go in parallel and large ones in turn.
+type treeBudget struct {
+	e   *Erasure
+	sem *semaphore.Weighted
+	wg  sync.WaitGroup
+}
+
+func (e *Erasure) newTreeBudget() *treeBudget {
+	return &treeBudget{e: e, sem: semaphore.NewWeighted(int64(e.ConStripes))}
+}
+
+//goFile runs `do` with the stripes a file of `size` bytes in stripes of `stripeSize` bytes takes once they're available,
+//or returns the context error if `ctx` is done meanwhile.
+func (b *treeBudget) goFile(ctx context.Context, size, stripeSize int64, do func(conStripes int)) error {
+	stripes := min(max(1, int(ceilFracInt64(size, stripeSize))), b.e.ConStripes)
+	if err := b.sem.Acquire(ctx, int64(stripes)); err != nil {
+		return err
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.sem.Release(int64(stripes))
+		do(stripes)
+	}()
+	return nil
+}
+
+//EncodeDir encodes the files of local directory tree `src` into directory `dst` of the system, see EncodeDirWithContext.
+func (e *Erasure) EncodeDir(src, dst string) (*DirSummary, error) {
+	return e.EncodeDirWithContext(context.Background(), src, dst)
+}
+
+//EncodeDirWithContext encodes the regular files of local directory tree `src` into directory `dst` of the system
+//concurrently, giving up the files not yet encoded once `ctx` is done.
+//
+//Every file is named by its path relative to `src` under `dst`, the root of the system if empty,
+//so that ReadDirTo brings the tree back anywhere. It keeps its permission, which ReadDirTo restores.
+//The directories walked are made in the system even if empty. The files share a budget of ConStripes stripes,
+//see treeBudget. A failed file doesn't stop the others, the summary tells which files are done and which failed.
+//The files are all encoded with storage class Class.
+//
+//Like EncodeFile, the config is not written, call WriteConfig once afterwards.
+func (e *Erasure) EncodeDirWithContext(ctx context.Context, src, dst string) (*DirSummary, error) {
+	if info, err := os.Stat(src); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, errNotDir
+	}
+	c, err := e.classCodec(e.Class)
+	if err != nil {
+		return nil, err
+	}
+	sum := &DirSummary{Failed: make(map[string]error)}
+	budget := e.newTreeBudget()
+	err = filepath.WalkDir(src, func(localPath string, d fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(src, localPath)
+		if relErr != nil {
+			return relErr
+		}
+		name := cleanName(path.Join(filepath.ToSlash(dst), filepath.ToSlash(rel)))
+		if err != nil {
+			sum.done(name, 0, err)
+			return nil
+		}
+		if d.IsDir() {
+			if err := e.Mkdir(name); err != nil {
+				sum.done(name, 0, err)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			sum.done(name, 0, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			sum.done(name, 0, errIsNotRegular)
+			return nil
+		}
+		return budget.goFile(ctx, info.Size(), c.dataStripeSize, func(conStripes int) {
+			sum.done(name, info.Size(), e.encodeLocalFile(ctx, localPath, name, info.Mode().Perm(), conStripes, c))
+		})
+	})
+	budget.wg.Wait()
+	sort.Strings(sum.Succeeded)
+	return sum, err
+}
+
+//encodeLocalFile encodes local file `localPath` of permission `perm` as file `name` with the parameters of `c`,
+//in batches of `conStripes` stripes
+func (e *Erasure) encodeLocalFile(ctx context.Context, localPath, name string, perm os.FileMode, conStripes int, c *codec) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := e.newFileWriter(ctx, fileKey(name), e.Override, conStripes, c)
+	if err != nil {
+		return err
+	}
+	w.fi.Mode = perm
+	if _, err := io.Copy(w, f); err != nil {
+		w.abort()
+		return err
+	}
+	return w.Close()
+}
+
+//ReadDirTo reads the files under directory `name` in the system into local directory `dst`, see ReadDirToWithContext.
+func (e *Erasure) ReadDirTo(name, dst string, options *Options) (*DirSummary, error) {
+	return e.ReadDirToWithContext(context.Background(), name, dst, options)
+}
+
+//ReadDirToWithContext reads the files under directory `name` in the system into local directory `dst` concurrently,
+//giving up the files not yet read once `ctx` is done. It's the counterpart of EncodeDir.
+//
+//The files are saved by their paths relative to `name` with the permissions they were encoded with,
+//and the empty directories are made as well. Like EncodeDir, the files share a budget of ConStripes stripes,
+//and the summary tells which files are read and which failed. Every file is read as ReadFile does with `options`.
+func (e *Erasure) ReadDirToWithContext(ctx context.Context, name, dst string, options *Options) (*DirSummary, error) {
+	name = cleanName(name)
+	if _, ok := e.fileMap.Load(escapeName(name)); ok {
+		return nil, errNotDir
+	}
+	if !e.isDir(name) {
+		return nil, errPathNotFound
+	}
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+	var files []*fileInfo
+	e.fileMap.Range(func(key, value interface{}) bool {
+		if !isHiddenName(key.(string)) && strings.HasPrefix(fileName(key.(string)), prefix) {
+			files = append(files, value.(*fileInfo))
+		}
+		return true
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileName < files[j].FileName
+	})
+	dirs := []string{dst}
+	e.mu.RLock()
+	for _, dir := range e.DirMeta[sort.SearchStrings(e.DirMeta, prefix):] {
+		if !strings.HasPrefix(dir, prefix) {
+			break
+		}
+		dirs = append(dirs, filepath.Join(dst, filepath.FromSlash(dir[len(prefix):])))
+	}
+	e.mu.RUnlock()
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	}
+	sum := &DirSummary{Failed: make(map[string]error)}
+	budget := e.newTreeBudget()
+	var err error
+	for _, fi := range files {
+		fi := fi
+		fn := fileName(fi.FileName)
+		savepath := filepath.Join(dst, filepath.FromSlash(fn[len(prefix):]))
+		err = budget.goFile(ctx, fi.FileSize, e.codecOf(fi).dataStripeSize, func(int) {
+			err := os.MkdirAll(filepath.Dir(savepath), 0777)
+			if err == nil {
+				err = e.readFile(ctx, fi.FileName, savepath, options)
+			}
+			if err == nil && fi.Mode != 0 {
+				err = os.Chmod(savepath, fi.Mode)
+			}
+			sum.done(fn, fi.FileSize, err)
+		})
+		if err != nil {
+			break
+		}
+	}
+	budget.wg.Wait()
+	sort.Strings(sum.Succeeded)
+	return sum, err
+}
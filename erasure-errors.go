@@ -32,7 +32,7 @@ var errFileIncompleted = errors.New("file hash check fails, file renders incompl
 
 var errFileNotFound = errors.New("file not found")
 
-var errFailModeNotRecognized = errors.New("the fail mode is not recognizable, please specify in \"diskFail\" or \"bitRot\"")
+var errFailModeNotRecognized = errors.New("the fail mode is not recognizable, please specify in \"diskFail\", \"bitRot\" or \"slowDisk\"")
 
 var errInvalidReplicateFactor = errors.New("the replicate factor MUST be non-negative")
 
@@ -44,6 +44,32 @@ var errDiskNumTooLarge = errors.New("diskNum is larger than provided")
 
 var errTooFewBlockAliveInStripe = errors.New("not enough blocks for reading in a stripe")
 
+var errFileClosed = errors.New("file already closed")
+
+var errNegativeOffset = errors.New("negative offset")
+
+var errInvalidWhence = errors.New("invalid whence")
+
+var errRangeOutOfFile = errors.New("the range exceeds the file size")
+
+var errBlockCorrupted = errors.New("block checksum mismatches, block renders corrupted")
+
+var errReservedFileName = errors.New("the file name is reserved by the system")
+
+var errInvalidFileName = errors.New("the file name is empty or names the root directory")
+
+var errIsDir = errors.New("the path is a directory")
+
+var errNotDir = errors.New("a file is in the path where a directory is expected")
+
+var errDirNotEmpty = errors.New("the directory is not empty")
+
+var errClassNotFound = errors.New("the storage class is not defined")
+
+var errInvalidBlockSize = errors.New("the block size MUST be positive")
+
+var errScalingInProgress = errors.New("the system is being scaled to other parameters, resume that first")
+
 // errUnexpected - unexpected error, requires manual intervention.
 var errUnexpected = storageErr("unexpected error, please report this issue at https://github.com/minio/minio/issues")
 
@@ -138,7 +164,7 @@ var errSkipFile = errors.New("skip this file")
 // storageErr represents error generated by xlStorage call.
 type storageErr string
 
-func (h storageErr) error() string {
+func (h storageErr) Error() string {
 	return string(h)
 }
 
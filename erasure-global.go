@@ -5,7 +5,9 @@
 package grasure
 
 import (
+	"os"
 	"sync"
+	"time"
 
 	"github.com/DurantVivado/reedsolomon"
 )
@@ -42,6 +44,13 @@ type diskInfo struct {
 
 	//the capacity of a disk
 	capacity int64
+
+	//the moving average of block read latency in nanoseconds and the number of reads, accessed atomically
+	latency int64
+	reads   int64
+
+	//the extra latency of every block read, simulated by Destroy in slowDisk mode
+	slowDown time.Duration
 }
 
 //Erasure is the critical erasure coding structure
@@ -62,6 +71,15 @@ type Erasure struct {
 	//FileMeta lists, indicating fileName, fileSize, fileHash, fileDist...
 	FileMeta []*fileInfo `json:"fileLists"`
 
+	//the files in the trash, in the order they were removed, guarded by mu
+	TrashMeta []*trashInfo `json:"trashLists,omitempty"`
+
+	//the directories made by Mkdir, sorted, guarded by mu
+	DirMeta []string `json:"dirLists,omitempty"`
+
+	//whether the file names are escaped as keys, false for systems built before the namespace, see erasure-namespace.go
+	NameEscaped bool `json:"nameEscaped"`
+
 	//how many stripes are allowed to encode/decode concurrently
 	ConStripes int `json:"-"`
 
@@ -74,6 +92,18 @@ type Erasure struct {
 	// the reedsolomon encoder, for block access
 	enc reedsolomon.Encoder
 
+	//the encoders of the erasure parameters files are striped with, by (k, m), see erasure-class.go
+	encoders sync.Map
+
+	//the storage classes defined, by name, guarded by mu
+	Classes map[string]*StorageClass `json:"classes,omitempty"`
+
+	//the storage class new files are encoded with, empty for the parameters of the system
+	Class string `json:"-"`
+
+	//the parameters the files are re-striped from by an unfinished Scale, see erasure-scaling.go
+	Scaling *StorageClass `json:"scaling,omitempty"`
+
 	// the data stripe size, equal to k*bs
 	dataStripeSize int64
 
@@ -86,9 +116,13 @@ type Erasure struct {
 	// configuration file path
 	ConfigFile string `json:"-"`
 
-	//file map
+	//file map, changed through storeFile and deleteFile so that dirIndex follows
 	fileMap sync.Map
 
+	//dirIndex counts the files under every directory implied by their paths, guarded by dirMu, see erasure-namespace.go
+	dirIndex map[string]int
+	dirMu    sync.Mutex
+
 	// the path of file recording all disks path
 	DiskFilePath string `json:"-"`
 
@@ -103,12 +137,53 @@ type Erasure struct {
 
 	//whether or not to mute outputs
 	Quiet bool `json:"-"`
+
+	//how long a block read may take before a spare block is fetched in its place, 0 disables hedging
+	HedgeDelay time.Duration `json:"-"`
+
+	//the average read latency beyond which a disk is treated as degraded, 0 disables the judgement
+	SlowDiskLatency time.Duration `json:"-"`
+
+	//the files whose applied update journals are dropped once the config is written, guarded by mu
+	journaled []string
+
+	//the records of renames dropped once the config is written, guarded by mu
+	renames []string
+
+	//parity deltas of updates are logged instead of written in place until the logs of a file reach ParityLogSize bytes,
+	//0 disables parity logging
+	ParityLogSize int64 `json:"-"`
+
+	//the parity logs of files, file name -> *parityLog
+	parityLogs sync.Map
+
+	//whether the former version of a file is kept when it's encoded again or updated, see erasure-version.go
+	Versioning bool `json:"-"`
+
+	//how many old versions of a file are kept at most, the oldest ones are pruned beyond it. 0 keeps all
+	MaxVersions int `json:"-"`
+
+	//whether RemoveFile moves files into the trash rather than deleting them, see erasure-trash.go
+	Trash bool `json:"-"`
+
+	//files smaller than PackThreshold bytes are packed into shared containers rather than striped on their own,
+	//see erasure-pack.go. 0 disables packing
+	PackThreshold int64 `json:"-"`
+
+	//the number of the container being filled, guarded by packMu
+	PackID int `json:"packID,omitempty"`
+
+	//packMu serializes packing and compaction
+	packMu sync.Mutex
+
+	//the containers compacted away and the old versions dropped, whose directories are removed once the config is written, guarded by mu
+	retired []string
 }
 
 //fileInfo defines the file-level information,
 //it's concurrently safe
 type fileInfo struct {
-	//file name
+	//file name, escaped as the key of the file, see erasure-namespace.go
 	FileName string `json:"fileName"`
 
 	//file size
@@ -117,9 +192,52 @@ type fileInfo struct {
 	//hash value (SHA256 by default)
 	Hash string `json:"fileHash"`
 
+	//HashState is the marshalled state of the hash after the whole file, which Append resumes rather than reading the file,
+	//empty along with Hash if the file has none
+	HashState []byte `json:"hashState,omitempty"`
+
 	//distribution forms a block->disk mapping
 	Distribution [][]int `json:"fileDist"`
 
+	//Offsets has the same row and column number as the first stripes of Distribution and records the block offsets
+	//relative to a disk, if they don't follow the order of Distribution, e.g., for the blocks kept in place by Scale.
+	//The stripes beyond it are placed after the existing blocks of every disk.
+	Offsets [][]int `json:"blockOffsets,omitempty"`
+
+	//BlockSums has the same row and column number as Distribution and records the CRC32C of every block
+	BlockSums [][]uint32 `json:"blockSums,omitempty"`
+
+	//ParityLogSizes records how many bytes of parity deltas are pending in the parity log of every disk
+	ParityLogSizes []int64 `json:"parityLogSizes,omitempty"`
+
+	//RepairList lists the blocks left stale by degraded updates as (stripe number, block index),
+	//which are brought up to date by RepairStale or Recover
+	RepairList [][2]int `json:"repairList,omitempty"`
+
+	//VersionID numbers the versions of the file, it grows every time the file is encoded again
+	VersionID int `json:"versionID,omitempty"`
+
+	//Versions lists the IDs of the old versions kept, oldest first
+	Versions []int `json:"versions,omitempty"`
+
+	//ModTime is when the file was last changed
+	ModTime time.Time `json:"modTime"`
+
+	//Mode is the permission of the file encoded by EncodeDir, restored by ReadDirTo
+	Mode os.FileMode `json:"mode,omitempty"`
+
+	//Pack locates the file in its container if it's packed, see erasure-pack.go
+	Pack *packRef `json:"pack,omitempty"`
+
+	//TailBlockSize is the block size of the last stripe if it's shortened, see erasure-tail.go
+	TailBlockSize int64 `json:"tailBlockSize,omitempty"`
+
+	//K, M and BlockSize are the erasure parameters the file is striped with,
+	//zero for files encoded before storage classes, which have those of the system, see erasure-class.go
+	K         int   `json:"dataShards,omitempty"`
+	M         int   `json:"parityShards,omitempty"`
+	BlockSize int64 `json:"blockSize,omitempty"`
+
 	//blockToOffset has the same row and column number as Distribution but points to the block offset relative to a disk.
 	blockToOffset [][]int
 
@@ -128,9 +246,6 @@ type fileInfo struct {
 
 	//system-level file info
 	// metaInfo     *os.fileInfo
-
-	//loadBalancedScheme is the most load-balanced scheme derived by SGA algo
-	loadBalancedScheme [][]int
 }
 
 type blockStat uint8
@@ -142,6 +257,12 @@ type blockInfo struct {
 type Options struct {
 	//Degrade tells if degrade read is on
 	Degrade bool
+	//SkipParity tells if healthy stripes are read without parity, relying on the file hash to detect corruption
+	SkipParity bool
+	//SkipHashCheck tells if the file hash is not checked after reading, e.g., for throughput benchmarks
+	SkipHashCheck bool
+	//Repair tells if reconstructed blocks on available disks are written back during reading
+	Repair bool
 }
 
 //SimOptions defines the parameters for simulation
@@ -154,6 +275,8 @@ type SimOptions struct {
 	FailNum int
 	//specify the fileName, used only for "bitRot" mode
 	FileName string
+	//the extra latency of every block read, used only for "slowDisk" mode
+	SlowDown time.Duration
 }
 
 //global system-level variables
@@ -0,0 +1,183 @@
+package grasure
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/DurantVivado/reedsolomon"
+)
+
+//a disk is judged by its latency only after this many reads
+const minLatencySamples = 8
+
+//DiskStat reports the read statistics of a disk
+type DiskStat struct {
+	//the disk path
+	Path string
+
+	//whether the disk is available
+	Available bool
+
+	//the moving average of block read latency
+	Latency time.Duration
+
+	//the number of blocks read
+	Reads int64
+
+	//whether the disk is treated as degraded for being slow
+	Slow bool
+}
+
+//blockResult is the outcome of reading a block
+type blockResult struct {
+	i    int
+	data []byte
+	err  error
+}
+
+//recordLatency folds a block read latency into the moving average of the disk
+func (d *diskInfo) recordLatency(elapsed time.Duration) {
+	if atomic.AddInt64(&d.reads, 1) == 1 {
+		atomic.StoreInt64(&d.latency, int64(elapsed))
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&d.latency)
+		if atomic.CompareAndSwapInt64(&d.latency, old, old+(int64(elapsed)-old)/8) {
+			return
+		}
+	}
+}
+
+//isDiskSlow tells if the average read latency of disk `diskId` exceeds SlowDiskLatency
+func (e *Erasure) isDiskSlow(diskId int) bool {
+	if e.SlowDiskLatency <= 0 {
+		return false
+	}
+	disk := e.diskInfos[diskId]
+	return atomic.LoadInt64(&disk.reads) >= minLatencySamples &&
+		time.Duration(atomic.LoadInt64(&disk.latency)) > e.SlowDiskLatency
+}
+
+//hasSlowDisk tells if any of the used disks is slow
+func (e *Erasure) hasSlowDisk() bool {
+	for i := 0; i < e.DiskNum; i++ {
+		if e.isDiskSlow(i) {
+			return true
+		}
+	}
+	return false
+}
+
+//isBlockFast tells if block `i` of stripe `stripeNo` is alive and not on a slow disk
+func (e *Erasure) isBlockFast(fi *fileInfo, stripeNo, i int) bool {
+	return e.isBlockAlive(fi, stripeNo, i) && !e.isDiskSlow(fi.Distribution[stripeNo][i])
+}
+
+//DiskStats returns the read statistics of the used disks
+func (e *Erasure) DiskStats() []DiskStat {
+	stats := make([]DiskStat, e.DiskNum)
+	for i, disk := range e.diskInfos[:e.DiskNum] {
+		stats[i] = DiskStat{
+			Path:      disk.diskPath,
+			Available: disk.available,
+			Latency:   time.Duration(atomic.LoadInt64(&disk.latency)),
+			Reads:     atomic.LoadInt64(&disk.reads),
+			Slow:      e.isDiskSlow(i),
+		}
+	}
+	return stats
+}
+
+//ResetDiskStats clears the read statistics, e.g., after a slow disk is replaced
+func (e *Erasure) ResetDiskStats() {
+	for _, disk := range e.diskInfos {
+		atomic.StoreInt64(&disk.latency, 0)
+		atomic.StoreInt64(&disk.reads, 0)
+	}
+}
+
+//readBlocks reads blocks `want` of stripe `stripeNo` into `buf` (allStripeSize) and tells which blocks are loaded.
+//The blocks of a shortened last stripe are packed at the beginning of `buf`, see erasure-tail.go.
+//
+//A block failing to read or mismatching its checksum is made up for by blocks from `spare`,
+//so are the blocks not arrived within HedgeDelay, and then it returns as soon as k blocks are loaded.
+//On success either all of `want` or at least k blocks are loaded.
+func (e *Erasure) readBlocks(fi *fileInfo, ifs []*os.File, stripeNo int, want, spare []int, buf []byte) ([]bool, error) {
+	hedge := e.HedgeDelay > 0
+	bs := e.blockSizeOf(fi, stripeNo)
+	k, m := e.shardsOf(fi)
+	//the channel never blocks, so that late reads finish after returning
+	results := make(chan blockResult, len(want)+len(spare))
+	launched := 0
+	launch := func(i int) {
+		launched++
+		go func() {
+			dst := buf[int64(i)*bs : int64(i+1)*bs]
+			//late reads must not write into buf, so each read has its own buffer when hedging
+			if hedge {
+				dst = make([]byte, bs)
+			}
+			results <- blockResult{i, dst, e.readBlock(fi, ifs, stripeNo, i, dst)}
+		}()
+	}
+	nextSpare := 0
+	launchSpares := func(n int) {
+		for ; n > 0 && nextSpare < len(spare); n-- {
+			launch(spare[nextSpare])
+			nextSpare++
+		}
+	}
+	for _, i := range want {
+		launch(i)
+	}
+	var timer <-chan time.Time
+	if hedge {
+		t := time.NewTimer(e.HedgeDelay)
+		defer t.Stop()
+		timer = t.C
+	}
+	loaded := make([]bool, k+m)
+	nLoaded, done := 0, 0
+	//degraded tells if k blocks are enough, since some block of `want` fails or is late
+	degraded := false
+	var firstErr error
+	for done < launched && !(hedge && degraded && nLoaded >= k) {
+		select {
+		case r := <-results:
+			done++
+			if r.err != nil {
+				if r.err != errBlockCorrupted && firstErr == nil {
+					firstErr = r.err
+				}
+				degraded = true
+				//the pending reads are expected to arrive
+				launchSpares(k - nLoaded - (launched - done))
+				continue
+			}
+			if hedge {
+				copy(buf[int64(r.i)*bs:int64(r.i+1)*bs], r.data)
+			}
+			loaded[r.i] = true
+			nLoaded++
+		case <-timer:
+			timer = nil
+			degraded = true
+			//the pending reads are late, spare blocks race with them
+			launchSpares(k - nLoaded)
+		}
+	}
+	if nLoaded >= k {
+		return loaded, nil
+	}
+	for _, i := range want {
+		if !loaded[i] {
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			return nil, reedsolomon.ErrTooFewShards
+		}
+	}
+	return loaded, nil
+}
@@ -2,6 +2,7 @@ package grasure
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -138,11 +139,17 @@ func (e *Erasure) resetSystem() error {
 
 	//in-memory meta reset
 	e.FileMeta = make([]*fileInfo, 0)
+	e.TrashMeta = nil
+	e.DirMeta = nil
+	e.NameEscaped = true
+	e.PackID = 0
+	e.Scaling = nil
+	e.retired = nil
 	// for k := range e.fileMap {
 	// 	delete(e.fileMap, k)
 	// }
 	e.fileMap.Range(func(key, value interface{}) bool {
-		e.fileMap.Delete(key)
+		e.deleteFile(key.(string))
 		return true
 	})
 	err = e.WriteConfig()
@@ -182,6 +189,16 @@ func (e *Erasure) ReadConfig() error {
 	if err != nil {
 		return err
 	}
+	//the trash, directories and container number are omitted from the config when empty,
+	//and the names are escaped unless the config says so
+	e.TrashMeta = nil
+	e.DirMeta = nil
+	e.NameEscaped = false
+	e.PackID = 0
+	e.Classes = nil
+	e.Scaling = nil
+	//the containers compacted away since the config was written are still referred to by it
+	e.retired = nil
 	err = json.Unmarshal(data, &e)
 	if err != nil {
 		//if json file is broken, we try to recover it
@@ -200,45 +217,59 @@ func (e *Erasure) ReadConfig() error {
 			return err
 		}
 	}
-	//initialize the ReedSolomon Code
-	e.enc, err = reedsolomon.New(e.K, e.M,
-		reedsolomon.WithAutoGoroutines(int(e.BlockSize)),
-		reedsolomon.WithCauchyMatrix(),
-		reedsolomon.WithInversionCache(true),
-	)
+	//initialize the ReedSolomon Code, which is cached along with those of the storage classes
+	e.enc, err = e.encoderOf(e.K, e.M)
 	if err != nil {
 		return err
 	}
+	for _, sc := range e.Classes {
+		if err := e.checkParams(sc.K, sc.M, sc.BlockSize); err != nil {
+			return err
+		}
+	}
 	e.dataStripeSize = int64(e.K) * e.BlockSize
 	e.allStripeSize = int64(e.K+e.M) * e.BlockSize
 
 	e.errgroupPool.New = func() interface{} {
 		return &errgroup.Group{}
 	}
+	//the files of systems built before the namespace are named by base names
+	if !e.NameEscaped {
+		if err := e.migrateNames(); err != nil {
+			return err
+		}
+	}
 	//unzip the fileMap
 	for _, f := range e.FileMeta {
-		stripeNum := len(f.Distribution)
-		f.blockToOffset = makeArr2DInt(stripeNum, e.K+e.M)
-		f.blockInfos = make([][]*blockInfo, stripeNum)
-		countSum := make([]int, e.DiskNum)
-		for row := range f.Distribution {
-			f.blockInfos[row] = make([]*blockInfo, e.K+e.M)
-			for line := range f.Distribution[row] {
-				diskId := f.Distribution[row][line]
-				f.blockToOffset[row][line] = countSum[diskId]
-				f.blockInfos[row][line] = &blockInfo{bstat: blkOK}
-				countSum[diskId]++
+		if f.K != 0 {
+			if err := e.checkParams(f.K, f.M, f.BlockSize); err != nil {
+				return err
+			}
+			if _, err := e.encoderOf(f.K, f.M); err != nil {
+				return err
 			}
 		}
+		countSum := e.unzipFileInfo(f)
 		//update the numBlocks
 		for i := range countSum {
 			e.diskInfos[i].numBlocks += countSum[i]
 		}
-		e.fileMap.Store(f.FileName, f)
+		e.storeFile(f)
 		// e.fileMap[f.FileName] = f
 
 	}
 	e.FileMeta = make([]*fileInfo, 0)
+	//interrupted updates and commits are finished if committed
+	if err := e.replayJournals(); err != nil {
+		return err
+	}
+	//while the staged files of interrupted encodes are never committed
+	if err := e.sweepStaging(); err != nil {
+		return err
+	}
+	if err := e.loadParityLogs(); err != nil {
+		return err
+	}
 	// we
 	//e.sEnc, err = reedsolomon.NewStreamC(e.K, e.M, conReads, conWrites)
 	// if err != nil {
@@ -248,6 +279,33 @@ func (e *Erasure) ReadConfig() error {
 	return nil
 }
 
+//unzipFileInfo derives the in-memory fields of `fi` from its distribution and offsets,
+//and returns how many blocks every disk holds.
+func (e *Erasure) unzipFileInfo(fi *fileInfo) []int {
+	stripeNum := len(fi.Distribution)
+	k, m := e.shardsOf(fi)
+	fi.blockToOffset = makeArr2DInt(stripeNum, k+m)
+	fi.blockInfos = make([][]*blockInfo, stripeNum)
+	countSum := make([]int, e.DiskNum)
+	next := make([]int, e.DiskNum)
+	for row := range fi.Distribution {
+		fi.blockInfos[row] = make([]*blockInfo, k+m)
+		for line := range fi.Distribution[row] {
+			diskId := fi.Distribution[row][line]
+			offset := next[diskId]
+			if row < len(fi.Offsets) {
+				offset = fi.Offsets[row][line]
+			}
+			fi.blockToOffset[row][line] = offset
+			fi.blockInfos[row][line] = &blockInfo{bstat: blkOK}
+			countSum[diskId]++
+			next[diskId] = max(next[diskId], offset+1)
+		}
+	}
+	fi.markStale()
+	return countSum
+}
+
 //Replicate the config file into the system for k-fold
 //it's NOT striped and encoded as a whole piece.
 func (e *Erasure) replicateConfig(k int) error {
@@ -268,20 +326,16 @@ func (e *Erasure) replicateConfig(k int) error {
 //WriteConfig writes the erasure parameters and file information list into config files.
 //
 //Calling it after actions like encode and read is a good habit.
+//The config and every replica are replaced by renaming, so they're either the old one or the new one after a crash.
 func (e *Erasure) WriteConfig() error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	f, err := os.OpenFile(e.ConfigFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
 	// we marsh filemap into fileLists
 	// for _, v := range e.fileMap {
 	// 	e.FileMeta = append(e.FileMeta, v)
 	// }
+	e.FileMeta = make([]*fileInfo, 0)
 	e.fileMap.Range(func(k, v interface{}) bool {
 		e.FileMeta = append(e.FileMeta, v.(*fileInfo))
 		return true
@@ -291,17 +345,24 @@ func (e *Erasure) WriteConfig() error {
 	if err != nil {
 		return err
 	}
-	buf := bufio.NewWriter(f)
-	_, err = buf.Write(data)
+	err = writeAtomic(e.ConfigFile, data)
 	if err != nil {
 		return err
 	}
-	buf.Flush()
-	// f.Sync()
-	err = e.updateConfigReplica()
+	err = e.updateConfigReplica(data)
 	if err != nil {
 		return err
 	}
+	//the updates are recorded in the config, so their journals are no longer needed
+	for _, name := range e.journaled {
+		e.dropJournal(name)
+	}
+	e.journaled = nil
+	for _, name := range e.renames {
+		e.dropRenamed(name)
+	}
+	e.renames = nil
+	e.removeRetired()
 	return nil
 }
 
@@ -323,8 +384,8 @@ func (e *Erasure) rebuildConfig() error {
 	return nil
 }
 
-//update the config file of all replica
-func (e *Erasure) updateConfigReplica() error {
+//update the config file of all replica with `data`
+func (e *Erasure) updateConfigReplica(data []byte) error {
 
 	//we read file meta in the disk path and try to rebuild the config file
 	if e.ReplicateFactor < 1 {
@@ -336,7 +397,7 @@ func (e *Erasure) updateConfigReplica() error {
 		if ok, err := pathExist(replicaPath); !ok && err == nil {
 			continue
 		}
-		_, err = copyFile(e.ConfigFile, replicaPath)
+		err = writeAtomic(replicaPath, data)
 		if err != nil {
 			return err
 		}
@@ -344,14 +405,51 @@ func (e *Erasure) updateConfigReplica() error {
 	return nil
 }
 
+//writeAtomic writes `data` into file `path` through a temporary file renamed into place
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	if err := syncFile(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 //RemoveFile deletes specific file `filename`in the system.
 //
-//Both the file blobs and meta data are deleted. It's currently irreversible.
+//Both the file blobs and meta data are deleted, along with the old versions of the file.
+//In trash mode, they're moved into the trash instead, from which Undelete brings the file back.
 func (e *Erasure) RemoveFile(filename string) error {
-	baseFilename := filepath.Base(filename)
-	if _, ok := e.fileMap.Load(baseFilename); !ok {
+	return e.RemoveFileWithContext(context.Background(), filename)
+}
+
+//RemoveFileWithContext is like RemoveFile, but gives up if `ctx` is done before anything is deleted.
+//
+//Once started, the removal runs to completion so that no file is left half deleted.
+func (e *Erasure) RemoveFileWithContext(ctx context.Context, filename string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return e.removeFile(fileKey(filename))
+}
+
+//removeFile deletes the file of key `baseFilename` in the system
+func (e *Erasure) removeFile(baseFilename string) error {
+	intFi, ok := e.fileMap.Load(baseFilename)
+	if !ok {
 		return fmt.Errorf("the file %s does not exist in the file system",
-			baseFilename)
+			fileName(baseFilename))
+	}
+	if e.Trash {
+		if _, err := e.trashFile(intFi.(*fileInfo)); err != nil {
+			return err
+		}
+		if !e.Quiet {
+			log.Printf("file %s moved into the trash.", fileName(baseFilename))
+		}
+		return nil
 	}
 	g := new(errgroup.Group)
 
@@ -376,10 +474,15 @@ func (e *Erasure) RemoveFile(filename string) error {
 	if err := g.Wait(); err != nil {
 		return err
 	}
-	e.fileMap.Delete(baseFilename)
+	e.dropJournal(baseFilename)
+	e.dropParityLog(baseFilename)
+	for _, id := range intFi.(*fileInfo).Versions {
+		e.dropVersion(baseFilename, id)
+	}
+	e.deleteFile(baseFilename)
 	// delete(e.fileMap, filename)
 	if !e.Quiet {
-		log.Printf("file %s successfully deleted.", baseFilename)
+		log.Printf("file %s successfully deleted.", fileName(baseFilename))
 	}
 	return nil
 }
@@ -387,7 +490,7 @@ func (e *Erasure) RemoveFile(filename string) error {
 //check if file exists both in config and storage blobs
 func (e *Erasure) checkIfFileExist(filename string) (bool, error) {
 	//1. first check the storage blobs if file still exists
-	baseFilename := filepath.Base(filename)
+	baseFilename := fileKey(filename)
 
 	g := new(errgroup.Group)
 
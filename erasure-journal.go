@@ -0,0 +1,420 @@
+package grasure
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+//the directory on every disk where updates are journaled before being applied
+const journalDir = ".journal"
+
+//journal records the blocks an update writes, so that the update is applied either completely or not at all.
+//
+//Every disk has a log `<name>.log` of (block offset, block) records for its BLOB.
+//Once all logs are durable, the new file info is written as `<name>.commit` on every disk,
+//and the first commit renamed into place is the commit point of the update.
+//Committed journals are applied to the BLOBs, and replayed by ReadConfig after a crash.
+//Once applied, the commit is renamed to `<name>.applied`,
+//so the file info is kept until the config is written while the next update of the file logs afresh.
+//
+//Unavailable disks take no part in a journal, the blocks they miss are listed in fileInfo.RepairList by degraded updates.
+type journal struct {
+	e *Erasure
+
+	//the file being updated
+	name string
+
+	//the block size of the file, which every record is of
+	blockSize int64
+
+	//the log of every disk
+	logs []*os.File
+
+	//mus guard the logs, as stripes are logged concurrently
+	mus []sync.Mutex
+}
+
+//newJournal creates empty logs for the update of `baseFileName` of `blockSize` blocks on every available disk
+func (e *Erasure) newJournal(baseFileName string, blockSize int64) (*journal, error) {
+	j := &journal{
+		e:         e,
+		name:      baseFileName,
+		blockSize: blockSize,
+		logs:      make([]*os.File, e.DiskNum),
+		mus:       make([]sync.Mutex, e.DiskNum),
+	}
+	for i, disk := range e.diskInfos[:e.DiskNum] {
+		if !disk.available {
+			continue
+		}
+		root := filepath.Join(disk.diskPath, journalDir)
+		if err := os.MkdirAll(root, 0777); err != nil {
+			j.discard()
+			return nil, err
+		}
+		f, err := os.OpenFile(filepath.Join(root, baseFileName+".log"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			j.discard()
+			return nil, err
+		}
+		j.logs[i] = f
+	}
+	return j, nil
+}
+
+//log records that `block` is to be written at `offset` (in blocks) of the BLOB on disk `diskId`.
+//A short block of the last stripe is recorded padded, see padBlock.
+func (j *journal) log(diskId, offset int, block []byte) error {
+	j.mus[diskId].Lock()
+	defer j.mus[diskId].Unlock()
+	if j.logs[diskId] == nil {
+		return &diskError{j.e.diskInfos[diskId].diskPath, " available flag set false"}
+	}
+	var head [8]byte
+	binary.LittleEndian.PutUint64(head[:], uint64(offset))
+	if _, err := j.logs[diskId].Write(head[:]); err != nil {
+		return err
+	}
+	_, err := j.logs[diskId].Write(padBlock(block, j.blockSize))
+	return err
+}
+
+//commit makes the logs durable and then records `fi`, the file info after the update, on every disk.
+//
+//Once commit returns nil, the update survives crashes.
+func (j *journal) commit(fi *fileInfo) error {
+	for i, f := range j.logs {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		j.logs[i] = nil
+	}
+	data, err := json.Marshal(fi)
+	if err != nil {
+		return err
+	}
+	for _, disk := range j.e.diskInfos[:j.e.DiskNum] {
+		if !disk.available {
+			continue
+		}
+		if err := writeRecord(filepath.Join(disk.diskPath, journalDir), j.name+".commit", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//writeRecord writes `data` durably as file `name` in directory `root`, which is replaced by renaming,
+//so the record is either the old one or the new one after a crash.
+func writeRecord(root, name string, data []byte) error {
+	tmp := filepath.Join(root, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	if err := syncFile(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(root, name)); err != nil {
+		return err
+	}
+	return syncDir(root)
+}
+
+//discard drops an uncommitted journal, leaving the file as it was.
+//The applied journal of the former update, if any, is kept.
+func (j *journal) discard() {
+	for _, f := range j.logs {
+		if f != nil {
+			f.Close()
+		}
+	}
+	for _, disk := range j.e.diskInfos[:j.e.DiskNum] {
+		if !disk.available {
+			continue
+		}
+		root := filepath.Join(disk.diskPath, journalDir)
+		os.Remove(filepath.Join(root, j.name+".commit"))
+		os.Remove(filepath.Join(root, j.name+".commit.tmp"))
+	}
+	for _, disk := range j.e.diskInfos[:j.e.DiskNum] {
+		if !disk.available {
+			continue
+		}
+		os.Remove(filepath.Join(disk.diskPath, journalDir, j.name+".log"))
+	}
+}
+
+//applyJournal writes the logged blocks of `fi` into the BLOBs in place,
+//and truncates every BLOB to the blocks it holds after the update, which cuts off the padding of a short last stripe.
+//
+//It's idempotent, so a committed journal is replayed as many times as needed.
+func (e *Erasure) applyJournal(fi *fileInfo) error {
+	sizes := e.blobSizes(fi)
+	blockSize := e.codecOf(fi).BlockSize
+	erg := e.errgroupPool.Get().(*errgroup.Group)
+	for i, disk := range e.diskInfos[:e.DiskNum] {
+		i := i
+		disk := disk
+		if !disk.available {
+			continue
+		}
+		erg.Go(func() error {
+			lf, err := os.Open(filepath.Join(disk.diskPath, journalDir, fi.FileName+".log"))
+			if os.IsNotExist(err) {
+				//the disk was unavailable during the update, what it misses is in the repair list
+				return nil
+			} else if err != nil {
+				return err
+			}
+			defer lf.Close()
+			bf, err := os.OpenFile(filepath.Join(disk.diskPath, fi.FileName, "BLOB"), os.O_RDWR|os.O_CREATE, 0666)
+			if err != nil {
+				return err
+			}
+			defer bf.Close()
+			var head [8]byte
+			block := make([]byte, blockSize)
+			for {
+				if _, err := io.ReadFull(lf, head[:]); err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+				if _, err := io.ReadFull(lf, block); err != nil {
+					return err
+				}
+				offset := int64(binary.LittleEndian.Uint64(head[:]))
+				if _, err := bf.WriteAt(block, offset*blockSize); err != nil {
+					return err
+				}
+			}
+			if err := bf.Truncate(sizes[i]); err != nil {
+				return err
+			}
+			return bf.Sync()
+		})
+	}
+	//a failed group keeps its error, so it's not put back
+	if err := erg.Wait(); err != nil {
+		return err
+	}
+	e.errgroupPool.Put(erg)
+	return nil
+}
+
+//publish applies the committed journal of `fi` and makes `fi` the current version of the file.
+func (e *Erasure) publish(fi *fileInfo) error {
+	if err := e.applyJournal(fi); err != nil {
+		return err
+	}
+	if err := e.markApplied(fi.FileName); err != nil {
+		return err
+	}
+	e.storeFile(fi)
+	e.mu.Lock()
+	e.journaled = append(e.journaled, fi.FileName)
+	e.mu.Unlock()
+	return nil
+}
+
+//markApplied renames the commit of `baseFileName` to `<name>.applied` on every disk.
+//
+//An interrupted rename leaves some commit in place, so the journal is applied again.
+//Disks missing the commit took no part in the update.
+func (e *Erasure) markApplied(baseFileName string) error {
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if !disk.available {
+			continue
+		}
+		root := filepath.Join(disk.diskPath, journalDir)
+		err := os.Rename(filepath.Join(root, baseFileName+".commit"), filepath.Join(root, baseFileName+".applied"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := syncDir(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//dropJournal removes the journal of `baseFileName` from every disk.
+//
+//The commits go first, so that an interrupted drop never leaves a commit without its logs.
+func (e *Erasure) dropJournal(baseFileName string) {
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		root := filepath.Join(disk.diskPath, journalDir)
+		os.Remove(filepath.Join(root, baseFileName+".commit"))
+		os.Remove(filepath.Join(root, baseFileName+".commit.tmp"))
+		os.Remove(filepath.Join(root, baseFileName+".applied"))
+	}
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		os.Remove(filepath.Join(disk.diskPath, journalDir, baseFileName+".log"))
+	}
+}
+
+//replayJournals finishes the updates interrupted by a crash during warm-up, with e.mu held by ReadConfig.
+//
+//Committed updates are applied again and their file info takes effect, so does the file info of applied ones.
+//The uncommitted logs are discarded, and the journals are dropped once the config is written.
+//A disk unavailable during some updates may keep older journals, so the latest commit or applied journal of a file wins.
+//The interrupted commits of staged directories are finished likewise, see finishStaged, and so are renames, see finishRenamed.
+func (e *Erasure) replayJournals() error {
+	commits := make(map[string]string)
+	applied := make(map[string]string)
+	staged := make(map[string]string)
+	renames := make(map[string]string)
+	logged := make(map[string]bool)
+	mtimes := make(map[string]time.Time)
+	latest := func(m map[string]string, name, path string, entry os.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if old, ok := m[name]; !ok || info.ModTime().After(mtimes[old]) {
+			m[name] = path
+		}
+		mtimes[path] = info.ModTime()
+		return nil
+	}
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		root := filepath.Join(disk.diskPath, journalDir)
+		entries, err := os.ReadDir(root)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasSuffix(name, ".commit") {
+				if err := latest(commits, strings.TrimSuffix(name, ".commit"), filepath.Join(root, name), entry); err != nil {
+					return err
+				}
+			} else if strings.HasSuffix(name, ".applied") {
+				if err := latest(applied, strings.TrimSuffix(name, ".applied"), filepath.Join(root, name), entry); err != nil {
+					return err
+				}
+			} else if strings.HasSuffix(name, ".staged") {
+				if err := latest(staged, strings.TrimSuffix(name, ".staged"), filepath.Join(root, name), entry); err != nil {
+					return err
+				}
+			} else if strings.HasSuffix(name, ".renamed") {
+				if err := latest(renames, name, filepath.Join(root, name), entry); err != nil {
+					return err
+				}
+			} else if strings.HasSuffix(name, ".log") {
+				logged[strings.TrimSuffix(name, ".log")] = true
+			}
+		}
+	}
+	for name := range logged {
+		if _, ok := commits[name]; ok {
+			continue
+		}
+		if _, ok := applied[name]; ok {
+			//the logs are either applied or of an unfinished update following the applied one
+			for _, disk := range e.diskInfos[:e.DiskNum] {
+				os.Remove(filepath.Join(disk.diskPath, journalDir, name+".log"))
+			}
+			continue
+		}
+		e.dropJournal(name)
+	}
+	//an interrupted commit of staged directories is finished, unless the file infos are recorded since
+	for name, path := range staged {
+		if old, ok := applied[name]; ok && mtimes[old].After(mtimes[path]) {
+			e.dropStaged(name)
+			continue
+		}
+		if err := e.finishStaged(path); err != nil {
+			return err
+		}
+		delete(commits, name)
+		delete(applied, name)
+	}
+	//a commit is more recent than the applied journal of the same file, unless it's left by an older update
+	for name, path := range commits {
+		if old, ok := applied[name]; ok && mtimes[old].After(mtimes[path]) {
+			delete(commits, name)
+			continue
+		}
+		applied[name] = path
+	}
+	//the journals and renames take effect in the order they were written,
+	//as the journals older than a rename are of the former names, see finishRenamed
+	names := make([]string, 0, len(applied))
+	for name := range applied {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return mtimes[applied[names[i]]].Before(mtimes[applied[names[j]]]) })
+	renamed := make([]string, 0, len(renames))
+	for _, path := range renames {
+		renamed = append(renamed, path)
+	}
+	sort.Slice(renamed, func(i, j int) bool { return mtimes[renamed[i]].Before(mtimes[renamed[j]]) })
+	for _, name := range names {
+		path := applied[name]
+		for len(renamed) > 0 && mtimes[renamed[0]].Before(mtimes[path]) {
+			if err := e.finishRenamed(renamed[0]); err != nil {
+				return err
+			}
+			renamed = renamed[1:]
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fi := &fileInfo{}
+		if err := json.Unmarshal(data, fi); err != nil {
+			return err
+		}
+		//the journal may be renamed since, by migrateNames
+		fi.FileName = name
+		e.unzipFileInfo(fi)
+		if _, ok := commits[name]; ok {
+			if err := e.applyJournal(fi); err != nil {
+				return err
+			}
+			if err := e.markApplied(name); err != nil {
+				return err
+			}
+		}
+		e.storeFile(fi)
+		e.journaled = append(e.journaled, name)
+	}
+	for _, path := range renamed {
+		if err := e.finishRenamed(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//syncFile flushes the content of file `path`
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -6,17 +6,37 @@ func (e *Erasure) generateLayout(fi *fileInfo) {
 	if fi == nil {
 		return
 	}
-	stripeNum := int(ceilFracInt64(fi.FileSize, e.dataStripeSize))
-	fi.Distribution = make([][]int, stripeNum)
-	fi.blockToOffset = makeArr2DInt(stripeNum, e.K+e.M)
-	countSum := make([]int, e.DiskNum)
-	for i := 0; i < stripeNum; i++ {
-		fi.Distribution[i] = genRandomArr(e.DiskNum, 0)[:e.K+e.M]
-		for j := 0; j < e.K+e.M; j++ {
-			diskId := fi.Distribution[i][j]
-			fi.blockToOffset[i][j] = countSum[diskId]
-			countSum[diskId]++
+	stripeNum := int(ceilFracInt64(fi.FileSize, e.codecOf(fi).dataStripeSize))
+	fi.Distribution = make([][]int, 0, stripeNum)
+	fi.blockToOffset = make([][]int, 0, stripeNum)
+	e.growLayout(fi, make([]int, e.DiskNum), stripeNum)
+}
+
+//nextOffsets returns the offset past the last block of `fi` on every disk, where its new stripes are placed
+func (e *Erasure) nextOffsets(fi *fileInfo) []int {
+	next := make([]int, e.DiskNum)
+	for stripeNo, row := range fi.Distribution {
+		for i, diskId := range row {
+			next[diskId] = max(next[diskId], fi.blockToOffset[stripeNo][i]+1)
 		}
+	}
+	return next
+}
 
+//growLayout appends `num` randomly distributed stripes to fi.Distribution and fi.blockToOffset.
+//
+//countSum tells the offset where the next block of the file goes on every disk, see nextOffsets, and is updated in place.
+func (e *Erasure) growLayout(fi *fileInfo, countSum []int, num int) {
+	k, m := e.shardsOf(fi)
+	for i := 0; i < num; i++ {
+		dist := genRandomArr(e.DiskNum, 0)[:k+m]
+		offsets := make([]int, k+m)
+		for j := 0; j < k+m; j++ {
+			diskId := dist[j]
+			offsets[j] = countSum[diskId]
+			countSum[diskId]++
+		}
+		fi.Distribution = append(fi.Distribution, dist)
+		fi.blockToOffset = append(fi.blockToOffset, offsets)
 	}
 }
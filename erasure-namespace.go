@@ -0,0 +1,343 @@
+package grasure
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//Files in the system are named by slash-separated paths like `a/b/report.pdf`, relative to the root of the system.
+//A path is cleaned as path.Clean does, so `/a/./b/../report.pdf` and `a/report.pdf` name the same file.
+//
+//Every file still has a single directory `<disk>/<key>` on every disk, whose name is the key of the file,
+//i.e., its path with every byte but letters, digits, '-', '_' and non-leading '.' escaped as %XX.
+//So '/' doesn't nest the directories on disks, and no path collides with system directories like .journal,
+//or with old versions, whose keys end with an unescaped `~v<id>`. The journals and parity logs are named by keys too.
+//
+//Directories are implied by the paths of files, whose counts under every directory are indexed in memory,
+//and those made by Mkdir are kept in the config even if empty.
+//Old versions and the containers of packed files, keyed `.pack<id>`, are kept out of the namespace.
+
+//maxKeyLen is the longest key of a file, leaving room for the suffixes of staging, journal and trash entries
+const maxKeyLen = 200
+
+//escapeName escapes the bytes of `name` unsafe for a directory on disks as %XX
+func escapeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' && i > 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+//cleanName returns the shortest path in the system equivalent to `name`, without leading '/'
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+//fileKey returns the key of file `name`
+func fileKey(name string) string {
+	return escapeName(cleanName(name))
+}
+
+//fileName returns the path of the file of key `baseFileName`
+func fileName(baseFileName string) string {
+	name, err := url.PathUnescape(baseFileName)
+	if err != nil {
+		return baseFileName
+	}
+	return name
+}
+
+//storeFile makes `fi` the file of key fi.FileName, indexing the directories of its path if it's new
+func (e *Erasure) storeFile(fi *fileInfo) {
+	e.dirMu.Lock()
+	defer e.dirMu.Unlock()
+	if _, ok := e.fileMap.Load(fi.FileName); !ok {
+		e.indexDirs(fi.FileName, 1)
+	}
+	e.fileMap.Store(fi.FileName, fi)
+}
+
+//deleteFile removes the file of key `baseFileName` from fileMap and the directory index
+func (e *Erasure) deleteFile(baseFileName string) {
+	e.dirMu.Lock()
+	defer e.dirMu.Unlock()
+	if _, ok := e.fileMap.LoadAndDelete(baseFileName); ok {
+		e.indexDirs(baseFileName, -1)
+	}
+}
+
+//indexDirs adds `delta` to the file counts of the directories above the file of key `baseFileName`, with dirMu held.
+//Old versions and containers are out of the namespace, so they're not counted.
+func (e *Erasure) indexDirs(baseFileName string, delta int) {
+	if isHiddenName(baseFileName) {
+		return
+	}
+	if e.dirIndex == nil {
+		e.dirIndex = make(map[string]int)
+	}
+	for dir := path.Dir(fileName(baseFileName)); dir != "."; dir = path.Dir(dir) {
+		if e.dirIndex[dir] += delta; e.dirIndex[dir] <= 0 {
+			delete(e.dirIndex, dir)
+		}
+	}
+}
+
+//checkNewFile tells if a file of key `baseFileName` can be created,
+//that is, the key is valid, and neither the path is a directory nor any of its parents is a file.
+func (e *Erasure) checkNewFile(baseFileName string) error {
+	if baseFileName == "" {
+		return errInvalidFileName
+	}
+	if len(baseFileName) > maxKeyLen {
+		return errFileNameTooLong
+	}
+	name := fileName(baseFileName)
+	if e.isDir(name) {
+		return errIsDir
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := e.fileMap.Load(escapeName(dir)); ok {
+			return errNotDir
+		}
+	}
+	return nil
+}
+
+//isDir tells if the cleaned path `name` is a directory, either made by Mkdir or holding some file
+func (e *Erasure) isDir(name string) bool {
+	if name == "" {
+		return true
+	}
+	e.mu.RLock()
+	i := sort.SearchStrings(e.DirMeta, name)
+	found := i < len(e.DirMeta) && e.DirMeta[i] == name
+	e.mu.RUnlock()
+	if found {
+		return true
+	}
+	e.dirMu.Lock()
+	defer e.dirMu.Unlock()
+	return e.dirIndex[name] > 0
+}
+
+//dirEntries returns the files and directories right under the cleaned path `name`, by their base names
+func (e *Erasure) dirEntries(name string) map[string]os.FileInfo {
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+	entries := make(map[string]os.FileInfo)
+	addDir := func(rest string) {
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			rest = rest[:i]
+		}
+		if _, ok := entries[rest]; !ok {
+			entries[rest] = &fileStat{name: rest, isDir: true}
+		}
+	}
+	e.fileMap.Range(func(key, value interface{}) bool {
+		if isHiddenName(key.(string)) {
+			return true
+		}
+		fn := fileName(key.(string))
+		if !strings.HasPrefix(fn, prefix) {
+			return true
+		}
+		if rest := fn[len(prefix):]; strings.Contains(rest, "/") {
+			addDir(rest)
+		} else {
+			entries[rest] = value.(*fileInfo).stat()
+		}
+		return true
+	})
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	//the directories under `name` are contiguous in the sorted list
+	for _, dir := range e.DirMeta[sort.SearchStrings(e.DirMeta, prefix):] {
+		if !strings.HasPrefix(dir, prefix) {
+			break
+		}
+		addDir(dir[len(prefix):])
+	}
+	return entries
+}
+
+//stat returns the os.FileInfo describing the file
+func (fi *fileInfo) stat() *fileStat {
+	return &fileStat{name: path.Base(fileName(fi.FileName)), size: fi.FileSize, modTime: fi.ModTime, mode: fi.Mode}
+}
+
+//Mkdir makes directory `name` in the system along with any missing parents, as os.MkdirAll does.
+//
+//It fails with errNotDir if `name` or any of its parents is a file.
+//Directories take no room on disks, they're only recorded in the config.
+func (e *Erasure) Mkdir(name string) error {
+	name = cleanName(name)
+	if name == "" {
+		return nil
+	}
+	if len(escapeName(name)) > maxKeyLen {
+		return errFileNameTooLong
+	}
+	var dirs []string
+	for dir := name; dir != "."; dir = path.Dir(dir) {
+		if _, ok := e.fileMap.Load(escapeName(dir)); ok {
+			return errNotDir
+		}
+		dirs = append(dirs, dir)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, dir := range dirs {
+		i := sort.SearchStrings(e.DirMeta, dir)
+		if i < len(e.DirMeta) && e.DirMeta[i] == dir {
+			continue
+		}
+		e.DirMeta = append(e.DirMeta, "")
+		copy(e.DirMeta[i+1:], e.DirMeta[i:])
+		e.DirMeta[i] = dir
+	}
+	return nil
+}
+
+//RemoveDir removes the empty directory `name` from the system.
+//
+//A directory holding files or directories is never removed, errDirNotEmpty is returned instead.
+func (e *Erasure) RemoveDir(name string) error {
+	name = cleanName(name)
+	if name == "" {
+		return errInvalidFileName
+	}
+	if _, ok := e.fileMap.Load(escapeName(name)); ok {
+		return errNotDir
+	}
+	if !e.isDir(name) {
+		return errPathNotFound
+	}
+	if len(e.dirEntries(name)) > 0 {
+		return errDirNotEmpty
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i := sort.SearchStrings(e.DirMeta, name)
+	if i < len(e.DirMeta) && e.DirMeta[i] == name {
+		e.DirMeta = append(e.DirMeta[:i], e.DirMeta[i+1:]...)
+	}
+	return nil
+}
+
+//ReadDir lists the files and directories right under directory `name` in the system, sorted by name.
+//
+//Old versions are not listed, see ListVersions.
+func (e *Erasure) ReadDir(name string) ([]os.FileInfo, error) {
+	name = cleanName(name)
+	if _, ok := e.fileMap.Load(escapeName(name)); ok {
+		return nil, errNotDir
+	}
+	entries := e.dirEntries(name)
+	if len(entries) == 0 && !e.isDir(name) {
+		return nil, errPathNotFound
+	}
+	list := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+	return list, nil
+}
+
+//Stat returns the os.FileInfo describing file or directory `name` in the system.
+func (e *Erasure) Stat(name string) (os.FileInfo, error) {
+	name = cleanName(name)
+	if intFi, ok := e.fileMap.Load(escapeName(name)); ok {
+		return intFi.(*fileInfo).stat(), nil
+	}
+	if e.isDir(name) {
+		return &fileStat{name: path.Base(name), isDir: true}, nil
+	}
+	return nil, errFileNotFound
+}
+
+//migrateNames escapes the names of files kept by systems built before the namespace, which were base names
+//used as they were, and renames their directories, journals and parity logs on every disk accordingly.
+//
+//A name missing on some disk is skipped, so the migration is simply done again if interrupted.
+//It's called by ReadConfig with e.mu held.
+func (e *Erasure) migrateNames() error {
+	renamed := make(map[string]string)
+	migrate := func(fi *fileInfo) {
+		key := escapeName(fi.FileName)
+		if loc := versionSuffix.FindStringIndex(fi.FileName); loc != nil {
+			key = escapeName(fi.FileName[:loc[0]]) + fi.FileName[loc[0]:]
+		}
+		if key != fi.FileName {
+			renamed[fi.FileName] = key
+			fi.FileName = key
+		}
+	}
+	for _, fi := range e.FileMeta {
+		migrate(fi)
+	}
+	for _, ti := range e.TrashMeta {
+		migrate(ti.File)
+		for _, fi := range ti.Versions {
+			migrate(fi)
+		}
+	}
+	//a key may be the name of another file, which grows longer when escaped and so is renamed first
+	olds := make([]string, 0, len(renamed))
+	for old := range renamed {
+		olds = append(olds, old)
+	}
+	sort.Slice(olds, func(i, j int) bool {
+		return len(renamed[olds[i]]) > len(renamed[olds[j]])
+	})
+	move := func(src, dst string) error {
+		if ok, err := pathExist(dst); err != nil || ok {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		for _, old := range olds {
+			key := renamed[old]
+			if err := move(filepath.Join(disk.diskPath, old), filepath.Join(disk.diskPath, key)); err != nil {
+				return err
+			}
+			for _, ext := range []string{".log", ".commit", ".applied"} {
+				if err := move(filepath.Join(disk.diskPath, journalDir, old+ext), filepath.Join(disk.diskPath, journalDir, key+ext)); err != nil {
+					return err
+				}
+			}
+			if err := move(filepath.Join(disk.diskPath, parityLogDir, old), filepath.Join(disk.diskPath, parityLogDir, key)); err != nil {
+				return err
+			}
+			for _, ti := range e.TrashMeta {
+				if err := move(filepath.Join(disk.diskPath, trashDir, ti.Dir, old), filepath.Join(disk.diskPath, trashDir, ti.Dir, key)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := syncDir(disk.diskPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	e.NameEscaped = true
+	return nil
+}
@@ -0,0 +1,344 @@
+package grasure
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//In packing mode, i.e., PackThreshold > 0, a file smaller than PackThreshold bytes is packed into a container
+//rather than striped on its own, which would take a whole stripe and a directory on every disk.
+//
+//A container is an ordinary file in the system keyed `.pack<id>`, which no file name is escaped into,
+//so it's read, recovered and repaired like any other file but never listed. Packed files are appended to
+//the container being filled, and located by the offset recorded in their file info, their size being the length.
+//A container is filled up to packStripes stripes, then a new one is started.
+//
+//The bytes of a packed file removed or replaced are left in its container, CompactPacks reclaims them.
+//Packed files have no blocks of their own, so WriteAt, Append and Truncate encode them again as a whole.
+
+//packPrefix begins the keys of containers
+const packPrefix = ".pack"
+
+//packStripes is how many stripes of data a container holds before a new one is started
+const packStripes = 64
+
+//packRef locates a packed file in its container
+type packRef struct {
+	//the container holding the file
+	Container int `json:"container"`
+
+	//where the file begins in the container
+	Offset int64 `json:"offset"`
+}
+
+//packName returns the key of container `id`
+func packName(id int) string {
+	return packPrefix + strconv.Itoa(id)
+}
+
+//isPackName tells if `baseFileName` is the key of a container
+func isPackName(baseFileName string) bool {
+	return strings.HasPrefix(baseFileName, packPrefix)
+}
+
+//isHiddenName tells if `baseFileName` is kept out of the namespace, i.e., an old version or a container
+func isHiddenName(baseFileName string) bool {
+	return isVersionName(baseFileName) || isPackName(baseFileName)
+}
+
+//packable tells if the file written is small enough to be packed, that is, none of its stripes is encoded yet.
+//
+//Packing appends to a container, which needs all disks available, otherwise the file is striped as usual.
+//Containers are of the system parameters, so a file of another storage class is never packed.
+func (w *fileWriter) packable() bool {
+	e := w.e
+	return e.PackThreshold > 0 && w.jn == nil && w.stripeNo == 0 && w.fi.FileSize < e.PackThreshold &&
+		!isPackName(w.fi.FileName) && w.c.K == e.K && w.c.M == e.M && w.c.BlockSize == e.BlockSize &&
+		e.allDisksAvailable()
+}
+
+//pack packs the buffered data into a container and publishes the file, dropping the staged BLOBs.
+func (w *fileWriter) pack() error {
+	e := w.e
+	fi := w.fi
+	for i := range w.of {
+		w.of[i].Close()
+	}
+	removeAll(w.staged)
+	data := make([]byte, fi.FileSize)
+	for s, n := 0, 0; n < len(data); s++ {
+		n += copy(data[n:], w.blobBuf[s])
+	}
+	ref, err := e.packBytes(w.ctx, data)
+	if err == nil {
+		//the data are striped along with the container
+		fi.Pack = ref
+		fi.K, fi.M, fi.BlockSize = 0, 0, 0
+		fi.Hash = fmt.Sprintf("%x", w.h.Sum(nil))
+		err = e.commitFile(fi, make([]string, e.DiskNum), w.override)
+	}
+	if err != nil {
+		w.err = err
+		return err
+	}
+	if !e.Quiet {
+		log.Println(fileName(fi.FileName), " successfully packed into container ", ref.Container)
+	}
+	return nil
+}
+
+//packBytes appends `data` to the container being filled and returns where they're put
+func (e *Erasure) packBytes(ctx context.Context, data []byte) (*packRef, error) {
+	e.packMu.Lock()
+	defer e.packMu.Unlock()
+	return e.appendPack(ctx, data)
+}
+
+//appendPack is like packBytes, with packMu held.
+//
+//A full container is left as it is, and the data start a new one.
+func (e *Erasure) appendPack(ctx context.Context, data []byte) (*packRef, error) {
+	intFi, ok := e.fileMap.Load(packName(e.PackID))
+	if ok {
+		size := intFi.(*fileInfo).FileSize
+		if size > 0 && size+int64(len(data)) > packStripes*e.codecOf(intFi.(*fileInfo)).dataStripeSize {
+			e.PackID++
+			ok = false
+		}
+	}
+	key := packName(e.PackID)
+	if !ok {
+		w, err := e.newFileWriter(ctx, key, true, e.ConStripes, e.sysCodec())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			w.abort()
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return &packRef{Container: e.PackID}, nil
+	}
+	ref := &packRef{Container: e.PackID, Offset: intFi.(*fileInfo).FileSize}
+	if len(data) > 0 {
+		if _, err := e.appendFile(ctx, key, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	return ref, nil
+}
+
+//readPacked reads packed file `baseFileName` into `savepath` through its container.
+//
+//The output is checked against the file hash unless options.SkipHashCheck is set.
+func (e *Erasure) readPacked(baseFileName string, savepath string, options *Options) error {
+	f, err := e.openFile(baseFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if options.SkipHashCheck {
+		f.h = nil
+	}
+	sf, err := os.OpenFile(savepath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sf, f); err != nil {
+		sf.Close()
+		os.Remove(savepath)
+		return err
+	}
+	return sf.Close()
+}
+
+//packedFile is a file packed into a container, in the system or in the trash
+type packedFile struct {
+	fi *fileInfo
+
+	//replace puts the file info relocated in place of fi
+	replace func(nf *fileInfo)
+}
+
+//packedFiles returns the files packed into every container, old versions and those in the trash included
+func (e *Erasure) packedFiles() map[int][]packedFile {
+	files := make(map[int][]packedFile)
+	e.fileMap.Range(func(key, value interface{}) bool {
+		if fi := value.(*fileInfo); fi.Pack != nil {
+			files[fi.Pack.Container] = append(files[fi.Pack.Container], packedFile{fi, func(nf *fileInfo) {
+				e.storeFile(nf)
+			}})
+		}
+		return true
+	})
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, ti := range e.TrashMeta {
+		ti := ti
+		if fi := ti.File; fi.Pack != nil {
+			files[fi.Pack.Container] = append(files[fi.Pack.Container], packedFile{fi, func(nf *fileInfo) {
+				e.mu.Lock()
+				ti.File = nf
+				e.mu.Unlock()
+			}})
+		}
+		for i, fi := range ti.Versions {
+			i := i
+			if fi.Pack != nil {
+				files[fi.Pack.Container] = append(files[fi.Pack.Container], packedFile{fi, func(nf *fileInfo) {
+					e.mu.Lock()
+					ti.Versions[i] = nf
+					e.mu.Unlock()
+				}})
+			}
+		}
+	}
+	return files
+}
+
+//CompactPacks reclaims the room left in containers by packed files removed or replaced, see CompactPacksWithContext.
+func (e *Erasure) CompactPacks() error {
+	return e.CompactPacksWithContext(context.Background())
+}
+
+//CompactPacksWithContext reclaims the room left in containers by packed files removed or replaced,
+//giving up the containers not yet compacted once `ctx` is done.
+//
+//The files still packed into a container at least half taken by such garbage, old versions and those in the trash
+//included, are moved into the container being filled, or a new one if it's that container, and the container is retired.
+//The retired containers are removed from disks once the config is written, so the files are found where
+//the config says even if the system crashes meanwhile. It's not safe to change packed files during compaction.
+func (e *Erasure) CompactPacksWithContext(ctx context.Context) error {
+	e.packMu.Lock()
+	defer e.packMu.Unlock()
+	files := e.packedFiles()
+	var ids []int
+	e.fileMap.Range(func(key, value interface{}) bool {
+		if isPackName(key.(string)) {
+			if id, err := strconv.Atoi(key.(string)[len(packPrefix):]); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		return true
+	})
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		intFi, _ := e.fileMap.Load(packName(id))
+		//copies share the bytes of their source
+		live := make(map[[2]int64]bool)
+		var liveBytes int64
+		for _, pf := range files[id] {
+			if span := [2]int64{pf.fi.Pack.Offset, pf.fi.FileSize}; !live[span] {
+				live[span] = true
+				liveBytes += pf.fi.FileSize
+			}
+		}
+		if size := intFi.(*fileInfo).FileSize; size == 0 || liveBytes*2 > size {
+			continue
+		}
+		if err := e.compactPack(ctx, id, files[id]); err != nil {
+			return err
+		}
+		if !e.Quiet {
+			log.Printf("container %d compacted, %d bytes reclaimed.", id, intFi.(*fileInfo).FileSize-liveBytes)
+		}
+	}
+	return nil
+}
+
+//compactPack moves `files` out of container `id` into the container being filled, and retires container `id`.
+//
+//A file is moved only once its bytes are checked against its hash.
+func (e *Erasure) compactPack(ctx context.Context, id int, files []packedFile) error {
+	//the files of the container being filled are moved into a new one
+	if id == e.PackID {
+		e.PackID++
+	}
+	if len(files) > 0 {
+		f, err := e.openFile(packName(id))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		moved := make(map[[2]int64]*packRef)
+		for _, pf := range files {
+			span := [2]int64{pf.fi.Pack.Offset, pf.fi.FileSize}
+			ref, ok := moved[span]
+			if !ok {
+				data := make([]byte, pf.fi.FileSize)
+				if _, err := f.ReadAt(data, pf.fi.Pack.Offset); err != nil {
+					return err
+				}
+				if pf.fi.Hash != "" && fmt.Sprintf("%x", sha256.Sum256(data)) != pf.fi.Hash {
+					return errFileIncompleted
+				}
+				if ref, err = e.appendPack(ctx, data); err != nil {
+					return err
+				}
+				moved[span] = ref
+			}
+			//the file info is replaced rather than changed, as it may be in use
+			nf := *pf.fi
+			nf.Pack = ref
+			pf.replace(&nf)
+		}
+	}
+	e.deleteFile(packName(id))
+	e.mu.Lock()
+	e.retired = append(e.retired, packName(id))
+	e.mu.Unlock()
+	return nil
+}
+
+//removeRetired removes the directories of the retired containers and old versions from every disk,
+//with e.mu held by WriteConfig. A name taken again by a file meanwhile is left alone.
+func (e *Erasure) removeRetired() {
+	for _, name := range e.retired {
+		if _, ok := e.fileMap.Load(name); ok {
+			continue
+		}
+		for _, disk := range e.diskInfos[:e.DiskNum] {
+			os.RemoveAll(filepath.Join(disk.diskPath, name))
+		}
+		e.dropJournal(name)
+		e.dropParityLog(name)
+	}
+	e.retired = nil
+}
+
+//reclaimRetired removes the directories of the retired `names` at once, as other files are about to take the names
+func (e *Erasure) reclaimRetired(names []string) {
+	taken := make(map[string]bool)
+	for _, name := range names {
+		taken[name] = true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	retired := e.retired[:0]
+	for _, name := range e.retired {
+		if !taken[name] {
+			retired = append(retired, name)
+			continue
+		}
+		for _, disk := range e.diskInfos[:e.DiskNum] {
+			os.RemoveAll(filepath.Join(disk.diskPath, name))
+		}
+		e.dropJournal(name)
+		e.dropParityLog(name)
+	}
+	e.retired = retired
+}
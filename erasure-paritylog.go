@@ -0,0 +1,574 @@
+package grasure
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+//the directory on every disk where parity deltas are logged before being merged
+const parityLogDir = ".paritylog"
+
+//parityLog holds the parity deltas of a file not yet merged into its parity blocks.
+//
+//In parity-logging mode, i.e., ParityLogSize > 0, updates write the changed data blocks in place as usual,
+//but append the deltas of parity blocks to a log `<name>` on the disk holding them, as (block offset, delta) records.
+//The size of every log is committed along with the update in fileInfo.ParityLogSizes,
+//so the records beyond it, left by unfinished updates, are ignored.
+//
+//A parity block read is patched with its pending delta, so reconstruction sees the current parity.
+//The deltas are merged into the parity blocks once the logs of the file reach ParityLogSize bytes,
+//by MergeParityLogs or by the merger started with StartParityMerger.
+type parityLog struct {
+	//wmu serializes the updates and merges of the file
+	wmu sync.Mutex
+
+	//mu is held for reading while a parity block is read and patched, and for writing while the deltas change
+	mu sync.RWMutex
+
+	//the accumulated delta of every pending parity block, by disk and then block offset
+	deltas []map[int][]byte
+}
+
+//parityLogOf returns the parity log of `baseFileName`, which is created if not yet
+func (e *Erasure) parityLogOf(baseFileName string) *parityLog {
+	pl, _ := e.parityLogs.LoadOrStore(baseFileName, &parityLog{deltas: make([]map[int][]byte, e.DiskNum)})
+	return pl.(*parityLog)
+}
+
+//pendingParity returns the parity log of `baseFileName`, or nil if the file never logs parity deltas
+func (e *Erasure) pendingParity(baseFileName string) *parityLog {
+	pl, ok := e.parityLogs.Load(baseFileName)
+	if !ok {
+		return nil
+	}
+	return pl.(*parityLog)
+}
+
+//patch brings the parity block at `offset` of disk `diskId` up to date with its pending delta, if any
+func (pl *parityLog) patch(diskId, offset int, block []byte) {
+	if delta, ok := pl.deltas[diskId][offset]; ok {
+		xorBlock(block, delta)
+	}
+}
+
+//unpatched returns the parity block at `offset` of disk `diskId` as it's on disk, given its current content
+func (pl *parityLog) unpatched(diskId, offset int, block []byte) []byte {
+	delta, ok := pl.deltas[diskId][offset]
+	if !ok {
+		return block
+	}
+	old := append([]byte(nil), block...)
+	xorBlock(old, delta)
+	return old
+}
+
+//unpatchedStripe returns the blocks of stripe `stripeNo` as they're on disk, given their current content.
+//
+//`pl` may be nil, then the blocks are returned as they are.
+func (e *Erasure) unpatchedStripe(fi *fileInfo, pl *parityLog, stripeNo int, blocks [][]byte) [][]byte {
+	if pl == nil {
+		return blocks
+	}
+	res := append([][]byte(nil), blocks...)
+	k, _ := e.shardsOf(fi)
+	for i := k; i < len(blocks); i++ {
+		res[i] = pl.unpatched(fi.Distribution[stripeNo][i], fi.blockToOffset[stripeNo][i], blocks[i])
+	}
+	return res
+}
+
+//add accumulates the committed deltas of an update
+func (pl *parityLog) add(deltas []map[int][]byte) {
+	for diskId := range deltas {
+		for offset, delta := range deltas[diskId] {
+			if pl.deltas[diskId] == nil {
+				pl.deltas[diskId] = make(map[int][]byte)
+			}
+			if old, ok := pl.deltas[diskId][offset]; ok {
+				xorBlock(old, delta)
+			} else {
+				pl.deltas[diskId][offset] = delta
+			}
+		}
+	}
+}
+
+//parityLogger appends the parity deltas of an update to the parity logs, after the committed records
+type parityLogger struct {
+	e *Erasure
+
+	//the file being updated
+	name string
+
+	//the block size of the file, which every delta is of
+	blockSize int64
+
+	//the log of every disk, opened on demand
+	logs []*os.File
+
+	//mus guard the logs, as stripes are logged concurrently
+	mus []sync.Mutex
+
+	//the size of every log, the committed size to start with
+	sizes []int64
+
+	//the deltas appended, added into the parity log once the update is committed
+	deltas []map[int][]byte
+}
+
+func (e *Erasure) newParityLogger(fi *fileInfo) *parityLogger {
+	pw := &parityLogger{
+		e:         e,
+		name:      fi.FileName,
+		blockSize: e.codecOf(fi).BlockSize,
+		logs:      make([]*os.File, e.DiskNum),
+		mus:       make([]sync.Mutex, e.DiskNum),
+		sizes:     make([]int64, e.DiskNum),
+		deltas:    make([]map[int][]byte, e.DiskNum),
+	}
+	copy(pw.sizes, fi.ParityLogSizes)
+	return pw
+}
+
+//log records that the parity block at `offset` of disk `diskId` changes by `delta`.
+//A short delta of the last stripe is padded, see padBlock.
+func (pw *parityLogger) log(diskId, offset int, delta []byte) error {
+	delta = padBlock(delta, pw.blockSize)
+	pw.mus[diskId].Lock()
+	defer pw.mus[diskId].Unlock()
+	if pw.logs[diskId] == nil {
+		root := filepath.Join(pw.e.diskInfos[diskId].diskPath, parityLogDir)
+		if err := os.MkdirAll(root, 0777); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(root, pw.name), os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		pw.logs[diskId] = f
+	}
+	var head [8]byte
+	binary.LittleEndian.PutUint64(head[:], uint64(offset))
+	if _, err := pw.logs[diskId].WriteAt(head[:], pw.sizes[diskId]); err != nil {
+		return err
+	}
+	if _, err := pw.logs[diskId].WriteAt(delta, pw.sizes[diskId]+int64(len(head))); err != nil {
+		return err
+	}
+	pw.sizes[diskId] += int64(len(head)) + int64(len(delta))
+	if pw.deltas[diskId] == nil {
+		pw.deltas[diskId] = make(map[int][]byte)
+	}
+	if old, ok := pw.deltas[diskId][offset]; ok {
+		xorBlock(old, delta)
+	} else {
+		pw.deltas[diskId][offset] = append([]byte(nil), delta...)
+	}
+	return nil
+}
+
+//sync makes the logged deltas durable and records the log sizes into `fi`, which is committed afterwards
+func (pw *parityLogger) sync(fi *fileInfo) error {
+	defer pw.close()
+	for _, f := range pw.logs {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	fi.ParityLogSizes = pw.sizes
+	return nil
+}
+
+func (pw *parityLogger) close() {
+	for i, f := range pw.logs {
+		if f != nil {
+			f.Close()
+			pw.logs[i] = nil
+		}
+	}
+}
+
+//beginParityUpdate prepares an update of `baseFileName`.
+//
+//In parity-logging mode, the parity log of the file is returned with its wmu held, and the caller unlocks it when done.
+//Otherwise, or if some disk is unavailable, the pending deltas are merged beforehand,
+//since the parity blocks are to be written in place, and nil is returned.
+func (e *Erasure) beginParityUpdate(baseFileName string) (*parityLog, error) {
+	if e.ParityLogSize <= 0 || !e.allDisksAvailable() {
+		return nil, e.mergeParityLogOf(baseFileName)
+	}
+	pl := e.parityLogOf(baseFileName)
+	pl.wmu.Lock()
+	return pl, nil
+}
+
+//allDisksAvailable tells if none of the disks in use is unavailable
+func (e *Erasure) allDisksAvailable() bool {
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if !disk.available {
+			return false
+		}
+	}
+	return true
+}
+
+//publishParity publishes the committed update `fi` of the file, whose parity deltas are logged by `pw`.
+//
+//The logs are merged once they reach ParityLogSize bytes.
+func (e *Erasure) publishParity(fi *fileInfo, pl *parityLog, pw *parityLogger) error {
+	pl.mu.Lock()
+	err := e.publish(fi)
+	if err == nil {
+		pl.add(pw.deltas)
+	}
+	pl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	logSize := int64(0)
+	for _, size := range fi.ParityLogSizes {
+		logSize += size
+	}
+	if logSize >= e.ParityLogSize {
+		return e.mergeParityLog(fi.FileName, pl)
+	}
+	return nil
+}
+
+//MergeParityLog merges the pending parity deltas of file `filename` into its parity blocks.
+//
+//The new parity blocks are written through the journal, so a crash never merges a delta twice.
+//Like updating, merging tolerates up to m unavailable disks: the pending parity blocks on them are left stale
+//in the repair list, see RepairStale, and their deltas are dropped along with the merged ones.
+func (e *Erasure) MergeParityLog(filename string) error {
+	return e.mergeParityLogOf(fileKey(filename))
+}
+
+//mergeParityLogOf merges the pending parity deltas of the file of key `baseFileName`
+func (e *Erasure) mergeParityLogOf(baseFileName string) error {
+	pl := e.pendingParity(baseFileName)
+	if pl == nil {
+		return nil
+	}
+	pl.wmu.Lock()
+	defer pl.wmu.Unlock()
+	return e.mergeParityLog(baseFileName, pl)
+}
+
+//MergeParityLogs merges the pending parity deltas of all files.
+func (e *Erasure) MergeParityLogs() error {
+	var names []string
+	e.parityLogs.Range(func(key, value interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	for _, name := range names {
+		if err := e.mergeParityLogOf(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//StartParityMerger merges the parity logs of all files every `interval` in the background, until `ctx` is done.
+func (e *Erasure) StartParityMerger(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := e.MergeParityLogs(); err != nil && !e.Quiet {
+					log.Println("merging parity logs fails for", err)
+				}
+			}
+		}
+	}()
+}
+
+//mergeParityLog merges the parity log of `baseFileName` with pl.wmu held.
+func (e *Erasure) mergeParityLog(baseFileName string, pl *parityLog) error {
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return nil
+	}
+	fi := intFi.(*fileInfo)
+	if len(fi.ParityLogSizes) == 0 {
+		return nil
+	}
+	c := e.codecOf(fi)
+	ifs, alive := e.openBlobs(baseFileName, os.O_RDONLY)
+	defer closeBlobs(ifs)
+	if e.DiskNum-alive > c.M {
+		return errTooFewDisksAlive
+	}
+	//the merged version has no pending deltas, and the checksums of the merged parity blocks
+	newFi := &fileInfo{
+		FileName:      fi.FileName,
+		FileSize:      fi.FileSize,
+		Hash:          fi.Hash,
+		HashState:     fi.HashState,
+		Distribution:  fi.Distribution,
+		Offsets:       fi.Offsets,
+		BlockSums:     append([][]uint32(nil), fi.BlockSums...),
+		RepairList:    fi.RepairList,
+		VersionID:     fi.VersionID,
+		Versions:      fi.Versions,
+		Mode:          fi.Mode,
+		ModTime:       fi.ModTime,
+		TailBlockSize: fi.TailBlockSize,
+		K:             fi.K,
+		M:             fi.M,
+		BlockSize:     fi.BlockSize,
+		blockToOffset: fi.blockToOffset,
+		blockInfos:    fi.blockInfos,
+	}
+	rl := newRepairList(fi, len(fi.Distribution))
+	jn, err := e.newJournal(baseFileName, c.BlockSize)
+	if err != nil {
+		return err
+	}
+	//the stripes with pending parity blocks
+	var stripes []int
+	for stripeNo, row := range fi.Distribution {
+		for i := c.K; i < c.K+c.M; i++ {
+			if _, ok := pl.deltas[row[i]][fi.blockToOffset[stripeNo][i]]; ok {
+				stripes = append(stripes, stripeNo)
+				break
+			}
+		}
+	}
+	for first := 0; first < len(stripes); first += e.ConStripes {
+		eg := e.errgroupPool.Get().(*errgroup.Group)
+		for _, stripeNo := range stripes[first:min(len(stripes), first+e.ConStripes)] {
+			stripeNo := stripeNo
+			eg.Go(func() error {
+				return e.mergeStripe(fi, newFi, ifs, jn, rl, pl, stripeNo)
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			jn.discard()
+			return err
+		}
+		e.errgroupPool.Put(eg)
+	}
+	//the block infos are shared with the current version, so they're made anew to mark the blocks left stale
+	if alive < e.DiskNum {
+		newFi.RepairList = rl.list()
+		e.unzipFileInfo(newFi)
+	}
+	if err := jn.commit(newFi); err != nil {
+		jn.discard()
+		return err
+	}
+	closeBlobs(ifs)
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if err := e.publish(newFi); err != nil {
+		return err
+	}
+	pl.deltas = make([]map[int][]byte, e.DiskNum)
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		os.Remove(filepath.Join(disk.diskPath, parityLogDir, baseFileName))
+	}
+	if !e.Quiet {
+		log.Println(baseFileName, " parity log merged.")
+	}
+	return nil
+}
+
+//mergeStripe journals the pending parity blocks of stripe `stripeNo` brought up to date,
+//those on unavailable disks are recorded as stale in `rl` instead.
+func (e *Erasure) mergeStripe(fi, newFi *fileInfo, ifs []*os.File, jn *journal, rl *repairList, pl *parityLog, stripeNo int) error {
+	var sums []uint32
+	if stripeNo < len(newFi.BlockSums) && newFi.BlockSums[stripeNo] != nil {
+		sums = append([]uint32(nil), newFi.BlockSums[stripeNo]...)
+		newFi.BlockSums[stripeNo] = sums
+	}
+	c := e.codecOf(fi)
+	var splitData [][]byte
+	for i := c.K; i < c.K+c.M; i++ {
+		diskId := fi.Distribution[stripeNo][i]
+		offset := fi.blockToOffset[stripeNo][i]
+		if _, ok := pl.deltas[diskId][offset]; !ok {
+			continue
+		}
+		if !e.diskInfos[diskId].available {
+			rl.markStale(stripeNo, i)
+			continue
+		}
+		//the block read is patched, a corrupted one is reconstructed from the stripe instead
+		block := make([]byte, e.blockSizeOf(fi, stripeNo))
+		if err := e.readBlock(fi, ifs, stripeNo, i, block); err != nil {
+			if splitData == nil {
+				splitData, err = e.readStripe(fi, ifs, stripeNo, make([]byte, c.allStripeSize), false)
+				if err != nil {
+					return err
+				}
+			}
+			block = splitData[i]
+		}
+		if sums != nil {
+			sums[i] = blockSum(block)
+		}
+		if err := jn.log(diskId, offset, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//restoredBlock returns block `i` of stripe `stripeNo` as it's on disk once the failed disks in `replaceMap` are restored,
+//given its current content: the pending parity blocks of surviving disks are left stale, the restored ones are up to date.
+func (e *Erasure) restoredBlock(fi *fileInfo, pl *parityLog, replaceMap map[int]int, stripeNo, i int, block []byte) []byte {
+	diskId := fi.Distribution[stripeNo][i]
+	k, _ := e.shardsOf(fi)
+	if _, ok := replaceMap[diskId]; ok || pl == nil || i < k {
+		return block
+	}
+	return pl.unpatched(diskId, fi.blockToOffset[stripeNo][i], block)
+}
+
+//restoredSums returns the checksums of stripe `stripeNo` once its pending parity blocks of the failed disks in `replaceMap`
+//are restored from `splitData`, or nil if the stripe has none of them.
+func (e *Erasure) restoredSums(fi *fileInfo, pl *parityLog, replaceMap map[int]int, stripeNo int, splitData [][]byte) []uint32 {
+	if stripeNo >= len(fi.BlockSums) || fi.BlockSums[stripeNo] == nil {
+		return nil
+	}
+	var sums []uint32
+	k, m := e.shardsOf(fi)
+	for i := k; i < k+m; i++ {
+		diskId := fi.Distribution[stripeNo][i]
+		if _, ok := replaceMap[diskId]; !ok {
+			continue
+		}
+		if _, ok := pl.deltas[diskId][fi.blockToOffset[stripeNo][i]]; !ok {
+			continue
+		}
+		if sums == nil {
+			sums = append([]uint32(nil), fi.BlockSums[stripeNo]...)
+		}
+		sums[i] = blockSum(splitData[i])
+	}
+	return sums
+}
+
+//dropRestoredParity forgets the pending deltas of the failed disks in `replaceMap` after they're restored,
+//and records the checksums `sums` of the restored parity blocks by stripe.
+func (e *Erasure) dropRestoredParity(fi *fileInfo, pl *parityLog, replaceMap map[int]int, sums map[int][]uint32) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if len(sums) > 0 {
+		blockSums := append([][]uint32(nil), fi.BlockSums...)
+		for stripeNo, row := range sums {
+			blockSums[stripeNo] = row
+		}
+		fi.BlockSums = blockSums
+	}
+	sizes := append([]int64(nil), fi.ParityLogSizes...)
+	for diskId := range replaceMap {
+		pl.deltas[diskId] = nil
+		if diskId < len(sizes) {
+			sizes[diskId] = 0
+		}
+	}
+	fi.ParityLogSizes = sizes
+}
+
+//dropParityLog removes the parity log of `baseFileName` from every disk and forgets its pending deltas
+func (e *Erasure) dropParityLog(baseFileName string) {
+	e.parityLogs.Delete(baseFileName)
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		os.Remove(filepath.Join(disk.diskPath, parityLogDir, baseFileName))
+	}
+}
+
+//loadParityLogs reads the pending parity deltas of all files during warm-up.
+//
+//The records beyond the committed sizes are cut off, and the logs of files without pending deltas are removed.
+func (e *Erasure) loadParityLogs() error {
+	e.parityLogs.Range(func(key, value interface{}) bool {
+		e.parityLogs.Delete(key)
+		return true
+	})
+	for diskId, disk := range e.diskInfos[:e.DiskNum] {
+		root := filepath.Join(disk.diskPath, parityLogDir)
+		entries, err := os.ReadDir(root)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			var size, blockSize int64
+			if intFi, ok := e.fileMap.Load(name); ok && diskId < len(intFi.(*fileInfo).ParityLogSizes) {
+				size = intFi.(*fileInfo).ParityLogSizes[diskId]
+				blockSize = e.codecOf(intFi.(*fileInfo)).BlockSize
+			}
+			if size == 0 {
+				os.Remove(filepath.Join(root, name))
+				continue
+			}
+			if err := e.loadParityLog(e.parityLogOf(name), diskId, filepath.Join(root, name), size, blockSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//loadParityLog reads the first `size` bytes of the log at `path` of disk `diskId` into `pl`, and cuts off the rest.
+//The deltas are of `blockSize` bytes.
+func (e *Erasure) loadParityLog(pl *parityLog, diskId int, path string, size, blockSize int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	deltas := make([]map[int][]byte, e.DiskNum)
+	deltas[diskId] = make(map[int][]byte)
+	var head [8]byte
+	for {
+		if _, err := io.ReadFull(f, head[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		delta := make([]byte, blockSize)
+		if _, err := io.ReadFull(f, delta); err != nil {
+			return err
+		}
+		offset := int(binary.LittleEndian.Uint64(head[:]))
+		if old, ok := deltas[diskId][offset]; ok {
+			xorBlock(old, delta)
+		} else {
+			deltas[diskId][offset] = delta
+		}
+	}
+	pl.add(deltas)
+	return nil
+}
+
+//xorBlock xors `src` into `dst`
+func xorBlock(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
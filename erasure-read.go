@@ -1,6 +1,10 @@
 package grasure
 
 import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
@@ -15,60 +19,59 @@ import (
 //
 //In case of any failure within fault tolerance, the file will be decoded first.
 //`degrade` indicates whether degraded read is enabled.
+//
+//The output is hashed while written and errFileIncompleted is returned if it mismatches the file hash,
+//unless options.SkipHashCheck is set.
+//
+//If options.SkipParity is set, only the data blocks of healthy stripes are read, relying on the hash check
+//to detect corruption. On mismatch, the file is read again with every stripe verified by parity.
+//
+//If options.Repair is set, failed blocks on available disks are written back once reconstructed.
 func (e *Erasure) ReadFile(filename string, savepath string, options *Options) error {
-	baseFileName := filepath.Base(filename)
+	return e.ReadFileWithContext(context.Background(), filename, savepath, options)
+}
+
+//ReadFileWithContext is like ReadFile, but stops reading once `ctx` is done.
+//
+//The context error is returned then, and the incomplete `savePath` is removed.
+func (e *Erasure) ReadFileWithContext(ctx context.Context, filename string, savepath string, options *Options) error {
+	return e.readFile(ctx, fileKey(filename), savepath, options)
+}
+
+//readFile reads the file of key `baseFileName` into `savepath`
+func (e *Erasure) readFile(ctx context.Context, baseFileName string, savepath string, options *Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	intFi, ok := e.fileMap.Load(baseFileName)
 	if !ok {
 		return errFileNotFound
 	}
 	fi := intFi.(*fileInfo)
+	if fi.Pack != nil {
+		return e.readPacked(baseFileName, savepath, options)
+	}
+	c := e.codecOf(fi)
 
 	fileSize := fi.FileSize
-	stripeNum := int(ceilFracInt64(fileSize, e.dataStripeSize))
-	dist := fi.Distribution
+	stripeNum := int(ceilFracInt64(fileSize, c.dataStripeSize))
 	//first we check the number of alive disks
 	// to judge if any part need reconstruction
-	alive := int32(0)
-	ifs := make([]*os.File, e.DiskNum)
-	erg := new(errgroup.Group)
-
-	for i, disk := range e.diskInfos[:e.DiskNum] {
-		i := i
-		disk := disk
-		erg.Go(func() error {
-			folderPath := filepath.Join(disk.diskPath, baseFileName)
-			blobPath := filepath.Join(folderPath, "BLOB")
-			if !disk.available {
-				return &diskError{disk.diskPath, " available flag set false"}
-			}
-			ifs[i], err = os.Open(blobPath)
-			if err != nil {
-				disk.available = false
-				return err
-			}
-
-			disk.available = true
-			atomic.AddInt32(&alive, 1)
-			return nil
-		})
-	}
-	if err := erg.Wait(); err != nil {
-		if !e.Quiet {
-			log.Printf("%s", err.Error())
-		}
+	//reconstructed blocks are written back in repair mode
+	flag := os.O_RDONLY
+	if options.Repair {
+		flag = os.O_RDWR
 	}
-	defer func() {
-		for i := 0; i < e.DiskNum; i++ {
-			if ifs[i] != nil {
-				ifs[i].Close()
-			}
-		}
-	}()
-	if int(alive) < e.K {
+	ifs, alive := e.openBlobs(baseFileName, flag)
+	defer closeBlobs(ifs)
+	if alive < c.K {
 		//the disk renders inrecoverable
 		return errTooFewDisksAlive
 	}
-	if int(alive) == e.DiskNum {
+	//with failed or slow disks, every stripe reads k blocks chosen to balance the load of surviving disks
+	balanced := alive < e.DiskNum || e.hasSlowDisk()
+	var scheme [][]int
+	if !balanced {
 		if !e.Quiet {
 			log.Println("start reading blocks")
 		}
@@ -76,6 +79,10 @@ func (e *Erasure) ReadFile(filename string, savepath string, options *Options) e
 		if !e.Quiet {
 			log.Println("start reconstructing blocks")
 		}
+		var err error
+		if scheme, err = e.balanceLoad(fi); err != nil {
+			return err
+		}
 	}
 	//for local save path
 	sf, err := os.OpenFile(savepath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
@@ -83,6 +90,11 @@ func (e *Erasure) ReadFile(filename string, savepath string, options *Options) e
 		return err
 	}
 	defer sf.Close()
+	//the output is checked against the file hash, containers and files written in place or truncated have none
+	var h hash.Hash
+	if !options.SkipHashCheck && fi.Hash != "" {
+		h = sha256.New()
+	}
 
 	//Since the file is striped, we have to reconstruct each stripe
 	//for each stripe we rejoin the data
@@ -90,101 +102,78 @@ func (e *Erasure) ReadFile(filename string, savepath string, options *Options) e
 	stripeCnt := 0
 	nextStripe := 0
 	for blob := 0; blob < numBlob; blob++ {
+		if err := ctx.Err(); err != nil {
+			sf.Close()
+			os.Remove(savepath)
+			return err
+		}
 		if stripeCnt+e.ConStripes > stripeNum {
 			nextStripe = stripeNum - stripeCnt
 		} else {
 			nextStripe = e.ConStripes
 		}
 		eg := e.errgroupPool.Get().(*errgroup.Group)
-		blobBuf := makeArr2DByte(e.ConStripes, int(e.allStripeSize))
+		blobBuf := makeArr2DByte(nextStripe, int(c.allStripeSize))
 		for s := 0; s < nextStripe; s++ {
 			s := s
 			stripeNo := stripeCnt + s
 			// offset := int64(subCnt) * e.allStripeSize
 			eg.Go(func() error {
-				erg := e.errgroupPool.Get().(*errgroup.Group)
-				defer e.errgroupPool.Put(erg)
-				//read all blocks in parallel
-				//We only have to read k blocks to rec
-				failList := make(map[int]bool)
-				for i := 0; i < e.K+e.M; i++ {
-					i := i
-					diskId := dist[stripeNo][i]
-					disk := e.diskInfos[diskId]
-					blkStat := fi.blockInfos[stripeNo][i]
-					if !disk.available || blkStat.bstat != blkOK {
-						failList[diskId] = true
-						continue
-					}
-					erg.Go(func() error {
-
-						//we also need to know the block's accurate offset with respect to disk
-						offset := fi.blockToOffset[stripeNo][i]
-						_, err := ifs[diskId].ReadAt(blobBuf[s][int64(i)*e.BlockSize:int64(i+1)*e.BlockSize],
-							int64(offset)*e.BlockSize)
-						// fmt.Println("Read ", n, " bytes at", i, ", block ", block)
-						if err != nil && err != io.EOF {
-							return err
-						}
-						return nil
-					})
-				}
-				if err := erg.Wait(); err != nil {
-					return err
+				var splitData [][]byte
+				var err error
+				if balanced {
+					splitData, err = e.readScheme(fi, ifs, stripeNo, scheme[stripeNo], blobBuf[s],
+						options.Degrade || options.SkipParity)
+				} else if options.SkipParity {
+					splitData, err = e.readDataBlocks(fi, ifs, stripeNo, 0, c.K-1, blobBuf[s])
+				} else {
+					splitData, err = e.readStripe(fi, ifs, stripeNo, blobBuf[s], options.Degrade)
 				}
-				//Split the blob into k+m parts
-				splitData, err := e.splitStripe(blobBuf[s])
 				if err != nil {
 					return err
 				}
-				//verify and reconstruct if broken
-				ok, err := e.enc.Verify(splitData)
-				if err != nil {
-					return err
-				}
-				if !ok {
-					// fmt.Println("reconstruct data of stripe:", stripeNo)
-					err = e.enc.ReconstructWithList(splitData,
-						&failList,
-						&(fi.Distribution[stripeNo]),
-						options.Degrade)
-
-					// err = e.enc.ReconstructWithKBlocks(splitData,
-					// 	&failList,
-					// 	&loadBalancedScheme[stripeNo],
-					// 	&(fi.Distribution[stripeNo]),
-					// 	degrade)
-					if err != nil {
+				if options.Repair && e.needRepair(fi, stripeNo) {
+					//parity is not reconstructed in degraded or parity-skipping reads
+					if options.Degrade || options.SkipParity {
+						splitData, err = e.readStripe(fi, ifs, stripeNo, blobBuf[s], false)
+						if err != nil {
+							return err
+						}
+					}
+					if err := e.repairStripe(fi, ifs, stripeNo, splitData); err != nil {
 						return err
 					}
 				}
 				//join and write to output file
+				erg := e.errgroupPool.Get().(*errgroup.Group)
 
-				for i := 0; i < e.K; i++ {
+				bs := e.blockSizeOf(fi, stripeNo)
+				for i := 0; i < c.K; i++ {
 					i := i
-					writeOffset := int64(stripeNo)*e.dataStripeSize + int64(i)*e.BlockSize
-					if fileSize-writeOffset <= e.BlockSize {
-						leftLen := fileSize - writeOffset
-						_, err := sf.WriteAt(splitData[i][:leftLen], writeOffset)
-						if err != nil {
-							return err
-						}
-						break
+					writeOffset := int64(stripeNo)*c.dataStripeSize + int64(i)*bs
+					//the last block of the file is cut short
+					leftLen := bs
+					if fileSize-writeOffset < bs {
+						leftLen = fileSize - writeOffset
 					}
 					erg.Go(func() error {
 						// fmt.Println("i:", i, "writeOffset", writeOffset+e.BlockSize, "at stripe", subCnt)
-						_, err := sf.WriteAt(splitData[i], writeOffset)
+						_, err := sf.WriteAt(splitData[i][:leftLen], writeOffset)
 						if err != nil {
 							return err
 						}
 						// sf.Sync()
 						return nil
 					})
-
+					if fileSize-writeOffset <= bs {
+						break
+					}
 				}
+				//a failed group keeps its error, so it's not put back
 				if err := erg.Wait(); err != nil {
 					return err
 				}
+				e.errgroupPool.Put(erg)
 				return nil
 			})
 
@@ -193,24 +182,375 @@ func (e *Erasure) ReadFile(filename string, savepath string, options *Options) e
 			return err
 		}
 		e.errgroupPool.Put(eg)
+		if h != nil {
+			//the data blocks are decoded in place, so they are contiguous in the buffer
+			for s := 0; s < nextStripe; s++ {
+				stripeOffset := int64(stripeCnt+s) * c.dataStripeSize
+				if fileSize-stripeOffset < c.dataStripeSize {
+					h.Write(blobBuf[s][:fileSize-stripeOffset])
+				} else {
+					h.Write(blobBuf[s][:c.dataStripeSize])
+				}
+			}
+		}
 		stripeCnt += nextStripe
 
 	}
+	if h != nil && fmt.Sprintf("%x", h.Sum(nil)) != fi.Hash {
+		if !options.SkipParity {
+			return errFileIncompleted
+		}
+		if !e.Quiet {
+			log.Printf("hash of %s mismatches, read again with parity", fileName(baseFileName))
+		}
+		sf.Close()
+		retry := *options
+		retry.SkipParity = false
+		return e.readFile(ctx, baseFileName, savepath, &retry)
+	}
 	if !e.Quiet {
-		log.Printf("reading %s...", filename)
+		log.Printf("reading %s...", fileName(baseFileName))
+	}
+	return nil
+}
+
+//openBlobs opens the BLOB of `baseFileName` on every disk with `flag`, e.g., os.O_RDONLY.
+//
+//Disks whose BLOB can not be opened are marked unavailable, the number of alive disks is returned.
+func (e *Erasure) openBlobs(baseFileName string, flag int) ([]*os.File, int) {
+	alive := int32(0)
+	ifs := make([]*os.File, e.DiskNum)
+	erg := new(errgroup.Group)
+
+	for i, disk := range e.diskInfos[:e.DiskNum] {
+		i := i
+		disk := disk
+		erg.Go(func() error {
+			folderPath := filepath.Join(disk.diskPath, baseFileName)
+			blobPath := filepath.Join(folderPath, "BLOB")
+			if !disk.available {
+				return &diskError{disk.diskPath, " available flag set false"}
+			}
+			f, err := os.OpenFile(blobPath, flag, 0666)
+			if err != nil {
+				disk.available = false
+				return err
+			}
+			ifs[i] = f
+			disk.available = true
+			atomic.AddInt32(&alive, 1)
+			return nil
+		})
+	}
+	if err := erg.Wait(); err != nil {
+		if !e.Quiet {
+			log.Printf("%s", err.Error())
+		}
+	}
+	return ifs, int(alive)
+}
+
+//closeBlobs closes the opened BLOBs
+func closeBlobs(ifs []*os.File) {
+	for i := range ifs {
+		if ifs[i] != nil {
+			ifs[i].Close()
+		}
+	}
+}
+
+//readStripe reads all blocks of stripe `stripeNo` into `buf` (allStripeSize) and splits it into k+m blocks.
+//
+//Blocks on unavailable disks, marked failed or mismatching their checksums are reconstructed,
+//so are the blocks on slow disks or arriving late, see readBlocks.
+//Only data blocks are recovered if `degrade` is on.
+func (e *Erasure) readStripe(fi *fileInfo, ifs []*os.File, stripeNo int, buf []byte, degrade bool) ([][]byte, error) {
+	c := e.codecOf(fi)
+	//slow disks are skipped while enough blocks are left, they serve as spares then
+	want := make([]int, 0, c.K+c.M)
+	spare := make([]int, 0)
+	for i := 0; i < c.K+c.M; i++ {
+		if e.isBlockFast(fi, stripeNo, i) {
+			want = append(want, i)
+		} else if e.isBlockAlive(fi, stripeNo, i) {
+			spare = append(spare, i)
+		}
+	}
+	if len(want) < c.K {
+		want, spare = append(want, spare...), nil
+	}
+	//read all blocks in parallel
+	loaded, err := e.readBlocks(fi, ifs, stripeNo, want, spare, buf)
+	if err != nil {
+		return nil, err
+	}
+	failList := make([]int, 0)
+	for i := 0; i < c.K+c.M; i++ {
+		if !loaded[i] {
+			failList = append(failList, i)
+		}
+	}
+	//Split the blob into k+m parts
+	splitData, err := c.splitStripe(buf[:e.stripeSizeOf(fi, stripeNo)])
+	if err != nil {
+		return nil, err
+	}
+	if len(failList) == 0 {
+		//verify the stripe in case of silent corruption, which can not be located though
+		ok, err := c.enc.Verify(splitData)
+		if err != nil {
+			return nil, err
+		}
+		if !ok && !e.Quiet {
+			log.Printf("stripe %d of %s fails verification", stripeNo, fi.FileName)
+		}
+		return splitData, nil
+	}
+	//the unread blocks must be reconstructed even if the stripe happens to verify
+	if len(failList) > c.M {
+		return nil, reedsolomon.ErrTooFewShards
+	}
+	//the failed blocks are emptied while the capacity is kept,
+	//so that they are reconstructed in place
+	for _, i := range failList {
+		splitData[i] = splitData[i][:0]
+	}
+	if degrade {
+		err = c.enc.ReconstructData(splitData)
+	} else {
+		err = c.enc.Reconstruct(splitData)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return splitData, nil
+}
+
+//isBlockAlive tells if block `i` of stripe `stripeNo` lies on an available disk and is not marked failed
+func (e *Erasure) isBlockAlive(fi *fileInfo, stripeNo, i int) bool {
+	diskId := fi.Distribution[stripeNo][i]
+	return e.diskInfos[diskId].available && fi.blockInfos[stripeNo][i].bstat == blkOK
+}
+
+//readDataBlocks reads data blocks `first` to `last` of stripe `stripeNo` into `buf` (allStripeSize) and splits it into k+m blocks.
+//
+//If any of them lies on an unavailable or slow disk, is marked failed, mismatches its checksum or arrives late,
+//k surviving blocks are read instead and the missing data blocks are reconstructed.
+//Blocks outside [first, last] are left undefined.
+func (e *Erasure) readDataBlocks(fi *fileInfo, ifs []*os.File, stripeNo, first, last int, buf []byte) ([][]byte, error) {
+	c := e.codecOf(fi)
+	requested := func(i int) bool {
+		return first <= i && i <= last
+	}
+	//the surviving blocks in order of preference:
+	//the requested blocks first, then the other data blocks and parity, slow disks last
+	order := make([]int, 0, c.K+c.M)
+	for _, fast := range []bool{true, false} {
+		for _, req := range []bool{true, false} {
+			for i := 0; i < c.K+c.M; i++ {
+				if requested(i) == req && e.isBlockAlive(fi, stripeNo, i) && e.isBlockFast(fi, stripeNo, i) == fast {
+					order = append(order, i)
+				}
+			}
+		}
+	}
+	healthy := true
+	for i := first; i <= last; i++ {
+		healthy = healthy && e.isBlockFast(fi, stripeNo, i)
+	}
+	var want, spare []int
+	if healthy {
+		//the requested blocks are exactly the first ones
+		want, spare = order[:last-first+1], order[last-first+1:]
+	} else if len(order) < c.K {
+		return nil, reedsolomon.ErrTooFewShards
+	} else {
+		want, spare = order[:c.K], order[c.K:]
+	}
+	loaded, err := e.readBlocks(fi, ifs, stripeNo, want, spare, buf)
+	if err != nil {
+		return nil, err
+	}
+	splitData, err := c.splitStripe(buf[:e.stripeSizeOf(fi, stripeNo)])
+	if err != nil {
+		return nil, err
+	}
+	degraded := false
+	for i := first; i <= last; i++ {
+		degraded = degraded || !loaded[i]
+	}
+	if !degraded {
+		return splitData, nil
+	}
+	//only the blocks loaded are kept for reconstruction,
+	//the others are emptied while the capacity is kept, so that they are reconstructed in place
+	for i := range splitData {
+		if !loaded[i] {
+			splitData[i] = splitData[i][:0]
+		}
+	}
+	if err := c.enc.ReconstructData(splitData); err != nil {
+		return nil, err
+	}
+	return splitData, nil
+}
+
+//readScheme reads the `chosen` k blocks of stripe `stripeNo` into `buf` (allStripeSize) and decodes the others,
+//only data blocks are recovered if `degrade` is on.
+//
+//Chosen blocks that are corrupted or late are made up for by the other surviving blocks.
+func (e *Erasure) readScheme(fi *fileInfo, ifs []*os.File, stripeNo int, chosen []int, buf []byte, degrade bool) ([][]byte, error) {
+	c := e.codecOf(fi)
+	isChosen := make([]bool, c.K+c.M)
+	for _, i := range chosen {
+		isChosen[i] = true
+	}
+	spare := make([]int, 0, c.M)
+	for _, fast := range []bool{true, false} {
+		for i := 0; i < c.K+c.M; i++ {
+			if !isChosen[i] && e.isBlockAlive(fi, stripeNo, i) && e.isBlockFast(fi, stripeNo, i) == fast {
+				spare = append(spare, i)
+			}
+		}
+	}
+	loaded, err := e.readBlocks(fi, ifs, stripeNo, chosen, spare, buf)
+	if err != nil {
+		return nil, err
+	}
+	splitData, err := c.splitStripe(buf[:e.stripeSizeOf(fi, stripeNo)])
+	if err != nil {
+		return nil, err
+	}
+	//the blocks not loaded are emptied while the capacity is kept, so that they are reconstructed in place
+	for i := range splitData {
+		if !loaded[i] {
+			splitData[i] = splitData[i][:0]
+		}
+	}
+	if degrade {
+		err = c.enc.ReconstructData(splitData)
+	} else {
+		err = c.enc.Reconstruct(splitData)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return splitData, nil
+}
+
+//ReadRange writes `length` bytes of file `filename` starting at `offset` to `w`.
+//
+//Only the data blocks overlapping the range are read when they are healthy,
+//otherwise k surviving blocks of the affected stripes are read and decoded.
+//A range covering the whole file is checked against the file hash, errFileIncompleted is returned on mismatch.
+func (e *Erasure) ReadRange(filename string, offset, length int64, w io.Writer) error {
+	baseFileName := fileKey(filename)
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	if offset < 0 || length < 0 {
+		return errNegativeOffset
+	}
+	if offset+length > fi.FileSize {
+		return errRangeOutOfFile
+	}
+	if length == 0 {
+		return nil
+	}
+	if fi.Pack != nil {
+		//a packed file is read through its container, and checked against the file hash if read sequentially
+		f, err := e.openFile(baseFileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if offset == 0 && length == fi.FileSize {
+			_, err = io.Copy(w, f)
+		} else {
+			_, err = io.Copy(w, io.NewSectionReader(f, offset, length))
+		}
+		return err
+	}
+	c := e.codecOf(fi)
+	ifs, alive := e.openBlobs(baseFileName, os.O_RDONLY)
+	defer closeBlobs(ifs)
+	if alive < c.K {
+		return errTooFewDisksAlive
+	}
+	var h hash.Hash
+	if offset == 0 && length == fi.FileSize && fi.Hash != "" {
+		h = sha256.New()
+	}
+	end := offset + length
+	firstStripe := int(offset / c.dataStripeSize)
+	lastStripe := int((end - 1) / c.dataStripeSize)
+	stripeNum := lastStripe - firstStripe + 1
+	numBlob := ceilFracInt(stripeNum, e.ConStripes)
+	stripeCnt := 0
+	nextStripe := 0
+	blobBuf := makeArr2DByte(e.ConStripes, int(c.allStripeSize))
+	for blob := 0; blob < numBlob; blob++ {
+		if stripeCnt+e.ConStripes > stripeNum {
+			nextStripe = stripeNum - stripeCnt
+		} else {
+			nextStripe = e.ConStripes
+		}
+		//the bytes of the range in every stripe
+		lo := make([]int64, nextStripe)
+		hi := make([]int64, nextStripe)
+		eg := e.errgroupPool.Get().(*errgroup.Group)
+		for s := 0; s < nextStripe; s++ {
+			s := s
+			stripeNo := firstStripe + stripeCnt + s
+			stripeOffset := int64(stripeNo) * c.dataStripeSize
+			lo[s] = 0
+			if offset > stripeOffset {
+				lo[s] = offset - stripeOffset
+			}
+			hi[s] = c.dataStripeSize
+			if end < stripeOffset+c.dataStripeSize {
+				hi[s] = end - stripeOffset
+			}
+			bs := e.blockSizeOf(fi, stripeNo)
+			first := int(lo[s] / bs)
+			last := int((hi[s] - 1) / bs)
+			eg.Go(func() error {
+				_, err := e.readDataBlocks(fi, ifs, stripeNo, first, last, blobBuf[s])
+				return err
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+		e.errgroupPool.Put(eg)
+		//the data blocks are decoded in place, so they are contiguous in the buffer
+		for s := 0; s < nextStripe; s++ {
+			if _, err := w.Write(blobBuf[s][lo[s]:hi[s]]); err != nil {
+				return err
+			}
+			if h != nil {
+				h.Write(blobBuf[s][lo[s]:hi[s]])
+			}
+		}
+		stripeCnt += nextStripe
+	}
+	if h != nil && fmt.Sprintf("%x", h.Sum(nil)) != fi.Hash {
+		return errFileIncompleted
 	}
 	return nil
 }
 
-func (e *Erasure) splitStripe(data []byte) ([][]byte, error) {
+func (c *codec) splitStripe(data []byte) ([][]byte, error) {
 	if len(data) == 0 {
 		return nil, reedsolomon.ErrShortData
 	}
 	// Calculate number of bytes per data shard.
-	perShard := ceilFracInt(len(data), e.K+e.M)
+	perShard := ceilFracInt(len(data), c.K+c.M)
 
 	// Split into equal-length shards.
-	dst := make([][]byte, e.K+e.M)
+	dst := make([][]byte, c.K+c.M)
 	i := 0
 	for ; i < len(dst) && len(data) >= perShard; i++ {
 		dst[i], data = data[:perShard:perShard], data[perShard:]
@@ -1,10 +1,11 @@
 package grasure
 
 import (
-	"io"
+	"context"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -27,6 +28,17 @@ func (e *Erasure) getFileNum() int {
 //
 //An (oldPath -> replacedPath) replace map is returned in the first placeholder.
 func (e *Erasure) Recover(options *Options) (map[string]string, error) {
+	return e.RecoverWithContext(context.Background(), options)
+}
+
+//RecoverWithContext is like Recover, but stops recovering once `ctx` is done.
+//
+//The context error is returned then. The disk paths are left unchanged
+//and the blobs restored so far are removed from the backup disks, so recovery can be started over.
+func (e *Erasure) RecoverWithContext(ctx context.Context, options *Options) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	totalFiles := e.getFileNum()
 	if !e.Quiet {
 		log.Printf("Start recovering, totally %d files need recovery",
@@ -43,8 +55,14 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 	if failNum == 0 {
 		return nil, nil
 	}
-	//the failure number exceeds the fault tolerance
-	if failNum > e.M {
+	//the failure number exceeds the fault tolerance of some file, which depends on its storage class
+	tolerable := true
+	e.fileMap.Range(func(_, fi interface{}) bool {
+		_, m := e.shardsOf(fi.(*fileInfo))
+		tolerable = fi.(*fileInfo).Pack != nil || failNum <= m
+		return tolerable
+	})
+	if !tolerable {
 		return nil, errTooFewDisksAlive
 	}
 	//the failure number doesn't exceed the fault tolerance
@@ -55,20 +73,24 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 	//the failed disks are mapped to backup disks
 	replaceMap := make(map[int]int)
 	ReplaceMap := make(map[string]string)
-	diskFailList := make(map[int]bool, failNum)
 	j := e.DiskNum
 	// think what if backup also breaks down, future stuff
 	for i := 0; i < e.DiskNum; i++ {
 		if !e.diskInfos[i].available {
 			ReplaceMap[e.diskInfos[i].diskPath] = e.diskInfos[j].diskPath
 			replaceMap[i] = j
-			diskFailList[i] = true
 			j++
 		}
 	}
 	//start recovering: traversing the files
 
 	erg := new(errgroup.Group)
+	//the directories created on backup disks, removed if recovery fails
+	var createdMu sync.Mutex
+	var created []string
+	//the parity deltas pending on the failed disks and their stale blocks are dropped once recovery succeeds,
+	//since the blocks restored are up to date
+	var restored []func()
 	// var ifpool, rfpool sync.Pool
 	// ifpool.New = func() interface{} {
 	// 	out := make([]*os.File, e.DiskNum)
@@ -79,8 +101,15 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 	// 	return &out
 	// }
 	e.fileMap.Range(func(filename, fi interface{}) bool {
+		if ctx.Err() != nil {
+			return false
+		}
 		basefilename := filename.(string)
 		fd := fi.(*fileInfo)
+		//a packed file is recovered along with its container
+		if fd.Pack != nil {
+			return true
+		}
 		//These files can be repaired concurrently
 		// rfs := *rfpool.Get().(*[]*os.File) //restore fs
 		// ifs := *ifpool.Get().(*[]*os.File)
@@ -91,7 +120,6 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 		erg.Go(func() error {
 			//read the current disks
 			erg := e.errgroupPool.Get().(*errgroup.Group)
-			defer e.errgroupPool.Put(erg)
 			for i, disk := range e.diskInfos[:e.DiskNum] {
 				i := i
 				disk := disk
@@ -135,6 +163,9 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 					if err := os.Mkdir(folderPath, 0666); err != nil {
 						return errDataDirExist
 					}
+					createdMu.Lock()
+					created = append(created, folderPath)
+					createdMu.Unlock()
 					rfs[i], err = os.OpenFile(blobPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 					if err != nil {
 						return err
@@ -146,6 +177,8 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 			if err := erg.Wait(); err != nil {
 				return err
 			}
+			//a failed group keeps its error, so it's put back only now
+			e.errgroupPool.Put(erg)
 			defer func() {
 				for i := 0; i < failNum; i++ {
 					if rfs[i] != nil {
@@ -153,6 +186,11 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 					}
 				}
 			}()
+			//plan which surviving blocks to read
+			scheme, err := e.balanceLoad(fd)
+			if err != nil {
+				return err
+			}
 			//recover the file and write to restore path
 			//we read the survival blocks
 			//Since the file is striped, we have to reconstruct each stripe
@@ -162,8 +200,21 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 			numBlob := ceilFracInt(stripeNum, e.ConStripes)
 			stripeCnt := 0
 			nextStripe := 0
-			blobBuf := makeArr2DByte(e.ConStripes, int(e.allStripeSize))
+			c := e.codecOf(fd)
+			blobBuf := makeArr2DByte(e.ConStripes, int(c.allStripeSize))
+			//files encoded without checksums have them recorded along the way
+			var sums [][]uint32
+			if len(fd.BlockSums) < stripeNum {
+				sums = make([][]uint32, stripeNum)
+			}
+			//updates and merges need all disks available, so the pending deltas don't change meanwhile
+			pl := e.pendingParity(basefilename)
+			var plSums map[int][]uint32
+			var plMu sync.Mutex
 			for blob := 0; blob < numBlob; blob++ {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
 				if stripeCnt+e.ConStripes > stripeNum {
 					nextStripe = stripeNum - stripeCnt
 				} else {
@@ -175,54 +226,35 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 					stripeNo := stripeCnt + s
 					// offset := int64(subCnt) * e.allStripeSize
 					eg.Go(func() error {
-						erg := e.errgroupPool.Get().(*errgroup.Group)
-						defer e.errgroupPool.Put(erg)
 						//read all blocks in parallel
 						//there are three cases of repairing
 						//1. none of the failed disks contain the blocks
 						//2. some of the failed disks contain the blocks
 						//3. all of the failed disks contain the blocks
-						for i := 0; i < e.K+e.M; i++ {
-							i := i
-							diskId := dist[stripeNo][i]
-							disk := e.diskInfos[diskId]
-							if !disk.available {
-								continue
-							}
-							erg.Go(func() error {
-								//we also need to know the block's accurate offset with respect to disk
-								offset := fd.blockToOffset[stripeNo][i]
-								_, err := ifs[diskId].ReadAt(blobBuf[s][int64(i)*e.BlockSize:int64(i+1)*e.BlockSize],
-									int64(offset)*e.BlockSize)
-								// fmt.Println("Read ", n, " bytes at", i, ", block ", block)
-								if err != nil && err != io.EOF {
-									return err
-								}
-								return nil
-							})
-						}
-						if err := erg.Wait(); err != nil {
-							return err
-						}
-						//Split the blob into k+m parts
-						splitData, err := e.splitStripe(blobBuf[s])
+						//k blocks are read as planned by balanceLoad,
+						//the parity blocks are also restored, so the stripe is fully reconstructed
+						splitData, err := e.readScheme(fd, ifs, stripeNo, scheme[stripeNo], blobBuf[s], false)
 						if err != nil {
 							return err
 						}
-						ok, err := e.enc.Verify(splitData)
-						if err != nil {
-							return err
-						}
-						if !ok {
-							err = e.enc.ReconstructWithList(splitData, &diskFailList, &(fd.Distribution[stripeNo]), options.Degrade)
-							if err != nil {
-								return err
+						if sums != nil {
+							sums[stripeNo] = make([]uint32, c.K+c.M)
+							for i := range splitData {
+								sums[stripeNo][i] = blockSum(e.restoredBlock(fd, pl, replaceMap, stripeNo, i, splitData[i]))
+							}
+						} else if pl != nil {
+							if row := e.restoredSums(fd, pl, replaceMap, stripeNo, splitData); row != nil {
+								plMu.Lock()
+								if plSums == nil {
+									plSums = make(map[int][]uint32)
+								}
+								plSums[stripeNo] = row
+								plMu.Unlock()
 							}
-						} 
+						}
 						//write the Blob to restore paths
 						egp := e.errgroupPool.Get().(*errgroup.Group)
-						defer e.errgroupPool.Put(egp)
-						for i := 0; i < e.K+e.M; i++ {
+						for i := 0; i < c.K+c.M; i++ {
 							i := i
 							diskId := dist[stripeNo][i]
 							if v, ok := replaceMap[diskId]; ok {
@@ -230,7 +262,7 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 								writeOffset := fd.blockToOffset[stripeNo][i]
 								egp.Go(func() error {
 									_, err := rfs[restoreId].WriteAt(splitData[i],
-										int64(writeOffset)*e.BlockSize)
+										int64(writeOffset)*c.BlockSize)
 									if err != nil {
 										return err
 									}
@@ -250,6 +282,7 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 						if err := egp.Wait(); err != nil {
 							return err
 						}
+						e.errgroupPool.Put(egp)
 						return nil
 					})
 
@@ -261,6 +294,17 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 				stripeCnt += nextStripe
 
 			}
+			if sums != nil {
+				fd.BlockSums = sums
+			}
+			createdMu.Lock()
+			restored = append(restored, func() {
+				if pl != nil {
+					e.dropRestoredParity(fd, pl, replaceMap, plSums)
+				}
+				e.dropRestoredStale(fd, replaceMap)
+			})
+			createdMu.Unlock()
 			if !e.Quiet {
 				log.Printf("reading %s!", filename)
 			}
@@ -277,9 +321,19 @@ func (e *Erasure) Recover(options *Options) (map[string]string, error) {
 		return true
 	})
 	//do not forget to recover the meta replicas
-	if err := erg.Wait(); err != nil {
+	err := erg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		for _, folderPath := range created {
+			os.RemoveAll(folderPath)
+		}
 		return nil, err
 	}
+	for _, drop := range restored {
+		drop()
+	}
 	err = e.updateDiskPath(replaceMap)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,374 @@
+package grasure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+//Rename renames file `oldName` in the system to `newName`, along with its old versions.
+//
+//The directories of the file are renamed on every disk, and put back if any rename fails,
+//so the file is found under either name but never half renamed. The blocks are neither read nor moved.
+//A file named `newName` is replaced only with Override. It's moved into the trash beforehand and brought back
+//if the rename fails, then removed once the config is written unless in trash mode, where it stays in the trash.
+//The rename is recorded beforehand, so after a crash it's finished by ReadConfig rather than
+//leaving the config to describe the directories moved, see finishRenamed.
+//Files are renamed one by one, renaming a directory is not supported.
+func (e *Erasure) Rename(oldName, newName string) error {
+	oldBase, newBase := fileKey(oldName), fileKey(newName)
+	if isVersionName(oldBase) || isReservedName(newBase) {
+		return errReservedFileName
+	}
+	if _, ok := e.fileMap.Load(oldBase); !ok {
+		return errFileNotFound
+	}
+	if oldBase == newBase {
+		return nil
+	}
+	intDst, replacing := e.fileMap.Load(newBase)
+	if replacing && !e.Override {
+		return fmt.Errorf("the file %s has already been in the file system, if you wish to override, please attach `-o`",
+			fileName(newBase))
+	} else if !replacing {
+		if err := e.checkNewFile(newBase); err != nil {
+			return err
+		}
+	}
+	//the parity log is named after the file, so its pending deltas are merged beforehand
+	if err := e.mergeParityLogOf(oldBase); err != nil {
+		return err
+	}
+	intFi, ok := e.fileMap.Load(oldBase)
+	if !ok {
+		return errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	rc := &renameRecord{From: []string{oldBase}, To: []string{newBase}, Kept: e.Trash}
+	for _, id := range fi.Versions {
+		if _, ok := e.fileMap.Load(versionName(oldBase, id)); ok {
+			rc.From = append(rc.From, versionName(oldBase, id))
+			rc.To = append(rc.To, versionName(newBase, id))
+		}
+	}
+	if replacing {
+		var err error
+		if rc.Replaced, err = e.newTrashInfo(intDst.(*fileInfo)); err != nil {
+			return err
+		}
+	}
+	record := fmt.Sprintf("%s.%d.renamed", newBase, time.Now().UnixNano())
+	if err := e.writeRenamed(record, rc); err != nil {
+		e.dropRenamed(record)
+		return err
+	}
+	if rc.Replaced != nil {
+		if err := e.moveToTrash(rc.Replaced); err != nil {
+			e.dropRenamed(record)
+			return err
+		}
+		//the directories under the new name are the renamed ones from now on
+		rc.Trashed = true
+		if err := e.writeRenamed(record, rc); err != nil {
+			e.untrash(rc.Replaced)
+			e.dropRenamed(record)
+			return err
+		}
+	}
+	renamed := make(map[string]string)
+	for i, name := range rc.From {
+		renamed[name] = rc.To[i]
+	}
+	e.reclaimRetired(rc.To)
+	err := e.moveDirs(rc.From, func(diskPath, name string) string {
+		return filepath.Join(diskPath, name)
+	}, func(diskPath, name string) string {
+		return filepath.Join(diskPath, renamed[name])
+	})
+	if err != nil {
+		if rc.Replaced != nil {
+			e.untrash(rc.Replaced)
+		}
+		e.dropRenamed(record)
+		return err
+	}
+	//the file info is replaced rather than changed, as it may be in use
+	for _, name := range rc.From {
+		if intF, ok := e.fileMap.Load(name); ok {
+			nf := *intF.(*fileInfo)
+			nf.FileName = renamed[name]
+			e.deleteFile(name)
+			e.storeFile(&nf)
+		}
+	}
+	e.mu.Lock()
+	//the journals of the former names and the record are dropped once the config is written
+	e.journaled = append(e.journaled, rc.From...)
+	e.renames = append(e.renames, record)
+	e.mu.Unlock()
+	if rc.Replaced != nil && !e.Trash {
+		//the file replaced is removed from the trash once the config is written
+		e.forgetTrash(rc.Replaced)
+		e.mu.Lock()
+		e.retired = append(e.retired, filepath.Join(trashDir, rc.Replaced.Dir))
+		e.mu.Unlock()
+	}
+	if !e.Quiet {
+		log.Printf("file %s successfully renamed to %s.", fileName(oldBase), fileName(newBase))
+	}
+	return nil
+}
+
+//renameRecord is the record of a rename, written as `<new name>.<time>.renamed` in the journal directory
+//until the config is written
+type renameRecord struct {
+	//the names of the file and its old versions, and their new names
+	From []string `json:"from"`
+	To   []string `json:"to"`
+
+	//the file replaced, and whether its directories are moved into the trash
+	Replaced *trashInfo `json:"replaced,omitempty"`
+	Trashed  bool       `json:"trashed,omitempty"`
+
+	//whether the file replaced stays in the trash
+	Kept bool `json:"kept,omitempty"`
+}
+
+//writeRenamed writes `rc` as record `name` on every available disk
+func (e *Erasure) writeRenamed(name string, rc *renameRecord) error {
+	data, err := json.Marshal(rc)
+	if err != nil {
+		return err
+	}
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if !disk.available {
+			continue
+		}
+		root := filepath.Join(disk.diskPath, journalDir)
+		if err := os.MkdirAll(root, 0777); err != nil {
+			return err
+		}
+		if err := writeRecord(root, name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//dropRenamed removes the record `name` of a rename from every disk
+func (e *Erasure) dropRenamed(name string) {
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		root := filepath.Join(disk.diskPath, journalDir)
+		os.Remove(filepath.Join(root, name))
+		os.Remove(filepath.Join(root, name+".tmp"))
+	}
+}
+
+//finishRenamed finishes the rename recorded at `path`, which a crash interrupted, with e.mu held by ReadConfig.
+//
+//The directories of the file replaced are moved into the trash unless they were already,
+//as the directories are renamed only afterwards, and then the directories still under the former names are renamed.
+//The config describes the file under the former names unless it's written since, in which case it's left as it is.
+func (e *Erasure) finishRenamed(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rc := &renameRecord{}
+	if err := json.Unmarshal(data, rc); err != nil {
+		return err
+	}
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if rc.Replaced != nil && !rc.Trashed {
+			dir := filepath.Join(disk.diskPath, trashDir, rc.Replaced.Dir)
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				return err
+			}
+			for _, name := range rc.Replaced.names() {
+				if err := os.Rename(filepath.Join(disk.diskPath, name), filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		for i, name := range rc.From {
+			src := filepath.Join(disk.diskPath, name)
+			if ok, err := pathExist(src); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			dst := filepath.Join(disk.diskPath, rc.To[i])
+			//what's left under the new name is retired
+			os.RemoveAll(dst)
+			if err := os.Rename(src, dst); err != nil {
+				return err
+			}
+		}
+		if err := syncDir(disk.diskPath); err != nil {
+			return err
+		}
+	}
+	e.renames = append(e.renames, filepath.Base(path))
+	if _, ok := e.fileMap.Load(rc.From[0]); !ok {
+		return nil
+	}
+	if rc.Replaced != nil {
+		for _, name := range rc.Replaced.names() {
+			e.deleteFile(name)
+		}
+		if !rc.Kept {
+			e.retired = append(e.retired, filepath.Join(trashDir, rc.Replaced.Dir))
+		} else {
+			//the config may be written while the file was being renamed
+			kept := false
+			for _, ti := range e.TrashMeta {
+				kept = kept || ti.Dir == rc.Replaced.Dir
+			}
+			if !kept {
+				e.TrashMeta = append(e.TrashMeta, rc.Replaced)
+			}
+		}
+	}
+	for i, name := range rc.From {
+		if intFi, ok := e.fileMap.Load(name); ok {
+			nf := *intFi.(*fileInfo)
+			nf.FileName = rc.To[i]
+			e.deleteFile(name)
+			e.storeFile(&nf)
+		}
+	}
+	e.journaled = append(e.journaled, rc.From...)
+	return nil
+}
+
+//Copy copies file `src` in the system as file `dst`, see CopyWithContext.
+func (e *Erasure) Copy(src, dst string) error {
+	return e.CopyWithContext(context.Background(), src, dst)
+}
+
+//CopyWithContext copies file `src` in the system as file `dst`, giving up if `ctx` is done before the copy is committed.
+//
+//The BLOB of every disk is cloned on the same disk, so the copy takes the layout of `src` without decoding,
+//and the two files are changed independently afterwards. The BLOBs on unavailable disks or missing are left empty,
+//their blocks are listed in the repair list of the copy, until brought up to date by RepairStale or Recover.
+//Like encoding, the copy is staged and then committed, so a file named `dst` is replaced only with Override,
+//and kept as an old version in versioning mode.
+func (e *Erasure) CopyWithContext(ctx context.Context, src, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	srcBase, dstBase := fileKey(src), fileKey(dst)
+	if _, ok := e.fileMap.Load(srcBase); !ok {
+		return errFileNotFound
+	}
+	if srcBase == dstBase {
+		return nil
+	}
+	if _, ok := e.fileMap.Load(dstBase); ok && !e.Override {
+		return fmt.Errorf("the file %s has already been in the file system, if you wish to override, please attach `-o`",
+			fileName(dstBase))
+	}
+	//the parity blocks are copied as they are on disks, so the pending deltas are merged beforehand
+	if err := e.mergeParityLogOf(srcBase); err != nil {
+		return err
+	}
+	intFi, ok := e.fileMap.Load(srcBase)
+	if !ok {
+		return errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	staged, err := e.stage(dstBase, e.Override)
+	if err != nil {
+		return err
+	}
+	if fi.Pack != nil {
+		//the copy of a packed file shares its bytes in the container, which are never changed in place
+		removeAll(staged)
+		newFi := &fileInfo{
+			FileName: dstBase,
+			FileSize: fi.FileSize,
+			Hash:     fi.Hash,
+			Mode:     fi.Mode,
+			Pack:     fi.Pack,
+		}
+		if err := e.commitFile(newFi, make([]string, e.DiskNum), e.Override); err != nil {
+			return err
+		}
+		if !e.Quiet {
+			log.Printf("file %s successfully copied to %s.", fileName(srcBase), fileName(dstBase))
+		}
+		return nil
+	}
+	missing := make([]bool, e.DiskNum)
+	erg := e.errgroupPool.Get().(*errgroup.Group)
+	for i, disk := range e.diskInfos[:e.DiskNum] {
+		i := i
+		disk := disk
+		erg.Go(func() error {
+			blobPath := filepath.Join(staged[i], "BLOB")
+			if disk.available {
+				_, err := copyFile(filepath.Join(disk.diskPath, srcBase, "BLOB"), blobPath)
+				if err == nil {
+					return syncFile(blobPath)
+				} else if !os.IsNotExist(err) {
+					return err
+				}
+			}
+			missing[i] = true
+			f, err := os.Create(blobPath)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		})
+	}
+	if err := erg.Wait(); err != nil {
+		removeAll(staged)
+		return err
+	}
+	e.errgroupPool.Put(erg)
+	if err := ctx.Err(); err != nil {
+		removeAll(staged)
+		return err
+	}
+	//the layout and checksums are shared, since neither is changed in place
+	newFi := &fileInfo{
+		FileName:      dstBase,
+		FileSize:      fi.FileSize,
+		Hash:          fi.Hash,
+		HashState:     fi.HashState,
+		Distribution:  fi.Distribution,
+		Offsets:       fi.Offsets,
+		BlockSums:     fi.BlockSums,
+		Mode:          fi.Mode,
+		TailBlockSize: fi.TailBlockSize,
+		K:             fi.K,
+		M:             fi.M,
+		BlockSize:     fi.BlockSize,
+	}
+	rl := newRepairList(fi, len(fi.Distribution))
+	for stripeNo, row := range fi.Distribution {
+		for i, diskId := range row {
+			if missing[diskId] {
+				rl.stale[[2]int{stripeNo, i}] = true
+			}
+		}
+	}
+	newFi.RepairList = rl.list()
+	e.unzipFileInfo(newFi)
+	if err := e.commitFile(newFi, staged, e.Override); err != nil {
+		removeAll(staged)
+		return err
+	}
+	if !e.Quiet {
+		log.Printf("file %s successfully copied to %s.", fileName(srcBase), fileName(dstBase))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package grasure
+
+import (
+	"log"
+	"os"
+
+	"golang.org/x/sync/errgroup"
+)
+
+//needRepair tells if stripe `stripeNo` has blocks marked failed on available disks
+func (e *Erasure) needRepair(fi *fileInfo, stripeNo int) bool {
+	k, m := e.shardsOf(fi)
+	for i := 0; i < k+m; i++ {
+		diskId := fi.Distribution[stripeNo][i]
+		if e.diskInfos[diskId].available && fi.blockInfos[stripeNo][i].bstat == blkFail {
+			return true
+		}
+	}
+	return false
+}
+
+//repairStripe writes the failed blocks of stripe `stripeNo` lying on available disks back to their locations,
+//and marks them blkOK again.
+//
+//`splitData` must be fully reconstructed, a rebuilt block mismatching its checksum is left failed.
+//Parity blocks with pending deltas are written as they lag behind, so that their parity logs still apply.
+func (e *Erasure) repairStripe(fi *fileInfo, ifs []*os.File, stripeNo int, splitData [][]byte) error {
+	pl := e.pendingParity(fi.FileName)
+	if pl != nil {
+		pl.mu.RLock()
+		defer pl.mu.RUnlock()
+	}
+	c := e.codecOf(fi)
+	erg := e.errgroupPool.Get().(*errgroup.Group)
+	for i := 0; i < c.K+c.M; i++ {
+		i := i
+		diskId := fi.Distribution[stripeNo][i]
+		if !e.diskInfos[diskId].available || fi.blockInfos[stripeNo][i].bstat != blkFail {
+			continue
+		}
+		block := splitData[i]
+		if pl != nil && i >= c.K {
+			block = pl.unpatched(diskId, fi.blockToOffset[stripeNo][i], block)
+		}
+		if !fi.checkBlock(stripeNo, i, block) {
+			if !e.Quiet {
+				log.Printf("block %d of stripe %d of %s can not be repaired", i, stripeNo, fi.FileName)
+			}
+			continue
+		}
+		erg.Go(func() error {
+			offset := fi.blockToOffset[stripeNo][i]
+			_, err := ifs[diskId].WriteAt(block, int64(offset)*c.BlockSize)
+			if err != nil {
+				return err
+			}
+			fi.blockInfos[stripeNo][i].bstat = blkOK
+			return nil
+		})
+	}
+	//a failed group keeps its error, so it's not put back
+	if err := erg.Wait(); err != nil {
+		return err
+	}
+	e.errgroupPool.Put(erg)
+	return nil
+}
@@ -1,6 +1,13 @@
 package grasure
 
-import "github.com/DurantVivado/reedsolomon"
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/DurantVivado/reedsolomon"
+	"golang.org/x/sync/errgroup"
+)
 
 // Scale expands the storage system to a new k and new m, for example,
 // Start with a (2,1) system but with more data flouring into, the system needs to be scaled to
@@ -11,7 +18,26 @@ import "github.com/DurantVivado/reedsolomon"
 //Another is that requirement of fault tolerance may level up when needed.
 //
 //It unavoidably incurrs serious data migration. We are working to minimize the traffic.
+//Every file of the system parameters is striped again with (new_k, new_m) and the same block size,
+//while the files of other storage classes keep theirs. The data blocks holding the same bytes in both layouts
+//stay on their disks at their offsets where they can, see planStripes, so only the rest are moved,
+//and the parity blocks written.
+//
+//Every file is re-striped through its journal, and the config is written after each one.
+//The system takes the new parameters first, with the files left pinned to the old ones, so they're readable meanwhile,
+//and an interrupted Scale is resumed by calling it again with the same parameters.
+//The config and its replicas are replaced atomically, see WriteConfig.
+//
+//Scale needs all disks available, and writes the config itself.
 func (e *Erasure) Scale(new_k, new_m int) error {
+	return e.ScaleWithContext(context.Background(), new_k, new_m)
+}
+
+//ScaleWithContext is like Scale, but stops between files once `ctx` is done, leaving the scaling to be resumed.
+func (e *Erasure) ScaleWithContext(ctx context.Context, new_k, new_m int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if new_k <= 0 || new_m <= 0 {
 		return reedsolomon.ErrInvShardNum
 	}
@@ -21,12 +47,262 @@ func (e *Erasure) Scale(new_k, new_m int) error {
 	if new_k+new_m > e.DiskNum {
 		return errTooFewDisksAlive
 	}
-	if new_k == e.K && new_m == e.M {
+	if e.Scaling != nil && (new_k != e.K || new_m != e.M) {
+		return errScalingInProgress
+	}
+	if new_k == e.K && new_m == e.M && e.Scaling == nil {
 		return nil
 	}
-	//step 1: modify the struct
-	//step 2: migrate data as well as replicas
-	//step 3: reorganize layout to conform to randomized distribution (other forms applies)
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if !disk.available {
+			return &diskError{disk.diskPath, " avilable flag set flase"}
+		}
+	}
+	//step 1: modify the struct, unless resuming
+	if e.Scaling == nil {
+		if err := e.beginScale(new_k, new_m); err != nil {
+			return err
+		}
+	}
+	//step 2 and 3: migrate data and reorganize layout file by file, see restripe
+	from := *e.Scaling
+	var names []string
+	e.fileMap.Range(func(key, value interface{}) bool {
+		fi := value.(*fileInfo)
+		if fi.Pack == nil && fi.K == from.K && fi.M == from.M && fi.BlockSize == from.BlockSize {
+			names = append(names, key.(string))
+		}
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := e.restripe(name); err != nil {
+			return err
+		}
+		//the file is recorded in its new layout, and its journal dropped
+		if err := e.WriteConfig(); err != nil {
+			return err
+		}
+	}
 	//step 4: write the new config and update replicas
+	e.mu.Lock()
+	e.Scaling = nil
+	e.mu.Unlock()
+	return e.WriteConfig()
+}
+
+//beginScale switches the system to `k`+`m` and records the old parameters in e.Scaling,
+//the files of the system parameters are pinned to the old ones until re-striped
+func (e *Erasure) beginScale(k, m int) error {
+	enc, err := e.encoderOf(k, m)
+	if err != nil {
+		return err
+	}
+	//the containers are pinned as well, so no file is packed meanwhile
+	e.packMu.Lock()
+	defer e.packMu.Unlock()
+	pin := func(fi *fileInfo) *fileInfo {
+		if fi.K != 0 || fi.Pack != nil {
+			return fi
+		}
+		newFi := *fi
+		newFi.K, newFi.M, newFi.BlockSize = e.K, e.M, e.BlockSize
+		return &newFi
+	}
+	e.fileMap.Range(func(key, value interface{}) bool {
+		if fi := value.(*fileInfo); pin(fi) != fi {
+			e.storeFile(pin(fi))
+		}
+		return true
+	})
+	e.mu.Lock()
+	for _, ti := range e.TrashMeta {
+		ti.File = pin(ti.File)
+		for i := range ti.Versions {
+			ti.Versions[i] = pin(ti.Versions[i])
+		}
+	}
+	e.Scaling = &StorageClass{K: e.K, M: e.M, BlockSize: e.BlockSize}
+	e.K, e.M, e.enc = k, m, enc
+	e.dataStripeSize = int64(k) * e.BlockSize
+	e.allStripeSize = int64(k+m) * e.BlockSize
+	e.mu.Unlock()
+	return e.WriteConfig()
+}
+
+//restripe stripes the file of key `baseFileName` again with the system parameters,
+//writing the moved data blocks and the new parity blocks through the journal, see planStripes
+func (e *Erasure) restripe(baseFileName string) error {
+	if isPackName(baseFileName) {
+		e.packMu.Lock()
+		defer e.packMu.Unlock()
+	}
+	//the parity blocks are encoded afresh, so the pending deltas are merged beforehand
+	if err := e.mergeParityLogOf(baseFileName); err != nil {
+		return err
+	}
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		//removed since Scale began
+		return nil
+	}
+	fi := intFi.(*fileInfo)
+	c := e.sysCodec()
+	newFi := &fileInfo{
+		FileName:      fi.FileName,
+		FileSize:      fi.FileSize,
+		Hash:          fi.Hash,
+		HashState:     fi.HashState,
+		VersionID:     fi.VersionID,
+		Versions:      fi.Versions,
+		Mode:          fi.Mode,
+		ModTime:       fi.ModTime,
+		TailBlockSize: c.tailBlockSize(fi.FileSize),
+	}
+	c.setParams(newFi)
+	stay, stayNum := e.planStripes(fi, newFi)
+	e.unzipFileInfo(newFi)
+	stripeNum := len(newFi.Distribution)
+	newFi.BlockSums = make([][]uint32, stripeNum)
+	f, err := e.openFile(baseFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	jn, err := e.newJournal(baseFileName, c.BlockSize)
+	if err != nil {
+		return err
+	}
+	for first := 0; first < stripeNum; first += e.ConStripes {
+		erg := e.errgroupPool.Get().(*errgroup.Group)
+		for stripeNo := first; stripeNo < min(first+e.ConStripes, stripeNum); stripeNo++ {
+			stripeNo := stripeNo
+			erg.Go(func() error {
+				offset := int64(stripeNo) * c.dataStripeSize
+				data := make([]byte, int64(c.K)*e.blockSizeOf(newFi, stripeNo))
+				n := int64(len(data))
+				if n > fi.FileSize-offset {
+					n = fi.FileSize - offset
+				}
+				if _, err := f.ReadAt(data[:n], offset); err != nil {
+					return err
+				}
+				blocks, err := c.encodeData(data)
+				if err != nil {
+					return err
+				}
+				e.setBlockSums(newFi, stripeNo, blocks)
+				for i := range blocks {
+					//the block already lies on its disk at its offset
+					if stay[stripeNo][i] {
+						continue
+					}
+					if err := jn.log(newFi.Distribution[stripeNo][i], newFi.blockToOffset[stripeNo][i], blocks[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		if err := erg.Wait(); err != nil {
+			jn.discard()
+			return err
+		}
+		e.errgroupPool.Put(erg)
+	}
+	if err := jn.commit(newFi); err != nil {
+		jn.discard()
+		return err
+	}
+	f.Close()
+	if err := e.publish(newFi); err != nil {
+		return err
+	}
+	if !e.Quiet {
+		log.Printf("file %s re-striped, %d of %d data blocks stay on their disks.",
+			fileName(baseFileName), stayNum, stripeNum*c.K)
+	}
 	return nil
 }
+
+//planStripes lays out the stripes of `newFi` reusing the disks and offsets of `fi`, and tells which blocks stay by stripe and how many.
+//
+//A data block holding the same bytes in both layouts, i.e., a full block of the same index that isn't stale,
+//stays on its disk at its offset unless an earlier block of its new stripe has taken the disk.
+//The other blocks go to the least loaded disks left, ties broken randomly, and take the lowest offsets left free.
+//The offsets are recorded in newFi.Offsets if any block stays, otherwise they follow the order of the stripes.
+func (e *Erasure) planStripes(fi, newFi *fileInfo) ([][]bool, int) {
+	oldK, _ := e.shardsOf(fi)
+	k, m := e.shardsOf(newFi)
+	stripeNum := int(ceilFracInt64(newFi.FileSize, int64(k)*newFi.BlockSize))
+	newFi.Distribution = make([][]int, stripeNum)
+	newFi.Offsets = make([][]int, stripeNum)
+	stay := make([][]bool, stripeNum)
+	load := make([]int, e.DiskNum)
+	//the offsets of every disk taken by the blocks staying
+	taken := make([]map[int]bool, e.DiskNum)
+	for i := range taken {
+		taken[i] = make(map[int]bool)
+	}
+	stayNum := 0
+	for stripeNo := range newFi.Distribution {
+		dist := make([]int, k+m)
+		newFi.Offsets[stripeNo] = make([]int, k+m)
+		stay[stripeNo] = make([]bool, k+m)
+		used := make([]bool, e.DiskNum)
+		var moved []int
+		for i := range dist {
+			j := stripeNo*k + i
+			if i < k && e.blockSizeOf(newFi, stripeNo) == newFi.BlockSize &&
+				j/oldK < len(fi.Distribution) && e.blockSizeOf(fi, j/oldK) == newFi.BlockSize &&
+				fi.blockInfos[j/oldK][j%oldK].bstat == blkOK {
+				if diskId := fi.Distribution[j/oldK][j%oldK]; !used[diskId] {
+					dist[i] = diskId
+					used[diskId] = true
+					load[diskId]++
+					offset := fi.blockToOffset[j/oldK][j%oldK]
+					newFi.Offsets[stripeNo][i] = offset
+					taken[diskId][offset] = true
+					stay[stripeNo][i] = true
+					stayNum++
+					continue
+				}
+			}
+			moved = append(moved, i)
+		}
+		for _, i := range moved {
+			best := -1
+			for _, diskId := range genRandomArr(e.DiskNum, 0) {
+				if !used[diskId] && (best < 0 || load[diskId] < load[best]) {
+					best = diskId
+				}
+			}
+			dist[i] = best
+			used[best] = true
+			load[best]++
+		}
+		newFi.Distribution[stripeNo] = dist
+	}
+	if stayNum == 0 {
+		newFi.Offsets = nil
+		return stay, 0
+	}
+	//the moved blocks fill the offsets left free in order
+	next := make([]int, e.DiskNum)
+	for stripeNo, row := range newFi.Distribution {
+		for i, diskId := range row {
+			if stay[stripeNo][i] {
+				continue
+			}
+			for taken[diskId][next[diskId]] {
+				next[diskId]++
+			}
+			newFi.Offsets[stripeNo][i] = next[diskId]
+			next[diskId]++
+		}
+	}
+	return stay, stayNum
+}
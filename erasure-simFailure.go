@@ -3,7 +3,6 @@ package grasure
 import (
 	"fmt"
 	"log"
-	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -17,6 +16,8 @@ const stripeFailProportion = 0.3
 //
 // for `bitRot`, `failNum` random blocks in a stripe of the file corrupts, that only works in Read Mode;
 //
+// for `slowDisk`, every block read on `failNum` random disks is delayed by `SlowDown`;
+//
 // Since it's a simulation, no real data will be lost.
 // Note that failNum = min(failNum, DiskNum).
 func (e *Erasure) Destroy(simOption *SimOptions) {
@@ -57,10 +58,8 @@ func (e *Erasure) Destroy(simOption *SimOptions) {
 	} else if simOption.Mode == "bitRot" || simOption.Mode == "BitRot" {
 		//in thi smode, we don't really corrupt a bit. Instead, we mark the block containing rots as failed
 		// which is omnipresent is today's storage facilities.
-		//if fileName is "", we corrupt all the files, else corrupt specific file
-		if simOption.FailNum > e.K+e.M {
-			simOption.FailNum = e.K + e.M
-		}
+		//if fileName is "", we corrupt all the files, else corrupt specific file.
+		//No more blocks than a stripe of the file has are corrupted
 		if simOption.FileName == "" {
 			e.fileMap.Range(func(filename, fi interface{}) bool {
 				fd := fi.(*fileInfo)
@@ -68,16 +67,17 @@ func (e *Erasure) Destroy(simOption *SimOptions) {
 				//algorithms have flaws. For every stripe, we corrupt failNum blocks
 				stripeNum := len(fd.blockInfos)
 				stripeFail := int(stripeFailProportion * float32(stripeNum))
+				k, m := e.shardsOf(fd)
 				for i := range genRandomArr(stripeNum, 0)[:stripeFail] {
 
-					for j := range genRandomArr(e.K+e.M, 0)[:simOption.FailNum] {
+					for j := range genRandomArr(k+m, 0)[:min(simOption.FailNum, k+m)] {
 						fd.blockInfos[i][j].bstat = blkFail
 					}
 				}
 				return true
 			})
 		} else {
-			baseFileName := filepath.Base(simOption.FileName)
+			baseFileName := fileKey(simOption.FileName)
 			intFi, ok := e.fileMap.Load(baseFileName)
 			if !ok {
 				log.Fatal(errFileNotFound)
@@ -89,9 +89,10 @@ func (e *Erasure) Destroy(simOption *SimOptions) {
 			stripeNum := len(fi.blockInfos)
 			stripeFail := int(stripeFailProportion * float32(stripeNum))
 			strps := genRandomArr(stripeNum, 0)[:stripeFail]
+			k, m := e.shardsOf(fi)
 			for _, i := range strps {
 
-				blks := genRandomArr(e.K+e.M, 0)[:simOption.FailNum]
+				blks := genRandomArr(k+m, 0)[:min(simOption.FailNum, k+m)]
 				for _, j := range blks {
 					// fmt.Printf("i:%d, j :%d fails.\n", i, j)
 					fi.blockInfos[i][j].bstat = blkFail
@@ -99,8 +100,23 @@ func (e *Erasure) Destroy(simOption *SimOptions) {
 			}
 
 		}
+	} else if simOption.Mode == "slowDisk" || simOption.Mode == "SlowDisk" {
+		//the disks stay available but every block read is delayed
+		if simOption.FailNum > e.DiskNum {
+			simOption.FailNum = e.DiskNum
+		}
+		if !e.Quiet && simOption.FailNum > 0 {
+			log.Println("simulate slow disks on:")
+		}
+		shuff := genRandomArr(e.DiskNum, 0)
+		for i := 0; i < simOption.FailNum; i++ {
+			if !e.Quiet {
+				log.Println(e.diskInfos[shuff[i]].diskPath)
+			}
+			e.diskInfos[shuff[i]].slowDown = simOption.SlowDown
+		}
 	} else {
-		log.Fatal("please specialize failMode in diskFail and bitRot")
+		log.Fatal("please specialize failMode in diskFail, bitRot and slowDisk")
 	}
 }
 
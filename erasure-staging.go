@@ -0,0 +1,354 @@
+package grasure
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//the directory on every disk where files are encoded before being committed
+const stagingDir = ".staging"
+
+//stage creates a staging directory for `baseFileName` on every disk and returns their paths.
+//
+//Without `override`, errDataDirExist is returned if the file already has a directory on some disk.
+//The names of system directories and old versions are reserved, and the file must fit in the namespace.
+func (e *Erasure) stage(baseFileName string, override bool) ([]string, error) {
+	if isReservedName(baseFileName) {
+		return nil, errReservedFileName
+	}
+	if err := e.checkNewFile(baseFileName); err != nil {
+		return nil, err
+	}
+	staged := make([]string, e.DiskNum)
+	for i, disk := range e.diskInfos[:e.DiskNum] {
+		if !override {
+			if ok, err := pathExist(filepath.Join(disk.diskPath, baseFileName)); err != nil {
+				removeAll(staged)
+				return nil, err
+			} else if ok {
+				removeAll(staged)
+				return nil, errDataDirExist
+			}
+		}
+		root := filepath.Join(disk.diskPath, stagingDir)
+		if err := os.MkdirAll(root, 0777); err != nil {
+			removeAll(staged)
+			return nil, err
+		}
+		dir, err := os.MkdirTemp(root, baseFileName+".")
+		if err != nil {
+			removeAll(staged)
+			return nil, err
+		}
+		staged[i] = dir
+	}
+	return staged, nil
+}
+
+//isReservedName tells if `baseFileName` is taken by system directories or old versions
+func isReservedName(baseFileName string) bool {
+	return baseFileName == stagingDir || baseFileName == journalDir || baseFileName == parityLogDir ||
+		baseFileName == trashDir || isVersionName(baseFileName)
+}
+
+//commitFile commits the staged directories of the new file `fi` and publishes it into fileMap.
+//
+//In versioning mode, the former version of the file is kept as an old version.
+func (e *Erasure) commitFile(fi *fileInfo, staged []string, override bool) error {
+	former, keepAs, err := e.formerVersion(fi.FileName)
+	if err != nil {
+		return err
+	}
+	fi.ModTime = time.Now()
+	if former != nil {
+		fi.VersionID = former.VersionID + 1
+		fi.Versions = former.Versions
+		//a file encoded again keeps its permission unless given one
+		if fi.Mode == 0 {
+			fi.Mode = former.Mode
+		}
+	}
+	sc := &stagedCommit{File: fi, Dirs: make([]string, len(staged))}
+	for i, dir := range staged {
+		if dir != "" {
+			sc.Dirs[i] = filepath.Base(dir)
+		}
+	}
+	var pruned []int
+	if keepAs != "" {
+		sc.Kept, pruned = e.keepVersion(fi, former, keepAs)
+	}
+	if err := e.commitStaged(sc, staged, override); err != nil {
+		return err
+	}
+	if sc.Kept != nil {
+		e.storeFile(sc.Kept)
+	}
+	for _, id := range pruned {
+		e.dropVersion(fi.FileName, id)
+	}
+	e.storeFile(fi)
+	e.mu.Lock()
+	e.journaled = append(e.journaled, sc.names()...)
+	e.mu.Unlock()
+	return nil
+}
+
+//stagedCommit is the record of a commit of staged directories, written as `<name>.staged` in the journal directory
+//of every disk before any directory is renamed, so that a commit interrupted by a crash is finished at warm-up.
+//
+//Once the directories are renamed, the file infos are recorded as applied journals, see settleStaged,
+//which the config supersedes once written.
+type stagedCommit struct {
+	//the new file, and its former version kept as an old version, if any
+	File *fileInfo `json:"file"`
+	Kept *fileInfo `json:"kept,omitempty"`
+
+	//the staged directory of every disk in the staging directory, empty for a packed file
+	Dirs []string `json:"dirs"`
+}
+
+//names returns the keys of the files the commit records
+func (sc *stagedCommit) names() []string {
+	if sc.Kept != nil {
+		return []string{sc.File.FileName, sc.Kept.FileName}
+	}
+	return []string{sc.File.FileName}
+}
+
+//commitStaged publishes the staged directories of `sc` as the new file by renaming them on every disk.
+//
+//A former directory of the file is moved aside and removed only after all disks are committed,
+//so that a failed commit restores it. It's kept as the directory of the old version instead, if any.
+//The commit is recorded beforehand, so after a crash it's finished by ReadConfig rather than
+//leaving the config to describe the directories replaced, see finishStaged.
+func (e *Erasure) commitStaged(sc *stagedCommit, staged []string, override bool) error {
+	baseFileName := sc.File.FileName
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if !disk.available {
+			continue
+		}
+		root := filepath.Join(disk.diskPath, journalDir)
+		if err = os.MkdirAll(root, 0777); err != nil {
+			break
+		}
+		if err = writeRecord(root, baseFileName+".staged", data); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		e.dropStaged(baseFileName)
+		return err
+	}
+	disks := e.diskInfos[:e.DiskNum]
+	aside := make([]string, len(disks))
+	done := 0
+	for i, disk := range disks {
+		folderPath := filepath.Join(disk.diskPath, baseFileName)
+		var ok bool
+		if ok, err = pathExist(folderPath); err != nil {
+			break
+		} else if ok {
+			if !override {
+				err = errDataDirExist
+				break
+			}
+			asidePath := staged[i] + ".old"
+			if sc.Kept != nil {
+				//what an interrupted commit left there is of no version
+				asidePath = filepath.Join(disk.diskPath, sc.Kept.FileName)
+				os.RemoveAll(asidePath)
+			}
+			if err = os.Rename(folderPath, asidePath); err != nil {
+				break
+			}
+			aside[i] = asidePath
+		}
+		if staged[i] != "" {
+			if err = os.Rename(staged[i], folderPath); err != nil {
+				break
+			}
+		}
+		done++
+	}
+	if err != nil {
+		//roll back, the staged directories are removed by the caller
+		for i := 0; i < len(disks) && i <= done; i++ {
+			folderPath := filepath.Join(disks[i].diskPath, baseFileName)
+			if i < done && staged[i] != "" {
+				os.Rename(folderPath, staged[i])
+			}
+			if aside[i] != "" {
+				os.Rename(aside[i], folderPath)
+			}
+		}
+		e.dropStaged(baseFileName)
+		return err
+	}
+	for _, disk := range disks {
+		if err := syncDir(disk.diskPath); err != nil {
+			return err
+		}
+	}
+	if err := e.settleStaged(sc); err != nil {
+		return err
+	}
+	//the former directories are no longer referred to, as the file infos are recorded
+	for i := range disks {
+		if aside[i] != "" && sc.Kept == nil {
+			os.RemoveAll(aside[i])
+		}
+	}
+	return nil
+}
+
+//settleStaged records the file infos of committed `sc` as applied journals on every disk,
+//which replace the journal of the former version, and then drops the record of the commit.
+//The pending parity deltas of the former version no longer apply either.
+func (e *Erasure) settleStaged(sc *stagedCommit) error {
+	baseFileName := sc.File.FileName
+	e.dropJournal(baseFileName)
+	e.dropParityLog(baseFileName)
+	files := []*fileInfo{sc.File}
+	if sc.Kept != nil {
+		//the old version goes first, so the applied journal of the file implies it
+		files = []*fileInfo{sc.Kept, sc.File}
+	}
+	for _, fi := range files {
+		data, err := json.Marshal(fi)
+		if err != nil {
+			return err
+		}
+		for _, disk := range e.diskInfos[:e.DiskNum] {
+			if !disk.available {
+				continue
+			}
+			if err := writeRecord(filepath.Join(disk.diskPath, journalDir), fi.FileName+".applied", data); err != nil {
+				return err
+			}
+		}
+	}
+	e.dropStaged(baseFileName)
+	return nil
+}
+
+//dropStaged removes the record of the commit of `baseFileName` from every disk
+func (e *Erasure) dropStaged(baseFileName string) {
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		root := filepath.Join(disk.diskPath, journalDir)
+		os.Remove(filepath.Join(root, baseFileName+".staged"))
+		os.Remove(filepath.Join(root, baseFileName+".staged.tmp"))
+	}
+}
+
+//finishStaged finishes the commit recorded at `path`, which a crash interrupted, with e.mu held by ReadConfig.
+//
+//The directories still staged are renamed into place, as the record is written only once all are staged,
+//and the file infos of the commit take effect. The directories the config describes are replaced,
+//but the file infos are kept as applied journals until the config is written.
+func (e *Erasure) finishStaged(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sc := &stagedCommit{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return err
+	}
+	baseFileName := sc.File.FileName
+	for i, disk := range e.diskInfos[:e.DiskNum] {
+		folderPath := filepath.Join(disk.diskPath, baseFileName)
+		src := ""
+		if i < len(sc.Dirs) && sc.Dirs[i] != "" {
+			src = filepath.Join(disk.diskPath, stagingDir, sc.Dirs[i])
+			if ok, err := pathExist(src); err != nil {
+				return err
+			} else if !ok {
+				//committed on this disk
+				continue
+			}
+		}
+		if ok, err := pathExist(folderPath); err != nil {
+			return err
+		} else if ok {
+			if sc.Kept != nil {
+				asidePath := filepath.Join(disk.diskPath, sc.Kept.FileName)
+				os.RemoveAll(asidePath)
+				if err := os.Rename(folderPath, asidePath); err != nil {
+					return err
+				}
+			} else if err := os.RemoveAll(folderPath); err != nil {
+				return err
+			}
+		}
+		if src != "" {
+			if err := os.Rename(src, folderPath); err != nil {
+				return err
+			}
+		}
+		if err := syncDir(disk.diskPath); err != nil {
+			return err
+		}
+	}
+	if err := e.settleStaged(sc); err != nil {
+		return err
+	}
+	//the old versions pruned by the commit are still described by the config
+	kept := make(map[int]bool)
+	for _, id := range sc.File.Versions {
+		kept[id] = true
+	}
+	if intFi, ok := e.fileMap.Load(baseFileName); ok {
+		for _, id := range intFi.(*fileInfo).Versions {
+			if !kept[id] && (sc.Kept == nil || versionName(baseFileName, id) != sc.Kept.FileName) {
+				e.deleteFile(versionName(baseFileName, id))
+				e.retired = append(e.retired, versionName(baseFileName, id))
+			}
+		}
+	}
+	for _, fi := range []*fileInfo{sc.Kept, sc.File} {
+		if fi != nil {
+			e.unzipFileInfo(fi)
+			e.storeFile(fi)
+		}
+	}
+	e.journaled = append(e.journaled, sc.names()...)
+	return nil
+}
+
+//sweepStaging removes what interrupted encodes left in the staging directories,
+//once the interrupted commits are finished by replayJournals
+func (e *Erasure) sweepStaging() error {
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if err := os.RemoveAll(filepath.Join(disk.diskPath, stagingDir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//syncDir flushes the entries of directory `path`, e.g., after a rename
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+//removeAll removes the given paths, empty ones are skipped
+func removeAll(paths []string) {
+	for _, path := range paths {
+		if path != "" {
+			os.RemoveAll(path)
+		}
+	}
+}
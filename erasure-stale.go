@@ -0,0 +1,228 @@
+package grasure
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+//repairList tracks the stale blocks of a file being updated, as its stripes are written concurrently.
+//
+//A block journaled by the update is up to date, while a block destined for an unavailable disk becomes stale.
+//The blocks left untouched keep their state.
+type repairList struct {
+	mu    sync.Mutex
+	stale map[[2]int]bool
+}
+
+//newRepairList starts from the stale blocks of `fi` within the first `stripeNum` stripes
+func newRepairList(fi *fileInfo, stripeNum int) *repairList {
+	rl := &repairList{stale: make(map[[2]int]bool)}
+	for _, blk := range fi.RepairList {
+		if blk[0] < stripeNum {
+			rl.stale[blk] = true
+		}
+	}
+	return rl
+}
+
+//list returns the stale blocks sorted by stripe and block
+func (rl *repairList) list() [][2]int {
+	if len(rl.stale) == 0 {
+		return nil
+	}
+	res := make([][2]int, 0, len(rl.stale))
+	for blk := range rl.stale {
+		res = append(res, blk)
+	}
+	sort.Slice(res, func(a, b int) bool {
+		if res[a][0] != res[b][0] {
+			return res[a][0] < res[b][0]
+		}
+		return res[a][1] < res[b][1]
+	})
+	return res
+}
+
+//markStale records block `i` of stripe `stripeNo` as stale
+func (rl *repairList) markStale(stripeNo, i int) {
+	rl.mu.Lock()
+	rl.stale[[2]int{stripeNo, i}] = true
+	rl.mu.Unlock()
+}
+
+//markStale marks the blocks in the repair list of `fi` failed, so they're reconstructed until repaired
+func (fi *fileInfo) markStale() {
+	for _, blk := range fi.RepairList {
+		fi.blockInfos[blk[0]][blk[1]].bstat = blkFail
+	}
+}
+
+//logBlock journals `block` as block `i` of stripe `stripeNo` of `fi`,
+//or records it as stale in `rl` if its disk is unavailable.
+func (e *Erasure) logBlock(jn *journal, rl *repairList, fi *fileInfo, stripeNo, i int, block []byte) error {
+	diskId := fi.Distribution[stripeNo][i]
+	available := e.diskInfos[diskId].available
+	if !available {
+		rl.markStale(stripeNo, i)
+		return nil
+	}
+	rl.mu.Lock()
+	delete(rl.stale, [2]int{stripeNo, i})
+	rl.mu.Unlock()
+	return jn.log(diskId, fi.blockToOffset[stripeNo][i], block)
+}
+
+//RepairStale brings the stale blocks of all files up to date, see RepairStaleWithContext.
+func (e *Erasure) RepairStale() error {
+	return e.RepairStaleWithContext(context.Background())
+}
+
+//RepairStaleWithContext brings the blocks left stale by degraded updates up to date, once their disks are available again.
+//
+//The stale blocks are reconstructed from the other blocks of their stripes and written through the journal,
+//the blocks on disks still unavailable are kept in the repair list.
+//The pending parity deltas of a file are merged beforehand, so that the parity blocks repaired are up to date.
+func (e *Erasure) RepairStaleWithContext(ctx context.Context) error {
+	var names []string
+	e.fileMap.Range(func(key, value interface{}) bool {
+		if len(value.(*fileInfo).RepairList) > 0 {
+			names = append(names, key.(string))
+		}
+		return true
+	})
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := e.repairStale(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//repairStale brings the stale blocks of `baseFileName` on available disks up to date
+func (e *Erasure) repairStale(baseFileName string) error {
+	pl, err := e.beginParityUpdate(baseFileName)
+	if err != nil {
+		return err
+	}
+	if pl != nil {
+		defer pl.wmu.Unlock()
+		if err := e.mergeParityLog(baseFileName, pl); err != nil {
+			return err
+		}
+	}
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	//the stale blocks by stripe, of which those on available disks are repaired
+	stripes := make(map[int][]int)
+	var stripeNos []int
+	var remained [][2]int
+	for _, blk := range fi.RepairList {
+		if !e.diskInfos[fi.Distribution[blk[0]][blk[1]]].available {
+			remained = append(remained, blk)
+			continue
+		}
+		if _, ok := stripes[blk[0]]; !ok {
+			stripeNos = append(stripeNos, blk[0])
+		}
+		stripes[blk[0]] = append(stripes[blk[0]], blk[1])
+	}
+	if len(stripeNos) == 0 {
+		return nil
+	}
+	c := e.codecOf(fi)
+	ifs, alive := e.openBlobs(baseFileName, os.O_RDONLY)
+	defer closeBlobs(ifs)
+	if alive < c.K {
+		return errTooFewDisksAlive
+	}
+	//the layout and checksums are unchanged, only the repair list is
+	newFi := &fileInfo{
+		FileName:       fi.FileName,
+		FileSize:       fi.FileSize,
+		Hash:           fi.Hash,
+		HashState:      fi.HashState,
+		Distribution:   fi.Distribution,
+		Offsets:        fi.Offsets,
+		BlockSums:      fi.BlockSums,
+		ParityLogSizes: fi.ParityLogSizes,
+		RepairList:     remained,
+		VersionID:      fi.VersionID,
+		Versions:       fi.Versions,
+		Mode:           fi.Mode,
+		ModTime:        fi.ModTime,
+		TailBlockSize:  fi.TailBlockSize,
+		K:              fi.K,
+		M:              fi.M,
+		BlockSize:      fi.BlockSize,
+	}
+	e.unzipFileInfo(newFi)
+	jn, err := e.newJournal(baseFileName, c.BlockSize)
+	if err != nil {
+		return err
+	}
+	bufs := makeArr2DByte(e.ConStripes, int(c.allStripeSize))
+	for first := 0; first < len(stripeNos); first += e.ConStripes {
+		eg := e.errgroupPool.Get().(*errgroup.Group)
+		for s, stripeNo := range stripeNos[first:min(len(stripeNos), first+e.ConStripes)] {
+			s := s
+			stripeNo := stripeNo
+			eg.Go(func() error {
+				//the stale blocks are marked failed, so they're reconstructed
+				splitData, err := e.readStripe(fi, ifs, stripeNo, bufs[s], false)
+				if err != nil {
+					return err
+				}
+				for _, i := range stripes[stripeNo] {
+					if err := jn.log(fi.Distribution[stripeNo][i], fi.blockToOffset[stripeNo][i], splitData[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			jn.discard()
+			return err
+		}
+		e.errgroupPool.Put(eg)
+	}
+	if err := jn.commit(newFi); err != nil {
+		jn.discard()
+		return err
+	}
+	closeBlobs(ifs)
+	if err := e.publish(newFi); err != nil {
+		return err
+	}
+	if !e.Quiet {
+		log.Println(baseFileName, " stale blocks repaired.")
+	}
+	return nil
+}
+
+//dropRestoredStale removes the blocks of the failed disks in `replaceMap` from the repair list of `fi` after they're restored
+func (e *Erasure) dropRestoredStale(fi *fileInfo, replaceMap map[int]int) {
+	if len(fi.RepairList) == 0 {
+		return
+	}
+	var remained [][2]int
+	for _, blk := range fi.RepairList {
+		if _, ok := replaceMap[fi.Distribution[blk[0]][blk[1]]]; ok {
+			fi.blockInfos[blk[0]][blk[1]].bstat = blkOK
+			continue
+		}
+		remained = append(remained, blk)
+	}
+	fi.RepairList = remained
+}
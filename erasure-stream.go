@@ -0,0 +1,593 @@
+package grasure
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+//fileWriter stripes the data written into it and encodes every `ConStripes` stripes as a batch, or fewer for EncodeDir.
+//
+//Blocks are written into staging directories, which are committed by rename and the file published into fileMap
+//only when it is closed, so an unfinished file leaves no visible trace.
+type fileWriter struct {
+	e *Erasure
+
+	//no more stripes are encoded once ctx is done
+	ctx context.Context
+
+	//the file being encoded
+	fi *fileInfo
+
+	//the erasure parameters the file is striped with
+	c *codec
+
+	//the opened BLOB of every disk
+	of []*os.File
+
+	//the staging directory of every disk
+	staged []string
+
+	//whether a former version of the file may be replaced
+	override bool
+
+	//the journal of an append, blocks are logged instead of written into staged BLOBs, see erasure-append.go
+	jn *journal
+
+	//the stale blocks of an append, including those destined for unavailable disks
+	rl *repairList
+
+	//hash of the data written so far, if any
+	h hash.Hash
+
+	//the first stripe of the current batch
+	stripeNo int
+
+	//stripe buffers of the current batch, each of dataStripeSize
+	blobBuf [][]byte
+
+	//how many bytes are buffered in the current batch
+	buffered int64
+
+	//how many blocks of the file every disk holds
+	countSum []int
+
+	//the first error encountered, later calls return it as well
+	err error
+
+	closed bool
+}
+
+//Create creates the file `filename` in the system and returns a writer encoding the data as it arrives.
+//
+//Data are striped and written to disks every `ConStripes` stripes, the file becomes visible after Close.
+func (e *Erasure) Create(filename string) (io.WriteCloser, error) {
+	return e.CreateWithContext(context.Background(), filename)
+}
+
+//CreateWithContext is like Create, but stops encoding once `ctx` is done.
+//
+//Then Write and Close return the context error, and the unfinished file is removed from disks.
+func (e *Erasure) CreateWithContext(ctx context.Context, filename string) (io.WriteCloser, error) {
+	c, err := e.classCodec(e.Class)
+	if err != nil {
+		return nil, err
+	}
+	return e.newFileWriter(ctx, fileKey(filename), e.Override, e.ConStripes, c)
+}
+
+//EncodeReader encodes the data read from `r` until EOF as file `filename`.
+//
+//Unlike EncodeFile, the length of `r` needs not to be known in advance,
+//so pipes, network streams and generated data are all welcome.
+func (e *Erasure) EncodeReader(filename string, r io.Reader) (*fileInfo, error) {
+	return e.EncodeReaderWithContext(context.Background(), filename, r)
+}
+
+//EncodeReaderWithContext is like EncodeReader, but stops encoding once `ctx` is done.
+//
+//A cancelled encode leaves no BLOB directories behind, so the file can be encoded again later.
+func (e *Erasure) EncodeReaderWithContext(ctx context.Context, filename string, r io.Reader) (*fileInfo, error) {
+	c, err := e.classCodec(e.Class)
+	if err != nil {
+		return nil, err
+	}
+	return e.encodeReader(ctx, filename, r, c)
+}
+
+//encodeReader encodes the data read from `r` until EOF as file `filename` with the parameters of `c`
+func (e *Erasure) encodeReader(ctx context.Context, filename string, r io.Reader, c *codec) (*fileInfo, error) {
+	w, err := e.newFileWriter(ctx, fileKey(filename), e.Override, e.ConStripes, c)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.fi, nil
+}
+
+//newFileWriter returns a writer encoding the file of key `baseFileName` in batches of `conStripes` stripes,
+//striped with the parameters of `c`
+func (e *Erasure) newFileWriter(ctx context.Context, baseFileName string, override bool, conStripes int, c *codec) (*fileWriter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := e.fileMap.Load(baseFileName); ok && !override {
+		return nil, fmt.Errorf("the file %s has already been in the file system, if you wish to override, please attach `-o`",
+			fileName(baseFileName))
+	}
+	//a former version is replaced only when the new one is committed
+	staged, err := e.stage(baseFileName, override)
+	if err != nil {
+		return nil, err
+	}
+	of := make([]*os.File, e.DiskNum)
+	//first open relevant file resources
+	erg := new(errgroup.Group)
+	for i := range e.diskInfos[:e.DiskNum] {
+		i := i
+		erg.Go(func() error {
+			partPath := filepath.Join(staged[i], "BLOB")
+			f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				return err
+			}
+			of[i] = f
+			return nil
+		})
+	}
+	if err := erg.Wait(); err != nil {
+		for i := range of {
+			if of[i] != nil {
+				of[i].Close()
+			}
+		}
+		removeAll(staged)
+		return nil, err
+	}
+	fi := &fileInfo{FileName: baseFileName}
+	c.setParams(fi)
+	fi.Distribution = make([][]int, 0)
+	fi.blockToOffset = make([][]int, 0)
+	w := &fileWriter{
+		e:        e,
+		ctx:      ctx,
+		fi:       fi,
+		c:        c,
+		of:       of,
+		staged:   staged,
+		override: override,
+		blobBuf:  makeArr2DByte(conStripes, int(c.dataStripeSize)),
+		countSum: make([]int, e.DiskNum),
+	}
+	//a container has no hash, the files packed into it are checked by their own,
+	//so packing a file doesn't read the container to resume it
+	if !isPackName(baseFileName) {
+		w.h = sha256.New()
+	}
+	return w, nil
+}
+
+//Write buffers p and encodes the buffered stripes whenever a batch is full.
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errFileClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	c := w.c
+	batchSize := int64(len(w.blobBuf)) * c.dataStripeSize
+	written := 0
+	for len(p) > 0 {
+		s := w.buffered / c.dataStripeSize
+		pos := w.buffered % c.dataStripeSize
+		n := copy(w.blobBuf[s][pos:], p)
+		if w.h != nil {
+			w.h.Write(p[:n])
+		}
+		w.buffered += int64(n)
+		w.fi.FileSize += int64(n)
+		written += n
+		p = p[n:]
+		if w.buffered == batchSize {
+			if err := w.flush(); err != nil {
+				w.err = err
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+//flush encodes the buffered stripes and writes the blocks to disks.
+//The last stripe will be shortened to fit its tail and refilled with zeros, see erasure-tail.go.
+func (w *fileWriter) flush() error {
+	e := w.e
+	c := w.c
+	fi := w.fi
+	if w.buffered == 0 {
+		return nil
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	stripeCnt := w.stripeNo
+	nextStripe := int(ceilFracInt64(w.buffered, c.dataStripeSize))
+	//only the last batch has a tail, the stripes flushed before are full
+	fi.TailBlockSize = c.tailBlockSize(w.buffered)
+	stripes := make([][]byte, nextStripe)
+	copy(stripes, w.blobBuf)
+	if tail := w.buffered % c.dataStripeSize; tail != 0 {
+		last := w.blobBuf[nextStripe-1][:int64(c.K)*fi.TailBlockSize]
+		for i := tail; i < int64(len(last)); i++ {
+			last[i] = 0
+		}
+		stripes[nextStripe-1] = last
+	}
+	//generate random distribution for data and parity of the new stripes
+	if grow := stripeCnt + nextStripe - len(fi.Distribution); grow > 0 {
+		e.growLayout(fi, w.countSum, grow)
+	}
+	e.growBlockSums(fi, stripeCnt+nextStripe)
+	eg := e.errgroupPool.Get().(*errgroup.Group)
+	for s := 0; s < nextStripe; s++ {
+		s := s
+		stripeNo := stripeCnt + s
+		eg.Go(func() error {
+			//split and encode the data
+			encodeData, err := c.encodeData(stripes[s])
+			if err != nil {
+				return err
+			}
+			e.setBlockSums(fi, stripeNo, encodeData)
+			erg := e.errgroupPool.Get().(*errgroup.Group)
+			//save the blob
+			for i := 0; i < c.K+c.M; i++ {
+				i := i
+				diskId := fi.Distribution[stripeNo][i]
+				erg.Go(func() error {
+					offset := fi.blockToOffset[stripeNo][i]
+					if w.jn != nil {
+						return e.logBlock(w.jn, w.rl, fi, stripeNo, i, encodeData[i])
+					}
+					_, err := w.of[diskId].WriteAt(encodeData[i], int64(offset)*c.BlockSize)
+					if err != nil {
+						return err
+					}
+					return nil
+				})
+			}
+			if err := erg.Wait(); err != nil {
+				return err
+			}
+			e.errgroupPool.Put(erg)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	e.errgroupPool.Put(eg)
+	w.buffered = 0
+	w.stripeNo += nextStripe
+	return nil
+}
+
+//Close encodes the remaining data and publishes the file into the system.
+//A file small enough is packed into a container instead, see erasure-pack.go.
+//
+//In versioning mode, the former version of the file is kept as an old version.
+func (w *fileWriter) Close() error {
+	if w.closed {
+		return errFileClosed
+	}
+	w.closed = true
+	if w.err == nil && w.packable() {
+		return w.pack()
+	}
+	if w.err == nil {
+		w.err = w.flush()
+	}
+	if w.jn != nil {
+		return w.commitAppend()
+	}
+	//the blocks must be durable before the commit
+	for i := range w.of {
+		if w.err == nil {
+			w.err = w.of[i].Sync()
+		}
+		if err := w.of[i].Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+	e := w.e
+	fi := w.fi
+	if w.h != nil {
+		setHash(fi, w.h)
+	}
+	fi.blockInfos = make([][]*blockInfo, len(fi.Distribution))
+	for row := range fi.Distribution {
+		fi.blockInfos[row] = make([]*blockInfo, w.c.K+w.c.M)
+		for line := range fi.Distribution[row] {
+			fi.blockInfos[row][line] = &blockInfo{bstat: blkOK}
+		}
+	}
+	//record the file meta
+	if w.err == nil {
+		w.err = e.commitFile(fi, w.staged, w.override)
+	}
+	if w.err != nil {
+		removeAll(w.staged)
+		return w.err
+	}
+	if !e.Quiet {
+		log.Println(fileName(fi.FileName), " successfully encoded. encoding size ",
+			w.c.stripedFileSize(fi.FileSize), "bytes")
+	}
+	return nil
+}
+
+//abort closes the writer without publishing the file, and removes what has been written.
+func (w *fileWriter) abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	if w.jn != nil {
+		w.jn.discard()
+		return
+	}
+	for i := range w.of {
+		w.of[i].Close()
+	}
+	removeAll(w.staged)
+}
+
+//File is a read-only handle of a file in the system, returned by Open.
+//
+//It implements io.Reader, io.ReaderAt, io.Seeker and io.Closer.
+//Only the data blocks covering the requested bytes are read, and reconstructed if needed.
+type File struct {
+	e *Erasure
+
+	//the file being read
+	fi *fileInfo
+
+	//the file whose BLOBs hold the data, the container of a packed file, where the data begin at offset base
+	blob *fileInfo
+	base int64
+
+	//the erasure parameters of blob
+	c *codec
+
+	//the opened BLOB of every disk
+	ifs []*os.File
+
+	//mu guards offset and the stripe cache
+	mu sync.Mutex
+
+	//the offset of next Read
+	offset int64
+
+	//hash of the bytes returned by sequential Reads, checked against the file hash once the end is reached.
+	//It's dropped if Read skips bytes.
+	h      hash.Hash
+	hashed int64
+
+	//the data blocks read last time, to serve sequential small reads
+	cacheNo    int
+	cacheFirst int
+	cacheLast  int
+	cacheData  []byte
+
+	closed bool
+}
+
+//fileStat implements os.FileInfo for files in the system.
+type fileStat struct {
+	name    string
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+	isDir   bool
+}
+
+func (fs *fileStat) Name() string { return fs.name }
+func (fs *fileStat) Size() int64  { return fs.size }
+func (fs *fileStat) Mode() os.FileMode {
+	if fs.isDir {
+		return os.ModeDir | 0777
+	}
+	if fs.mode != 0 {
+		return fs.mode
+	}
+	return 0666
+}
+func (fs *fileStat) ModTime() time.Time { return fs.modTime }
+func (fs *fileStat) IsDir() bool        { return fs.isDir }
+func (fs *fileStat) Sys() interface{}   { return nil }
+
+//Open opens file `filename` in the system for reading.
+//
+//The returned handle maps an offset to the stripes and blocks via the file distribution,
+//so that ranges can be served without saving the whole file to local disk.
+func (e *Erasure) Open(filename string) (*File, error) {
+	return e.openFile(fileKey(filename))
+}
+
+//openFile opens the file of key `baseFileName` for reading
+func (e *Erasure) openFile(baseFileName string) (*File, error) {
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return nil, errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	f := &File{e: e, fi: fi, blob: fi, cacheNo: -1}
+	if fi.Pack != nil {
+		baseFileName = packName(fi.Pack.Container)
+		intBlob, ok := e.fileMap.Load(baseFileName)
+		if !ok {
+			return nil, errFileNotFound
+		}
+		f.blob = intBlob.(*fileInfo)
+		f.base = fi.Pack.Offset
+	}
+	f.c = e.codecOf(f.blob)
+	ifs, alive := e.openBlobs(baseFileName, os.O_RDONLY)
+	if alive < f.c.K {
+		closeBlobs(ifs)
+		return nil, errTooFewDisksAlive
+	}
+	f.ifs = ifs
+	if fi.Hash != "" {
+		f.h = sha256.New()
+	}
+	return f, nil
+}
+
+//Stat returns the os.FileInfo describing the file.
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.fi.stat(), nil
+}
+
+//Read reads up to len(p) bytes from the current offset.
+//
+//If the whole file is read sequentially, errFileIncompleted is returned at the end when it mismatches the file hash.
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	offset := f.offset
+	f.mu.Unlock()
+	n, err := f.ReadAt(p, offset)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.offset = offset + int64(n)
+	if f.h != nil {
+		if offset > f.hashed {
+			f.h = nil
+		} else if end := offset + int64(n); end > f.hashed {
+			f.h.Write(p[f.hashed-offset : n])
+			f.hashed = end
+			if f.hashed == f.fi.FileSize {
+				sum := fmt.Sprintf("%x", f.h.Sum(nil))
+				f.h = nil
+				if sum != f.fi.Hash {
+					return n, errFileIncompleted
+				}
+			}
+		}
+	}
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+//ReadAt reads len(p) bytes starting at byte offset `off`, it's safe for concurrent use.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errFileClosed
+	}
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	e := f.e
+	fileSize := f.fi.FileSize
+	n := 0
+	for n < len(p) && off < fileSize {
+		//the offset in the BLOBs
+		pos := f.base + off
+		stripeNo := int(pos / f.c.dataStripeSize)
+		stripeOffset := int64(stripeNo) * f.c.dataStripeSize
+		lo := pos - stripeOffset
+		hi := lo + int64(len(p)-n)
+		if hi > f.c.dataStripeSize {
+			hi = f.c.dataStripeSize
+		}
+		if hi > f.base+fileSize-stripeOffset {
+			hi = f.base + fileSize - stripeOffset
+		}
+		bs := e.blockSizeOf(f.blob, stripeNo)
+		data, err := f.blocks(stripeNo, int(lo/bs), int((hi-1)/bs))
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[lo:hi])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+//blocks returns the data of stripe `stripeNo`, in which only data blocks `first` to `last` are valid.
+//The returned slice must not be modified.
+func (f *File) blocks(stripeNo, first, last int) ([]byte, error) {
+	f.mu.Lock()
+	if f.cacheNo == stripeNo && f.cacheFirst <= first && last <= f.cacheLast {
+		data := f.cacheData
+		f.mu.Unlock()
+		return data, nil
+	}
+	f.mu.Unlock()
+	e := f.e
+	buf := make([]byte, f.c.allStripeSize)
+	//the data blocks are reconstructed in place, so buf begins with the data
+	if _, err := e.readDataBlocks(f.blob, f.ifs, stripeNo, first, last, buf); err != nil {
+		return nil, err
+	}
+	data := buf[:f.c.dataStripeSize]
+	f.mu.Lock()
+	f.cacheNo = stripeNo
+	f.cacheFirst = first
+	f.cacheLast = last
+	f.cacheData = data
+	f.mu.Unlock()
+	return data, nil
+}
+
+//Seek sets the offset for the next Read, interpreted according to `whence`.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.fi.FileSize
+	default:
+		return 0, errInvalidWhence
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+//Close closes the opened BLOBs.
+func (f *File) Close() error {
+	if f.closed {
+		return errFileClosed
+	}
+	f.closed = true
+	closeBlobs(f.ifs)
+	return nil
+}
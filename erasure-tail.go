@@ -0,0 +1,67 @@
+package grasure
+
+//The last stripe of a file is mostly partially filled. Rather than refilled with zeros up to dataStripeSize,
+//it's encoded with the smallest block size fitting its tail, recorded as fileInfo.TailBlockSize,
+//so a file just over a stripe boundary doesn't take nearly two stripes on disks.
+//
+//The data of the last stripe lie in its k data blocks one after another, as in any other stripe,
+//so the data blocks read into a stripe buffer are contiguous. The blocks are still located at offsets in units of BlockSize,
+//and a short block takes the start of its slot, which ends its BLOB unless Scale kept blocks after it, see fileInfo.Offsets.
+//
+//Files encoded before have a TailBlockSize of zero, whose last stripe is of full blocks.
+//It's shortened the next time the stripe is encoded again, e.g., by Update, Append or Truncate.
+
+//tailBlockSize returns the block size of the last stripe of a file of `fileSize` bytes,
+//or zero if the last stripe is full
+func (c *codec) tailBlockSize(fileSize int64) int64 {
+	tail := fileSize % c.dataStripeSize
+	if tail == 0 {
+		return 0
+	}
+	return ceilFracInt64(tail, int64(c.K))
+}
+
+//blockSizeOf returns the size of the blocks of stripe `stripeNo` of `fi`
+func (e *Erasure) blockSizeOf(fi *fileInfo, stripeNo int) int64 {
+	if fi.TailBlockSize > 0 && stripeNo == len(fi.Distribution)-1 {
+		return fi.TailBlockSize
+	}
+	if fi.BlockSize > 0 {
+		return fi.BlockSize
+	}
+	return e.BlockSize
+}
+
+//stripeSizeOf returns the size of all blocks of stripe `stripeNo` of `fi`
+func (e *Erasure) stripeSizeOf(fi *fileInfo, stripeNo int) int64 {
+	c := e.codecOf(fi)
+	return int64(c.K+c.M) * e.blockSizeOf(fi, stripeNo)
+}
+
+//blobSizes returns the size of the BLOB of `fi` on every disk, up to the end of its last block
+func (e *Erasure) blobSizes(fi *fileInfo) []int64 {
+	sizes := make([]int64, e.DiskNum)
+	blockSize := e.codecOf(fi).BlockSize
+	for stripeNo, row := range fi.Distribution {
+		bs := e.blockSizeOf(fi, stripeNo)
+		for i, diskId := range row {
+			if end := int64(fi.blockToOffset[stripeNo][i])*blockSize + bs; end > sizes[diskId] {
+				sizes[diskId] = end
+			}
+		}
+	}
+	return sizes
+}
+
+//padBlock returns `block` refilled with zeros up to `blockSize` if it's a short block of a last stripe,
+//so that records of journals and parity logs are all of the block size of the file.
+//The padding is cut off when the journal is applied, and never read back from a parity log,
+//as a delta is xored into blocks no longer than itself.
+func padBlock(block []byte, blockSize int64) []byte {
+	if int64(len(block)) >= blockSize {
+		return block
+	}
+	padded := make([]byte, blockSize)
+	copy(padded, block)
+	return padded
+}
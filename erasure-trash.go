@@ -0,0 +1,256 @@
+package grasure
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//the directory on every disk where removed files are kept in trash mode
+const trashDir = ".trash"
+
+//trashInfo records a file removed in trash mode, until it's undeleted or purged.
+//
+//The directories of the file and its old versions are moved into `<disk>/.trash/<dir>` on every disk,
+//where they're kept as they were, so undeleting a file moves them back.
+//Recover restores the files in the system only, a file undeleted after its disks are replaced is read degraded.
+type trashInfo struct {
+	//the file info at the removal
+	File *fileInfo `json:"file"`
+
+	//the old versions of the file
+	Versions []*fileInfo `json:"versions,omitempty"`
+
+	//when the file was removed
+	DeletedAt time.Time `json:"deletedAt"`
+
+	//the directory holding the file under trashDir
+	Dir string `json:"dir"`
+}
+
+//TrashedFile describes a file in the trash, as listed by ListTrash
+type TrashedFile struct {
+	//the name and size of the file
+	Name string
+	Size int64
+
+	//when the file was removed
+	DeletedAt time.Time
+}
+
+//trashFile moves file `fi` and its old versions into the trash, and returns the record of the trash
+func (e *Erasure) trashFile(fi *fileInfo) (*trashInfo, error) {
+	ti, err := e.newTrashInfo(fi)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.moveToTrash(ti); err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+//newTrashInfo returns the record of file `fi` and its old versions as they would be moved into the trash
+func (e *Erasure) newTrashInfo(fi *fileInfo) (*trashInfo, error) {
+	//the file is kept as it is, so its pending parity deltas are merged beforehand
+	if err := e.mergeParityLogOf(fi.FileName); err != nil {
+		return nil, err
+	}
+	intFi, ok := e.fileMap.Load(fi.FileName)
+	if !ok {
+		return nil, errFileNotFound
+	}
+	fi = intFi.(*fileInfo)
+	deletedAt := time.Now()
+	ti := &trashInfo{
+		File:      fi,
+		DeletedAt: deletedAt,
+		Dir:       fmt.Sprintf("%s.%d", fi.FileName, deletedAt.UnixNano()),
+	}
+	for _, id := range fi.Versions {
+		if intOld, ok := e.fileMap.Load(versionName(fi.FileName, id)); ok {
+			ti.Versions = append(ti.Versions, intOld.(*fileInfo))
+		}
+	}
+	return ti, nil
+}
+
+//names returns the names of the file of `ti` and its old versions
+func (ti *trashInfo) names() []string {
+	names := []string{ti.File.FileName}
+	for _, fi := range ti.Versions {
+		names = append(names, fi.FileName)
+	}
+	return names
+}
+
+//moveToTrash moves the directories of `ti` into the trash and records it
+func (e *Erasure) moveToTrash(ti *trashInfo) error {
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if err := os.MkdirAll(filepath.Join(disk.diskPath, trashDir, ti.Dir), 0777); err != nil {
+			e.removeTrash(ti)
+			return err
+		}
+	}
+	names := ti.names()
+	err := e.moveDirs(names, func(diskPath, name string) string {
+		return filepath.Join(diskPath, name)
+	}, func(diskPath, name string) string {
+		return filepath.Join(diskPath, trashDir, ti.Dir, name)
+	})
+	if err != nil {
+		e.removeTrash(ti)
+		return err
+	}
+	for _, name := range names {
+		e.dropJournal(name)
+		e.dropParityLog(name)
+		e.deleteFile(name)
+	}
+	e.mu.Lock()
+	e.TrashMeta = append(e.TrashMeta, ti)
+	e.mu.Unlock()
+	return nil
+}
+
+//moveDirs renames directory `from(disk, name)` to `to(disk, name)` on every disk for all `names`.
+//
+//The directories missing on some disk are skipped, and the moved ones are put back if any rename fails.
+func (e *Erasure) moveDirs(names []string, from, to func(diskPath, name string) string) error {
+	type move struct{ src, dst string }
+	var done []move
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		for _, name := range names {
+			src, dst := from(disk.diskPath, name), to(disk.diskPath, name)
+			err := os.Rename(src, dst)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				for i := len(done) - 1; i >= 0; i-- {
+					os.Rename(done[i].dst, done[i].src)
+				}
+				return err
+			}
+			done = append(done, move{src, dst})
+		}
+		if err := syncDir(disk.diskPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//removeTrash removes the directory of `ti` from the trash of every disk
+func (e *Erasure) removeTrash(ti *trashInfo) error {
+	for _, disk := range e.diskInfos[:e.DiskNum] {
+		if err := os.RemoveAll(filepath.Join(disk.diskPath, trashDir, ti.Dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ListTrash lists the files in the trash, in the order they were removed.
+func (e *Erasure) ListTrash() []TrashedFile {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	files := make([]TrashedFile, 0, len(e.TrashMeta))
+	for _, ti := range e.TrashMeta {
+		files = append(files, TrashedFile{Name: fileName(ti.File.FileName), Size: ti.File.FileSize, DeletedAt: ti.DeletedAt})
+	}
+	return files
+}
+
+//Undelete brings file `filename` back from the trash along with its old versions.
+//
+//If the file was removed more than once, the latest removed one is brought back.
+//A file of the same name in the system is replaced only with Override, it goes to the trash in its turn.
+func (e *Erasure) Undelete(filename string) error {
+	baseFileName := fileKey(filename)
+	e.mu.RLock()
+	var ti *trashInfo
+	for _, t := range e.TrashMeta {
+		if t.File.FileName == baseFileName {
+			ti = t
+		}
+	}
+	e.mu.RUnlock()
+	if ti == nil {
+		return errFileNotFound
+	}
+	if _, ok := e.fileMap.Load(baseFileName); ok {
+		if !e.Override {
+			return fmt.Errorf("the file %s has already been in the file system, if you wish to override, please attach `-o`",
+				fileName(baseFileName))
+		}
+		if err := e.removeFile(baseFileName); err != nil {
+			return err
+		}
+	} else if err := e.checkNewFile(baseFileName); err != nil {
+		return err
+	}
+	if err := e.untrash(ti); err != nil {
+		return err
+	}
+	if !e.Quiet {
+		log.Printf("file %s successfully undeleted.", fileName(baseFileName))
+	}
+	return nil
+}
+
+//untrash moves the file of `ti` and its old versions back from the trash into the system
+func (e *Erasure) untrash(ti *trashInfo) error {
+	files := append([]*fileInfo{ti.File}, ti.Versions...)
+	names := ti.names()
+	e.reclaimRetired(names)
+	err := e.moveDirs(names, func(diskPath, name string) string {
+		return filepath.Join(diskPath, trashDir, ti.Dir, name)
+	}, func(diskPath, name string) string {
+		return filepath.Join(diskPath, name)
+	})
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		e.unzipFileInfo(fi)
+		e.storeFile(fi)
+	}
+	e.forgetTrash(ti)
+	e.removeTrash(ti)
+	return nil
+}
+
+//forgetTrash drops `ti` from the trash records
+func (e *Erasure) forgetTrash(ti *trashInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, t := range e.TrashMeta {
+		if t == ti {
+			e.TrashMeta = append(e.TrashMeta[:i:i], e.TrashMeta[i+1:]...)
+			break
+		}
+	}
+}
+
+//PurgeTrash removes the files in the trash removed more than `olderThan` ago, freeing their blocks.
+//
+//A zero `olderThan` empties the trash.
+func (e *Erasure) PurgeTrash(olderThan time.Duration) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kept := make([]*trashInfo, 0, len(e.TrashMeta))
+	var err error
+	for _, ti := range e.TrashMeta {
+		if err != nil || time.Since(ti.DeletedAt) < olderThan {
+			kept = append(kept, ti)
+			continue
+		}
+		if err = e.removeTrash(ti); err != nil {
+			kept = append(kept, ti)
+		}
+	}
+	e.TrashMeta = kept
+	return err
+}
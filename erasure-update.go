@@ -2,21 +2,38 @@ package grasure
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"sort"
-	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
 //update a file according to a new file, the local `filename` will be used to update the file in the cloud with the same name
+//
+//The changed blocks are journaled before written in place, so the file is either the old version or the new one
+//even if the update is interrupted by a crash, see erasure-journal.go.
+//
+//Up to m disks may be unavailable, the blocks destined for them are left stale and listed in the repair list
+//of the file, until brought up to date by RepairStale or Recover.
+//
+//In versioning mode, the new file is encoded afresh instead, keeping the old version intact.
+//So is a packed file, which has no blocks of its own to update.
 func (e *Erasure) Update(oldFile, newFile string) error {
+	return e.UpdateWithContext(context.Background(), oldFile, newFile)
+}
+
+//UpdateWithContext is like Update, but stops updating once `ctx` is done.
+//
+//The context error is returned then, and the file is left as the old version.
+func (e *Erasure) UpdateWithContext(ctx context.Context, oldFile, newFile string) error {
 	// read old file info
-	baseName := filepath.Base(oldFile)
+	baseName := fileKey(oldFile)
 	intFi, ok := e.fileMap.Load(baseName)
 	if !ok {
 		return errFileNotFound
@@ -28,245 +45,222 @@ func (e *Erasure) Update(oldFile, newFile string) error {
 		return err
 	}
 	defer nf.Close()
-	fileInfo, err := nf.Stat()
-	oldFileSize := fi.FileSize
-	fi.FileSize = fileInfo.Size()
-	hashStr, err := hashStr(nf)
+	if e.Versioning || fi.Pack != nil {
+		return e.encodeVersion(ctx, baseName, nf)
+	}
+	c := e.codecOf(fi)
+	stat, err := nf.Stat()
 	if err != nil {
 		return err
 	}
-	fi.Hash = hashStr
-
-	// open file as io.Reader
-	alive := int32(0)
-	diskNum := len(e.diskInfos)
-	ifs := make([]*os.File, diskNum)
-	erg := new(errgroup.Group)
-	diskFail := false
-	for i, disk := range e.diskInfos[:e.DiskNum] {
-		i := i
-		disk := disk
-		erg.Go(func() error {
-			folderPath := filepath.Join(disk.diskPath, baseName)
-			blobPath := filepath.Join(folderPath, "BLOB")
-			if !disk.available {
-				diskFail = true
-				return &diskError{disk.diskPath, " avilable flag set flase"}
-			}
-			ifs[i], err = os.OpenFile(blobPath, os.O_RDWR|os.O_TRUNC, 0666)
-			if err != nil {
-				disk.available = false
+	h := sha256.New()
+	if _, err := io.Copy(h, nf); err != nil {
+		return err
+	}
+	//hashing takes a while, nothing is changed if cancelled meanwhile
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pl, err := e.beginParityUpdate(baseName)
+	if err != nil {
+		return err
+	}
+	if pl != nil {
+		defer pl.wmu.Unlock()
+		//parity deltas are logged only if the layout is kept, otherwise the pending ones are merged beforehand
+		if ceilFracInt64(stat.Size(), c.dataStripeSize) != int64(len(fi.Distribution)) ||
+			c.tailBlockSize(stat.Size()) != fi.TailBlockSize {
+			if err := e.mergeParityLog(baseName, pl); err != nil {
 				return err
 			}
-
-			disk.available = true
-			atomic.AddInt32(&alive, 1)
-			return nil
-		})
-	}
-	if err := erg.Wait(); err != nil {
-		if !e.Quiet {
-			log.Printf("read failed %s", err.Error())
-		}
-		if diskFail {
-			return err
+			pl = nil
 		}
 	}
-	defer func() {
-		for i := range e.diskInfos {
-			ifs[i].Close()
-		}
-	}()
-	if int(alive) < e.K {
-		//the disk renders inrecoverable
+	//the file info is replaced if the parity log is merged meanwhile
+	intFi, _ = e.fileMap.Load(baseName)
+	fi = intFi.(*fileInfo)
+	var pw *parityLogger
+	if pl != nil {
+		pw = e.newParityLogger(fi)
+		defer pw.close()
+	}
+	// open file as io.Reader, the blobs are only read until the journal is committed
+	ifs, alive := e.openBlobs(baseName, os.O_RDONLY)
+	defer closeBlobs(ifs)
+	if e.DiskNum-alive > c.M {
 		return errTooFewDisksAlive
 	}
-	if int(alive) == e.DiskNum {
-		if !e.Quiet {
-			log.Println("start reading blocks")
-		}
-	} else {
-		if !e.Quiet {
-			log.Println("start reconstructing blocks")
-		}
+	if !e.Quiet {
+		log.Println("start updating blocks")
 	}
 
-	oldStripeNum := int(ceilFracInt64(oldFileSize, e.dataStripeSize))
-	newStripeNum := int(ceilFracInt64(fi.FileSize, e.dataStripeSize))
-	// fmt.Println(oldStripeNum, newStripeNum)
-	numBlob := ceilFracInt(newStripeNum, e.ConStripes)
-	adjustDist(e, fi, oldStripeNum, newStripeNum)
+	oldStripeNum := len(fi.Distribution)
+	newStripeNum := int(ceilFracInt64(stat.Size(), c.dataStripeSize))
+	//the new version is described by a copy, which takes effect once the update is committed
+	newFi := &fileInfo{
+		FileName:     fi.FileName,
+		FileSize:     stat.Size(),
+		Distribution: append([][]int(nil), fi.Distribution[:min(oldStripeNum, newStripeNum)]...),
+		Offsets:      fi.Offsets[:min(len(fi.Offsets), newStripeNum)],
+		BlockSums:    make([][]uint32, min(len(fi.BlockSums), newStripeNum)),
+		VersionID:    fi.VersionID,
+		Versions:     fi.Versions,
+		Mode:         fi.Mode,
+		ModTime:      time.Now(),
+		//the last stripe is shortened to fit the new tail
+		TailBlockSize: c.tailBlockSize(stat.Size()),
+		K:             fi.K,
+		M:             fi.M,
+		BlockSize:     fi.BlockSize,
+	}
+	for i := range newFi.BlockSums {
+		newFi.BlockSums[i] = append([]uint32(nil), fi.BlockSums[i]...)
+	}
+	setHash(newFi, h)
+	adjustDist(e, newFi, oldStripeNum, newStripeNum)
+	rl := newRepairList(fi, min(oldStripeNum, newStripeNum))
+	jn, err := e.newJournal(baseName, c.BlockSize)
+	if err != nil {
+		return err
+	}
 
+	numBlob := ceilFracInt(newStripeNum, e.ConStripes)
 	stripeCnt := 0
 	nextStripe := 0
-	dist := fi.Distribution
-	newBlobBuf := makeArr2DByte(e.ConStripes, int(e.dataStripeSize))
-	oldBlobBuf := makeArr2DByte(e.ConStripes, int(e.allStripeSize))
+	newBlobBuf := makeArr2DByte(e.ConStripes, int(c.dataStripeSize))
+	oldBlobBuf := makeArr2DByte(e.ConStripes, int(c.allStripeSize))
 	for blob := 0; blob < numBlob; blob++ {
+		if err := ctx.Err(); err != nil {
+			jn.discard()
+			return err
+		}
 		if stripeCnt+e.ConStripes > newStripeNum {
 			nextStripe = newStripeNum - stripeCnt
 		} else {
 			nextStripe = e.ConStripes
 		}
 		eg := e.errgroupPool.Get().(*errgroup.Group)
-		// newBlobBuf := *e.dataBlobPool.Get().(*[][]byte)
-		// oldBlobBuf := *e.allBlobPool.Get().(*[][]byte)
 		for s := 0; s < nextStripe; s++ {
 			s := s
 			stripeNo := stripeCnt + s
-			if stripeNo < oldStripeNum {
-				// read old data shards
-				// fmt.Println("old")
-				eg.Go(func() error {
-					erg := e.errgroupPool.Get().(*errgroup.Group)
-					defer e.errgroupPool.Put(erg)
-					for i := 0; i < e.K+e.M; i++ {
-						i := i
-						erg.Go(func() error {
-							diskID := dist[stripeNo][i]
-							disk := e.diskInfos[diskID]
-							if !disk.available {
-								return nil
-							}
-							offset := fi.blockToOffset[stripeNo][i]
-							_, err := ifs[diskID].ReadAt(oldBlobBuf[s][int64(i)*e.BlockSize:int64(i+1)*e.BlockSize],
-								int64(offset)*e.BlockSize)
-							if err != nil && err != io.EOF {
-								return err
-							}
-							return nil
-						})
-					}
-					if err := erg.Wait(); err != nil {
-						return err
-					}
-					//Split the blob into k+m parts
-					oldData, err := e.splitStripe(oldBlobBuf[s])
+			eg.Go(func() error {
+				// read new data shards, the tail of the last stripe is refilled with zeros
+				offset := int64(stripeNo) * c.dataStripeSize
+				n, err := nf.ReadAt(newBlobBuf[s], offset)
+				if err != nil && err != io.EOF {
+					return err
+				}
+				for i := n; i < len(newBlobBuf[s]); i++ {
+					newBlobBuf[s][i] = 0
+				}
+				bs := e.blockSizeOf(newFi, stripeNo)
+				newData, err := c.enc.Split(newBlobBuf[s][:int64(c.K)*bs])
+				if err != nil {
+					return err
+				}
+				if stripeNo >= oldStripeNum || e.blockSizeOf(fi, stripeNo) != bs {
+					// if new filesize is greater than old filesize, we just encode the remaining data,
+					// so is a stripe whose block size changes, as the last one does with the tail
+					err = c.enc.Encode(newData)
 					if err != nil {
 						return err
 					}
-					//verify and reconstruct
-					ok, err := e.enc.Verify(oldData)
-					if err != nil {
-						return err
-					}
-					if !ok {
-						// fmt.Println("reconstruct data of stripe:", stripeNo)
-						err = e.enc.Reconstruct(oldData)
-						if err != nil {
+					e.setBlockSums(newFi, stripeNo, newData)
+					for i := 0; i < c.K+c.M; i++ {
+						if err := e.logBlock(jn, rl, newFi, stripeNo, i, newData[i]); err != nil {
 							return err
 						}
 					}
-					// read new data shards
-					offset := int64(stripeCnt+s) * e.dataStripeSize
-					_, err = nf.ReadAt(newBlobBuf[s], offset)
-					if err != nil && err != io.EOF {
-						return err
-					}
-					newData, err := e.enc.Split(newBlobBuf[s])
-					if err != nil {
-						return err
-					}
-					// compare
-					diffIdx, err := compareStripe(oldData[0:e.K], newData[0:e.K])
-					if err != nil {
-						return err
-					}
-					// if no data has been changed,
-					if diffIdx == nil {
-						return nil
-					}
-					// we create the argments of Update
-					shards := make([][]byte, e.K+e.M)
-					for i := range shards {
-						shards[i] = make([]byte, e.BlockSize)
-					}
-					for i := range oldData {
-						if i >= e.K || sort.SearchInts(diffIdx, i) != len(diffIdx) {
-							copy(shards[i], oldData[i])
-						} else {
-							shards[i] = nil
-							newData[i] = nil
-						}
-					}
-					// update
-					err = e.enc.Update(shards, newData[0:e.K])
-					if err != nil {
-						return err
-					}
-					// we write back the changed data blocks and all parity blocks
-					for i := 0; i < e.K+e.M; i++ {
-						i := i
-						if shards[i] == nil {
-							continue
-						}
-						newBlock := make([]byte, e.BlockSize)
-						if i >= e.K {
-							copy(newBlock, shards[i])
-						} else {
-							copy(newBlock, newData[i])
-						}
-						erg.Go(func() error {
-							diskID := fi.Distribution[stripeNo][i]
-							offset := fi.blockToOffset[stripeNo][i]
-							_, err := ifs[diskID].WriteAt(newBlock, int64(offset)*e.BlockSize)
-							if err != nil {
-								return err
-							}
-							return nil
-						})
-					}
-					if err := erg.Wait(); err != nil {
-						return err
-					}
 					return nil
-				})
-			} else {
-				// if new filesize is greater than old filesize, we just encode the remaining data
-				// fmt.Println("new")
-				eg.Go(func() error {
-					offset := int64(stripeNo) * e.dataStripeSize
-					_, err = nf.ReadAt(newBlobBuf[s], offset)
-					if err != nil && err != io.EOF {
-						return err
-					}
-					newData, err := e.enc.Split(newBlobBuf[s])
-					if err != nil {
-						return err
+				}
+				// read old data shards, verified and reconstructed if needed
+				oldData, err := e.readStripe(fi, ifs, stripeNo, oldBlobBuf[s], false)
+				if err != nil {
+					return err
+				}
+				// compare
+				diffIdx, err := compareStripe(oldData[0:c.K], newData[0:c.K])
+				if err != nil {
+					return err
+				}
+				// if no data has been changed,
+				if diffIdx == nil {
+					e.setBlockSums(newFi, stripeNo, e.unpatchedStripe(fi, pl, stripeNo, oldData))
+					return nil
+				}
+				//the unchanged blocks keep their checksums, the others are recorded below
+				e.setBlockSums(newFi, stripeNo, e.unpatchedStripe(fi, pl, stripeNo, oldData))
+				// we create the argments of Update
+				shards := make([][]byte, c.K+c.M)
+				for i := range shards {
+					shards[i] = make([]byte, bs)
+				}
+				for i := range oldData {
+					if i >= c.K || sort.SearchInts(diffIdx, i) != len(diffIdx) {
+						copy(shards[i], oldData[i])
+					} else {
+						shards[i] = nil
+						newData[i] = nil
 					}
-					err = e.enc.Encode(newData)
-					if err != nil {
-						return err
+				}
+				// update
+				err = c.enc.Update(shards, newData[0:c.K])
+				if err != nil {
+					return err
+				}
+				// we journal the changed data blocks and all parity blocks
+				for i := 0; i < c.K+c.M; i++ {
+					if shards[i] == nil {
+						continue
 					}
-					erg := e.errgroupPool.Get().(*errgroup.Group)
-					defer e.errgroupPool.Put(erg)
-					for i := 0; i < e.K+e.M; i++ {
-						i := i
-						erg.Go(func() error {
-							a := i
-							diskID := fi.Distribution[stripeNo][a]
-							writeOffset := fi.blockToOffset[stripeNo][a]
-							_, err := ifs[diskID].WriteAt(newData[a], int64(writeOffset)*e.BlockSize)
-							if err != nil {
-								return err
-							}
-							return nil
-						})
+					newBlock := shards[i]
+					if i < c.K {
+						newBlock = newData[i]
+					} else if pw != nil {
+						//the parity block on disk is kept along with its checksum, only the delta is logged
+						xorBlock(oldData[i], newBlock)
+						if err := pw.log(newFi.Distribution[stripeNo][i], newFi.blockToOffset[stripeNo][i], oldData[i]); err != nil {
+							return err
+						}
+						continue
 					}
-					if err := erg.Wait(); err != nil {
+					newFi.BlockSums[stripeNo][i] = blockSum(newBlock)
+					if err := e.logBlock(jn, rl, newFi, stripeNo, i, newBlock); err != nil {
 						return err
 					}
-					return nil
-				})
-			}
-
+				}
+				return nil
+			})
 		}
 		if err := eg.Wait(); err != nil {
+			jn.discard()
 			return err
 		}
 		e.errgroupPool.Put(eg)
 		stripeCnt += nextStripe
 	}
+	newFi.RepairList = rl.list()
+	newFi.markStale()
+	if pw != nil {
+		if err := pw.sync(newFi); err != nil {
+			jn.discard()
+			return err
+		}
+	}
+	//the commit point, from now on the update survives crashes
+	if err := jn.commit(newFi); err != nil {
+		jn.discard()
+		return err
+	}
+	closeBlobs(ifs)
+	if pw != nil {
+		err = e.publishParity(newFi, pl, pw)
+	} else {
+		err = e.publish(newFi)
+	}
+	if err != nil {
+		return err
+	}
 
 	if !e.Quiet {
 		log.Println(baseName, " successfully updated.")
@@ -293,29 +287,14 @@ func compareStripe(oldStripe, newStripe [][]byte) ([]int, error) {
 	return res, nil
 }
 
+//adjustDist resizes the distribution of `fi` from `oldStripeNum` to `newStripeNum` stripes,
+//the new stripes are randomly distributed and placed after the existing blocks of every disk.
 func adjustDist(e *Erasure, fi *fileInfo, oldStripeNum, newStripeNum int) {
-	countSum := make([]int, e.DiskNum)
-	if newStripeNum > oldStripeNum {
-		for i := 0; i < newStripeNum-oldStripeNum; i++ {
-			fi.Distribution = append(fi.Distribution, make([]int, e.K+e.M))
-			fi.blockToOffset = append(fi.blockToOffset, make([]int, e.K+e.M))
-		}
-		for i := 0; i < oldStripeNum; i++ {
-			for j := 0; j < e.K+e.M; j++ {
-				diskId := fi.Distribution[i][j]
-				countSum[diskId]++
-			}
-		}
-		for i := oldStripeNum; i < newStripeNum; i++ {
-			fi.Distribution[i] = genRandomArr(e.DiskNum, 0)[0 : e.K+e.M]
-			for j := 0; j < e.K+e.M; j++ {
-				diskID := fi.Distribution[i][j]
-				fi.blockToOffset[i][j] = countSum[diskID]
-				countSum[diskID]++
-			}
-		}
-	} else {
-		fi.Distribution = fi.Distribution[0:newStripeNum]
-		fi.blockToOffset = fi.blockToOffset[0:newStripeNum]
+	c := e.codecOf(fi)
+	for i := oldStripeNum; i < newStripeNum; i++ {
+		fi.Distribution = append(fi.Distribution, genRandomArr(e.DiskNum, 0)[0:c.K+c.M])
 	}
+	fi.Distribution = fi.Distribution[0:newStripeNum]
+	e.growBlockSums(fi, newStripeNum)
+	e.unzipFileInfo(fi)
 }
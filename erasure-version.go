@@ -0,0 +1,273 @@
+package grasure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"time"
+)
+
+//In versioning mode, a file encoded again or updated keeps its former version.
+//
+//An old version is an ordinary file in the system keyed `<key>~v<id>`, hidden behind the current version,
+//so it's read, recovered and repaired like any other file. Its directories are those of the former version,
+//which are renamed rather than removed when the new version is committed, so keeping a version costs no copy.
+//The keys of this form are reserved, no file name is escaped into one, see erasure-namespace.go.
+//
+//WriteAt, Append and Truncate encode the changed content as a new version too, see rewriteVersion.
+//The directories of a dropped version are removed only once the config no longer referring to it is written,
+//see removeRetired.
+
+//versionSuffix matches the names of old versions
+var versionSuffix = regexp.MustCompile(`~v[0-9]+$`)
+
+//FileVersion describes a version of a file, as listed by ListVersions
+type FileVersion struct {
+	//ID numbers the version
+	ID int
+
+	//the size and hash of the version
+	Size int64
+	Hash string
+
+	//ModTime is when the version was last changed
+	ModTime time.Time
+
+	//Current tells if it's the current version
+	Current bool
+}
+
+//versionName returns the name under which version `versionID` of `baseFileName` is kept
+func versionName(baseFileName string, versionID int) string {
+	return fmt.Sprintf("%s~v%d", baseFileName, versionID)
+}
+
+//isVersionName tells if `baseFileName` is reserved for old versions
+func isVersionName(baseFileName string) bool {
+	return versionSuffix.MatchString(baseFileName)
+}
+
+//formerVersion returns the current version of `baseFileName` about to be replaced, if any,
+//and in versioning mode the name it's kept as.
+func (e *Erasure) formerVersion(baseFileName string) (*fileInfo, string, error) {
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return nil, "", nil
+	}
+	if !e.Versioning {
+		return intFi.(*fileInfo), "", nil
+	}
+	//an old version is never changed, so its pending parity deltas are merged beforehand
+	if err := e.mergeParityLogOf(baseFileName); err != nil {
+		return nil, "", err
+	}
+	intFi, _ = e.fileMap.Load(baseFileName)
+	fi := intFi.(*fileInfo)
+	return fi, versionName(baseFileName, fi.VersionID), nil
+}
+
+//keepVersion makes `former`, whose directories are committed as `name`, an old version of `fi`, and returns it
+//along with the old versions beyond MaxVersions, which `fi` no longer lists and are dropped once committed.
+func (e *Erasure) keepVersion(fi, former *fileInfo, name string) (*fileInfo, []int) {
+	old := *former
+	old.FileName = name
+	old.Versions = nil
+	fi.Versions = append(append([]int(nil), former.Versions...), former.VersionID)
+	var pruned []int
+	if e.MaxVersions > 0 && len(fi.Versions) > e.MaxVersions {
+		n := len(fi.Versions) - e.MaxVersions
+		pruned = fi.Versions[:n]
+		fi.Versions = append([]int(nil), fi.Versions[n:]...)
+	}
+	return &old, pruned
+}
+
+//pruneVersions removes the old versions of `fi` but the latest `keep` ones
+func (e *Erasure) pruneVersions(fi *fileInfo, keep int) {
+	if keep < 0 {
+		keep = 0
+	}
+	if len(fi.Versions) <= keep {
+		return
+	}
+	pruned := len(fi.Versions) - keep
+	for _, id := range fi.Versions[:pruned] {
+		e.dropVersion(fi.FileName, id)
+	}
+	fi.Versions = append([]int(nil), fi.Versions[pruned:]...)
+}
+
+//dropVersion removes version `versionID` of `baseFileName` from the system,
+//its blocks are freed once the config is written
+func (e *Erasure) dropVersion(baseFileName string, versionID int) {
+	name := versionName(baseFileName, versionID)
+	e.deleteFile(name)
+	e.mu.Lock()
+	e.retired = append(e.retired, name)
+	e.mu.Unlock()
+}
+
+//versionFile returns the key of version `versionID` of the file of key `baseFileName`,
+//or errFileVersionNotFound if it's not kept.
+func (e *Erasure) versionFile(baseFileName string, versionID int) (string, error) {
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return "", errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	if versionID == fi.VersionID {
+		return baseFileName, nil
+	}
+	for _, id := range fi.Versions {
+		if id != versionID {
+			continue
+		}
+		name := versionName(baseFileName, id)
+		if _, ok := e.fileMap.Load(name); ok {
+			return name, nil
+		}
+	}
+	return "", errFileVersionNotFound
+}
+
+//encodeVersion encodes the data read from `r` until EOF as the new version of `baseFileName`.
+//
+//The new version keeps the erasure parameters of the current one, unless it's packed, which takes those of Class.
+func (e *Erasure) encodeVersion(ctx context.Context, baseFileName string, r io.Reader) error {
+	c, err := e.classCodec(e.Class)
+	if intFi, ok := e.fileMap.Load(baseFileName); ok && intFi.(*fileInfo).Pack == nil {
+		c, err = e.codecOf(intFi.(*fileInfo)), nil
+	}
+	if err != nil {
+		return err
+	}
+	w, err := e.newFileWriter(ctx, baseFileName, true, e.ConStripes, c)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.abort()
+		return err
+	}
+	return w.Close()
+}
+
+//rewriteVersion changes file `fi` by encoding the content `change` makes of its data as its new version, see encodeVersion.
+//
+//It serves the packed files, whose bytes in the container are never changed in place,
+//and the files in versioning mode, whose former content is kept as an old version.
+func (e *Erasure) rewriteVersion(ctx context.Context, fi *fileInfo, change func(data io.ReaderAt) io.Reader) error {
+	f, err := e.openFile(fi.FileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return e.encodeVersion(ctx, fi.FileName, change(f))
+}
+
+//appendVersion appends the data read from `r` until EOF to file `fi` as its new version, see rewriteVersion
+func (e *Erasure) appendVersion(ctx context.Context, fi *fileInfo, r io.Reader) (int64, error) {
+	err := e.rewriteVersion(ctx, fi, func(data io.ReaderAt) io.Reader {
+		return io.MultiReader(io.NewSectionReader(data, 0, fi.FileSize), r)
+	})
+	if err != nil {
+		return 0, err
+	}
+	intFi, ok := e.fileMap.Load(fi.FileName)
+	if !ok {
+		return 0, errFileNotFound
+	}
+	return intFi.(*fileInfo).FileSize - fi.FileSize, nil
+}
+
+//ListVersions lists the versions of file `filename` kept in the system, oldest first and the current one last.
+func (e *Erasure) ListVersions(filename string) ([]FileVersion, error) {
+	baseFileName := fileKey(filename)
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return nil, errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	versions := make([]FileVersion, 0, len(fi.Versions)+1)
+	for _, id := range fi.Versions {
+		intOld, ok := e.fileMap.Load(versionName(baseFileName, id))
+		if !ok {
+			continue
+		}
+		old := intOld.(*fileInfo)
+		versions = append(versions, FileVersion{ID: id, Size: old.FileSize, Hash: old.Hash, ModTime: old.ModTime})
+	}
+	versions = append(versions, FileVersion{ID: fi.VersionID, Size: fi.FileSize, Hash: fi.Hash, ModTime: fi.ModTime, Current: true})
+	return versions, nil
+}
+
+//ReadFileVersion is like ReadFile, but reads version `versionID` of the file, see ListVersions.
+func (e *Erasure) ReadFileVersion(filename string, versionID int, savepath string, options *Options) error {
+	return e.ReadFileVersionWithContext(context.Background(), filename, versionID, savepath, options)
+}
+
+//ReadFileVersionWithContext is like ReadFileVersion, but stops reading once `ctx` is done.
+func (e *Erasure) ReadFileVersionWithContext(ctx context.Context, filename string, versionID int, savepath string, options *Options) error {
+	name, err := e.versionFile(fileKey(filename), versionID)
+	if err != nil {
+		return err
+	}
+	return e.readFile(ctx, name, savepath, options)
+}
+
+//OpenVersion is like Open, but opens version `versionID` of the file.
+func (e *Erasure) OpenVersion(filename string, versionID int) (*File, error) {
+	name, err := e.versionFile(fileKey(filename), versionID)
+	if err != nil {
+		return nil, err
+	}
+	return e.openFile(name)
+}
+
+//RestoreVersion makes the content of version `versionID` of file `filename` current again.
+func (e *Erasure) RestoreVersion(filename string, versionID int) error {
+	return e.RestoreVersionWithContext(context.Background(), filename, versionID)
+}
+
+//RestoreVersionWithContext is like RestoreVersion, but stops once `ctx` is done.
+//
+//The old version is encoded afresh as the new version, so it's kept along with the version it replaces
+//in versioning mode. Otherwise the current version is replaced.
+func (e *Erasure) RestoreVersionWithContext(ctx context.Context, filename string, versionID int) error {
+	baseFileName := fileKey(filename)
+	name, err := e.versionFile(baseFileName, versionID)
+	if err != nil {
+		return err
+	}
+	if name == baseFileName {
+		return nil
+	}
+	f, err := e.openFile(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := e.encodeVersion(ctx, baseFileName, f); err != nil {
+		return err
+	}
+	if !e.Quiet {
+		log.Printf("file %s restored to version %d.", filename, versionID)
+	}
+	return nil
+}
+
+//PruneVersions removes the old versions of file `filename` but the latest `keep` ones, freeing their blocks.
+func (e *Erasure) PruneVersions(filename string, keep int) error {
+	baseFileName := fileKey(filename)
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return errFileNotFound
+	}
+	//the file info is replaced rather than changed, as it may be in use
+	fi := *intFi.(*fileInfo)
+	e.pruneVersions(&fi, keep)
+	e.storeFile(&fi)
+	return nil
+}
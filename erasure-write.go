@@ -0,0 +1,237 @@
+package grasure
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+//WriteAt writes `p` into file `filename` at offset `off` and returns the number of bytes written.
+//The file size is unchanged, so the bytes must lie within the file.
+//
+//Only the data blocks covering `p` and the parity blocks of the touched stripes are read.
+//The parity blocks are updated by the delta of the data blocks, and only the changed blocks are written back,
+//through the journal as Update does. The file hash is dropped rather than computed again by reading the whole file,
+//the blocks are still verified by their checksums, see erasure-checksum.go.
+//In parity-logging mode, the parity deltas are logged instead, see erasure-paritylog.go.
+//Like Update, up to m disks may be unavailable, leaving the blocks destined for them stale.
+//In versioning mode, the written content is encoded as a new version instead, see rewriteVersion.
+//
+//It's not safe to write a file concurrently.
+func (e *Erasure) WriteAt(filename string, p []byte, off int64) (int, error) {
+	baseFileName := fileKey(filename)
+	intFi, ok := e.fileMap.Load(baseFileName)
+	if !ok {
+		return 0, errFileNotFound
+	}
+	fi := intFi.(*fileInfo)
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off+int64(len(p)) > fi.FileSize {
+		return 0, errRangeOutOfFile
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if e.Versioning || fi.Pack != nil {
+		//the content of the file after the write
+		end := off + int64(len(p))
+		err := e.rewriteVersion(context.Background(), fi, func(data io.ReaderAt) io.Reader {
+			return io.MultiReader(io.NewSectionReader(data, 0, off), bytes.NewReader(p), io.NewSectionReader(data, end, fi.FileSize-end))
+		})
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	pl, err := e.beginParityUpdate(baseFileName)
+	if err != nil {
+		return 0, err
+	}
+	if pl != nil {
+		defer pl.wmu.Unlock()
+	}
+	//the file info is replaced if the parity log is merged meanwhile
+	intFi, _ = e.fileMap.Load(baseFileName)
+	fi = intFi.(*fileInfo)
+	var pw *parityLogger
+	if pl != nil {
+		pw = e.newParityLogger(fi)
+		defer pw.close()
+	}
+	c := e.codecOf(fi)
+	ifs, alive := e.openBlobs(baseFileName, os.O_RDONLY)
+	defer closeBlobs(ifs)
+	if e.DiskNum-alive > c.M {
+		return 0, errTooFewDisksAlive
+	}
+	//the layout is unchanged, only the checksums of written blocks are, and the file hash is dropped
+	newFi := &fileInfo{
+		FileName:       fi.FileName,
+		FileSize:       fi.FileSize,
+		Distribution:   fi.Distribution,
+		Offsets:        fi.Offsets,
+		BlockSums:      append([][]uint32(nil), fi.BlockSums...),
+		ParityLogSizes: fi.ParityLogSizes,
+		RepairList:     fi.RepairList,
+		VersionID:      fi.VersionID,
+		Versions:       fi.Versions,
+		Mode:           fi.Mode,
+		ModTime:        time.Now(),
+		TailBlockSize:  fi.TailBlockSize,
+		K:              fi.K,
+		M:              fi.M,
+		BlockSize:      fi.BlockSize,
+		blockToOffset:  fi.blockToOffset,
+		blockInfos:     fi.blockInfos,
+	}
+	rl := newRepairList(fi, len(fi.Distribution))
+	jn, err := e.newJournal(baseFileName, c.BlockSize)
+	if err != nil {
+		return 0, err
+	}
+	firstStripe := int(off / c.dataStripeSize)
+	lastStripe := int((off + int64(len(p)) - 1) / c.dataStripeSize)
+	for first := firstStripe; first <= lastStripe; first += e.ConStripes {
+		eg := e.errgroupPool.Get().(*errgroup.Group)
+		for stripeNo := first; stripeNo <= min(lastStripe, first+e.ConStripes-1); stripeNo++ {
+			stripeNo := stripeNo
+			eg.Go(func() error {
+				return e.writeStripeAt(fi, newFi, ifs, jn, rl, pw, stripeNo, p, off)
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			jn.discard()
+			return 0, err
+		}
+		e.errgroupPool.Put(eg)
+	}
+	//the block states are renewed only if the repair list may change
+	if len(fi.RepairList) > 0 || len(rl.stale) > 0 {
+		newFi.RepairList = rl.list()
+		e.unzipFileInfo(newFi)
+	}
+	if pw != nil {
+		if err := pw.sync(newFi); err != nil {
+			jn.discard()
+			return 0, err
+		}
+	}
+	if err := jn.commit(newFi); err != nil {
+		jn.discard()
+		return 0, err
+	}
+	closeBlobs(ifs)
+	if pw != nil {
+		err = e.publishParity(newFi, pl, pw)
+	} else {
+		err = e.publish(newFi)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//writeStripeAt journals the blocks of stripe `stripeNo` changed by writing `p` at file offset `off`,
+//and records their checksums in `newFi`. The parity deltas are logged by `pw` instead if it's not nil.
+//The blocks destined for unavailable disks are recorded in `rl`.
+func (e *Erasure) writeStripeAt(fi, newFi *fileInfo, ifs []*os.File, jn *journal, rl *repairList, pw *parityLogger, stripeNo int, p []byte, off int64) error {
+	c := e.codecOf(fi)
+	//the bytes of p within the stripe, as offsets in the stripe
+	stripeOff := int64(stripeNo) * c.dataStripeSize
+	lo, hi := off-stripeOff, off+int64(len(p))-stripeOff
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > c.dataStripeSize {
+		hi = c.dataStripeSize
+	}
+	bs := e.blockSizeOf(fi, stripeNo)
+	first, last := int(lo/bs), int((hi-1)/bs)
+	want := make([]int, 0, last-first+1+c.M)
+	for i := first; i <= last; i++ {
+		want = append(want, i)
+	}
+	for i := c.K; i < c.K+c.M; i++ {
+		want = append(want, i)
+	}
+	//the old blocks are read directly, and reconstructed from the whole stripe if any is missing or fails
+	buf := make([]byte, c.allStripeSize)
+	complete := true
+	for _, i := range want {
+		complete = complete && e.isBlockAlive(fi, stripeNo, i)
+	}
+	if complete {
+		loaded, err := e.readBlocks(fi, ifs, stripeNo, want, nil, buf)
+		complete = err == nil
+		for _, i := range want {
+			complete = complete && loaded[i]
+		}
+	}
+	var splitData [][]byte
+	var err error
+	if complete {
+		splitData, err = c.splitStripe(buf[:e.stripeSizeOf(fi, stripeNo)])
+	} else {
+		splitData, err = e.readStripe(fi, ifs, stripeNo, buf, false)
+	}
+	if err != nil {
+		return err
+	}
+	shards := make([][]byte, c.K+c.M)
+	newData := make([][]byte, c.K)
+	for i := first; i <= last; i++ {
+		newData[i] = make([]byte, bs)
+		copy(newData[i], splitData[i])
+		blockOff := stripeOff + int64(i)*bs
+		if off > blockOff {
+			copy(newData[i][off-blockOff:], p)
+		} else {
+			copy(newData[i], p[blockOff-off:])
+		}
+		shards[i] = splitData[i]
+	}
+	copy(shards[c.K:], splitData[c.K:])
+	var deltas [][]byte
+	if pw != nil {
+		deltas = make([][]byte, c.M)
+		for i := range deltas {
+			deltas[i] = append([]byte(nil), splitData[c.K+i]...)
+		}
+	}
+	//the parity is updated in place by the delta
+	if err := c.enc.Update(shards, newData); err != nil {
+		return err
+	}
+	var sums []uint32
+	if stripeNo < len(newFi.BlockSums) {
+		sums = append([]uint32(nil), newFi.BlockSums[stripeNo]...)
+		newFi.BlockSums[stripeNo] = sums
+	}
+	for _, i := range want {
+		block := shards[i]
+		if i < c.K {
+			block = newData[i]
+		} else if pw != nil {
+			//the parity block on disk is kept along with its checksum
+			xorBlock(deltas[i-c.K], block)
+			if err := pw.log(fi.Distribution[stripeNo][i], fi.blockToOffset[stripeNo][i], deltas[i-c.K]); err != nil {
+				return err
+			}
+			continue
+		}
+		if sums != nil {
+			sums[i] = blockSum(block)
+		}
+		if err := e.logBlock(jn, rl, fi, stripeNo, i, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+// This test unit tests appending and truncating files
+package grasure
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestAppendTruncate(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	fileSize := int64(100*KiB + 123)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []int{2, 4, 6} {
+		testEC.K = k
+		for _, m := range []int{1, 2, 3} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			for _, bs := range []int64{4 * KiB, 16 * KiB} {
+				testEC.BlockSize = bs
+				err = testEC.InitSystem(true)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				err = testEC.ReadConfig()
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				err = generateRandomFileBySize(inpath, fileSize)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				_, err = testEC.EncodeFile(inpath)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				//the hash state to append from is kept in the config
+				err = testEC.WriteConfig()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = testEC.ReadConfig()
+				if err != nil {
+					t.Fatal(err)
+				}
+				//the local file is changed alike
+				lf, err := os.OpenFile(inpath, os.O_RDWR|os.O_APPEND, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stripeSize := int64(k) * bs
+				//the file hash follows appends until a truncate drops it
+				hashed := true
+				checkHash := func(op int64) {
+					want := ""
+					if hashed {
+						if _, err = lf.Seek(0, io.SeekStart); err != nil {
+							t.Fatal(err)
+						}
+						if want, err = hashStr(lf); err != nil {
+							t.Fatal(err)
+						}
+					}
+					intFi, _ := testEC.fileMap.Load(fileKey(inpath))
+					if got := intFi.(*fileInfo).Hash; got != want {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d the file hash is %q after op %d, while %q is expected", k, m, bs, N, got, op, want)
+					}
+				}
+				//appends within the last stripe and crossing batches of stripes,
+				//truncates to the middle and the end of a stripe, to zero and beyond the end
+				for _, op := range []int64{1, 100, bs + 3, 7*stripeSize + 5, -3*stripeSize - 1, -stripeSize, -1, -1 << 40, 0, 2 * stripeSize, 0} {
+					stat, err := lf.Stat()
+					if err != nil {
+						t.Fatal(err)
+					}
+					size := stat.Size()
+					if op > 0 {
+						p := make([]byte, op)
+						fillRandom(p)
+						n, err := testEC.Append(inpath, bytes.NewReader(p))
+						if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d append of %d bytes to %d fails for %s", k, m, bs, N, op, size, err.Error())
+						}
+						if n != op {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d append of %d bytes returns %d", k, m, bs, N, op, n)
+						}
+						if _, err = lf.Write(p); err != nil {
+							t.Fatal(err)
+						}
+						checkHash(op)
+						continue
+					}
+					//-stripeSize truncates to the stripe boundary below, and 0 to somewhere around half the size
+					newSize := size + op
+					if op == -stripeSize {
+						newSize = (size - 1) / stripeSize * stripeSize
+					} else if op == 0 {
+						newSize = size/2 + 2*stripeSize
+					}
+					if newSize < 0 {
+						newSize = 0
+					}
+					err = testEC.Truncate(inpath, newSize)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d truncate from %d to %d fails for %s", k, m, bs, N, size, newSize, err.Error())
+					}
+					if err = lf.Truncate(newSize); err != nil {
+						t.Fatal(err)
+					}
+					hashed = hashed && newSize > size
+					checkHash(op)
+				}
+				stat, err := lf.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				lf.Close()
+				//the BLOBs hold exactly the blocks of the remaining stripes
+				blobSize := int64(0)
+				for i := range testEC.diskInfos[:N] {
+					bstat, err := os.Stat(filepath.Join(testEC.diskInfos[i].diskPath, fileKey(inpath), "BLOB"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					blobSize += bstat.Size()
+				}
+				if want := ceilFracInt64(stat.Size(), stripeSize) * int64(k+m) * bs; blobSize != want {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d BLOBs take %d bytes, while %d are expected", k, m, bs, N, blobSize, want)
+				}
+				//parity is kept consistent, so both normal and degraded reads see the changes
+				for _, options := range []Options{{}, {Degrade: true}} {
+					err = testEC.ReadFile(inpath, outpath, &options)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails for %s", k, m, bs, N, err.Error())
+					}
+					if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails for hash check fail", k, m, bs, N)
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+				}
+				for i := range testEC.diskInfos {
+					testEC.diskInfos[i].available = true
+				}
+				//the changes survive a restart
+				err = testEC.WriteConfig()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = testEC.ReadConfig()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = testEC.ReadFile(inpath, outpath, &Options{})
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d read after restart fails for %s", k, m, bs, N, err.Error())
+				}
+				if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d read after restart fails for hash check fail", k, m, bs, N)
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if err = testEC.Truncate(inpath, -1); err != errNegativeOffset {
+		t.Fatalf("truncate to a negative size returns %v", err)
+	}
+	if _, err = testEC.Append("nonexistent", bytes.NewReader([]byte{0})); err != errFileNotFound {
+		t.Fatalf("append to a nonexistent file returns %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// This test unit tests the load-balanced read scheme
+package grasure
+
+import (
+	"math/rand"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+//maxLoad returns the maximum number of blocks read from a disk in stripes [first, first+len(scheme))
+func maxLoad(fi *fileInfo, first int, scheme [][]int) int {
+	load := make(map[int]int)
+	res := 0
+	for s := range scheme {
+		for _, i := range scheme[s] {
+			diskId := fi.Distribution[first+s][i]
+			load[diskId]++
+			res = max(res, load[diskId])
+		}
+	}
+	return res
+}
+
+//bruteForceLoad tries every choice of k surviving blocks per stripe and returns the smallest maximum load
+func bruteForceLoad(e *Erasure, fi *fileInfo, num int) int {
+	choices := make([][][]int, num)
+	for s := 0; s < num; s++ {
+		alive := make([]int, 0)
+		for i := 0; i < e.K+e.M; i++ {
+			if e.isBlockAlive(fi, s, i) {
+				alive = append(alive, i)
+			}
+		}
+		for mask := 0; mask < 1<<len(alive); mask++ {
+			pick := make([]int, 0)
+			for j := range alive {
+				if mask&(1<<j) != 0 {
+					pick = append(pick, alive[j])
+				}
+			}
+			if len(pick) == e.K {
+				choices[s] = append(choices[s], pick)
+			}
+		}
+	}
+	best := num * e.K
+	scheme := make([][]int, num)
+	var dfs func(s int)
+	dfs = func(s int) {
+		if s == num {
+			best = min(best, maxLoad(fi, 0, scheme))
+			return
+		}
+		for _, c := range choices[s] {
+			scheme[s] = c
+			dfs(s + 1)
+		}
+	}
+	dfs(0)
+	return best
+}
+
+func TestBalanceLoad(t *testing.T) {
+	rand.Seed(100000007)
+	for _, k := range []int{2, 3} {
+		for _, m := range []int{1, 2} {
+			for N := k + m; N <= k+m+3; N++ {
+				for fn := 0; fn <= m; fn++ {
+					testEC := &Erasure{K: k, M: m, DiskNum: N, ConStripes: 4}
+					for i := 0; i < N; i++ {
+						testEC.diskInfos = append(testEC.diskInfos, &diskInfo{available: true})
+					}
+					for _, i := range genRandomArr(N, 0)[:fn] {
+						testEC.diskInfos[i].available = false
+					}
+					fi := &fileInfo{}
+					testEC.growLayout(fi, make([]int, N), 4)
+					fi.blockInfos = make([][]*blockInfo, 4)
+					for s := range fi.blockInfos {
+						for i := 0; i < k+m; i++ {
+							fi.blockInfos[s] = append(fi.blockInfos[s], &blockInfo{bstat: blkOK})
+						}
+					}
+					scheme, err := testEC.balanceLoad(fi)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,N:%d,fn:%d,%s\n", k, m, N, fn, err.Error())
+					}
+					for s, chosen := range scheme {
+						if len(chosen) != k {
+							t.Fatalf("k:%d,m:%d,N:%d,fn:%d stripe %d reads %d blocks", k, m, N, fn, s, len(chosen))
+						}
+						for j, i := range chosen {
+							if !testEC.isBlockAlive(fi, s, i) || j > 0 && chosen[j-1] >= i {
+								t.Fatalf("k:%d,m:%d,N:%d,fn:%d stripe %d reads %v", k, m, N, fn, s, chosen)
+							}
+						}
+					}
+					if got, want := maxLoad(fi, 0, scheme), bruteForceLoad(testEC, fi, 4); got != want {
+						t.Fatalf("k:%d,m:%d,N:%d,fn:%d maximum load is %d, but %d is possible", k, m, N, fn, got, want)
+					}
+				}
+			}
+		}
+	}
+}
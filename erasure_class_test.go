@@ -0,0 +1,218 @@
+// This test unit tests encoding files of different storage classes in one system
+package grasure
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestStorageClass(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	inpath := filepath.Join("input", "class")
+	outpath := filepath.Join("output", "class")
+	defer os.Remove(inpath)
+	defer os.Remove(outpath)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revive := func() {
+		for i := range testEC.diskInfos {
+			testEC.diskInfos[i].available = true
+		}
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			testEC.Class = ""
+			testEC.Classes = nil
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			//the classes must fit the disks
+			if err = testEC.DefineClass("wide", N, 1, bs); err != errTooFewDisksAlive {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d a class wider than the disks is defined, %v", k, m, bs, N, err)
+			}
+			if err = testEC.DefineClass("empty", 2, 1, 0); err != errInvalidBlockSize {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d a class of empty blocks is defined, %v", k, m, bs, N, err)
+			}
+			classes := map[string]*StorageClass{
+				"hot":     {K: 2, M: 1, BlockSize: 1 * KiB},
+				"archive": {K: N - 2, M: 2, BlockSize: 16 * KiB},
+			}
+			for name, sc := range classes {
+				if err = testEC.DefineClass(name, sc.K, sc.M, sc.BlockSize); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d define class %s fails for %s", k, m, bs, N, name, err.Error())
+				}
+			}
+			if _, err = testEC.EncodeFileWithClass(inpath, "cold"); err != errClassNotFound {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d an undefined class is used, %v", k, m, bs, N, err)
+			}
+			//a file of every class, and one of the system parameters
+			contents := map[string][]byte{}
+			for _, name := range []string{"", "hot", "archive"} {
+				content := make([]byte, 5*int64(k)*bs+rand.Int63n(int64(k)*bs))
+				fillRandom(content)
+				contents["class_"+name] = content
+				if err = os.WriteFile(inpath, content, 0666); err != nil {
+					t.Fatal(err)
+				}
+				if name == "archive" {
+					//the default class is used by EncodeReader as well
+					testEC.Class = name
+					_, err = testEC.EncodeReader("class_"+name, bytes.NewReader(content))
+					testEC.Class = ""
+				} else {
+					var fi *fileInfo
+					fi, err = testEC.EncodeFileWithClass(inpath, name)
+					if err == nil {
+						err = testEC.Rename(fileName(fi.FileName), "class_"+name)
+					}
+				}
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode of class %q fails for %s", k, m, bs, N, name, err.Error())
+				}
+			}
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			//the classes and the parameters of every file survive the config
+			for name, sc := range classes {
+				if got := testEC.Classes[name]; got == nil || *got != *sc {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d class %s is %v after reading the config", k, m, bs, N, name, got)
+				}
+			}
+			checkParams := func(stage string) {
+				for name := range contents {
+					intFi, ok := testEC.fileMap.Load(fileKey(name))
+					if !ok {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s file %s is lost", k, m, bs, N, stage, name)
+					}
+					fi := intFi.(*fileInfo)
+					want := StorageClass{K: k, M: m, BlockSize: bs}
+					if sc, ok := classes[name[len("class_"):]]; ok {
+						want = *sc
+					}
+					if got := (StorageClass{K: fi.K, M: fi.M, BlockSize: fi.BlockSize}); got != want {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s file %s has parameters %v, want %v", k, m, bs, N, stage, name, got, want)
+					}
+					total := int64(0)
+					for i := range testEC.diskInfos[:testEC.DiskNum] {
+						info, err := os.Stat(filepath.Join(testEC.diskInfos[i].diskPath, fi.FileName, "BLOB"))
+						if err != nil {
+							t.Fatal(err)
+						}
+						total += info.Size()
+					}
+					if want := testEC.codecOf(fi).stripedFileSize(fi.FileSize); total != want {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s the BLOBs of %s take %d bytes, want %d", k, m, bs, N, stage, name, total, want)
+					}
+				}
+			}
+			checkRead := func(stage string) {
+				for name, content := range contents {
+					for _, options := range []Options{{}, {Degrade: true}} {
+						err = testEC.ReadFile(name, outpath, &options)
+						if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of %s fails for %s", k, m, bs, N, stage, name, err.Error())
+						}
+						if data, _ := os.ReadFile(outpath); !bytes.Equal(data, content) {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of %s fails for hash check fail", k, m, bs, N, stage, name)
+						}
+					}
+				}
+			}
+			checkParams("encoded")
+			checkRead("encoded")
+			//the encoders are shared by the files of the same (k, m)
+			enc1, _ := testEC.encoderOf(2, 1)
+			enc2, _ := testEC.encoderOf(2, 1)
+			if enc1 != enc2 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the encoder of 2+1 is not cached", k, m, bs, N)
+			}
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: 1})
+			checkRead("degraded")
+			revive()
+			//the files are changed with their own parameters
+			p := []byte("changed across blocks")
+			off := int64(len(contents["class_archive"])) / 3
+			if _, err = testEC.WriteAt("class_archive", p, off); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d write fails for %s", k, m, bs, N, err.Error())
+			}
+			copy(contents["class_archive"][off:], p)
+			if _, err = testEC.Append("class_hot", bytes.NewReader(p)); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d append fails for %s", k, m, bs, N, err.Error())
+			}
+			contents["class_hot"] = append(contents["class_hot"], p...)
+			content := append([]byte(nil), contents["class_"]...)
+			copy(content[bs/2:], p)
+			content = append(content, p...)
+			if err = os.WriteFile(inpath, content, 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err = testEC.Update("class_", inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d update fails for %s", k, m, bs, N, err.Error())
+			}
+			contents["class_"] = content
+			checkParams("changed")
+			checkRead("changed")
+			//the blocks of a failed disk are restored with the parameters of every file
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: 1})
+			rm, err := testEC.Recover(&Options{})
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d recover fails for %s", k, m, bs, N, err.Error())
+			}
+			for old, new := range rm {
+				for name := range contents {
+					oldPath := filepath.Join(old, fileKey(name), "BLOB")
+					newPath := filepath.Join(new, fileKey(name), "BLOB")
+					if ok, err := checkFileIfSame(newPath, oldPath); err != nil || !ok {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d the BLOB of %s recovered differs, %v", k, m, bs, N, name, err)
+					}
+				}
+			}
+			checkParams("recovered")
+			checkRead("recovered")
+			if err := os.Rename(testDiskFilePath+".old", testDiskFilePath); err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadDiskPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// This test unit tests the cancellation of operations
+package grasure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//cancelReader cancels the context once `n` bytes are read
+type cancelReader struct {
+	r      io.Reader
+	n      int64
+	cancel context.CancelFunc
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n -= int64(n)
+	if cr.n <= 0 {
+		cr.cancel()
+	}
+	return n, err
+}
+
+//-------------------------TEST UNIT----------------------------
+
+func TestCancel(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        false,
+		Quiet:           true,
+		K:               4,
+		M:               2,
+		DiskNum:         6,
+		BlockSize:       4 * KiB,
+	}
+	fileSize := int64(1 * MiB)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	err = generateRandomFileBySize(inpath, fileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.InitSystem(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//cancelled halfway, the encode leaves nothing behind
+	f, err := os.Open(inpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = testEC.EncodeReaderWithContext(ctx, inpath, &cancelReader{f, fileSize / 3, cancel})
+	f.Close()
+	if err != context.Canceled {
+		t.Fatalf("cancelled encode returns %v", err)
+	}
+	if _, ok := testEC.fileMap.Load(fileKey(inpath)); ok {
+		t.Fatal("cancelled encode is recorded in fileMap")
+	}
+	for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+		if ok, _ := pathExist(filepath.Join(disk.diskPath, fileKey(inpath))); ok {
+			t.Fatalf("cancelled encode leaves blobs in %s", disk.diskPath)
+		}
+	}
+	//so encoding again without override succeeds
+	_, err = testEC.EncodeFile(inpath)
+	if err != nil {
+		t.Fatalf("encode after cancellation fails for %s", err.Error())
+	}
+	//a cancelled context stops other operations before anything is changed
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err = testEC.EncodeFileWithContext(ctx, inpath); err != context.Canceled {
+		t.Fatalf("cancelled encode returns %v", err)
+	}
+	if err = testEC.ReadFileWithContext(ctx, inpath, outpath, &Options{}); err != context.Canceled {
+		t.Fatalf("cancelled read returns %v", err)
+	}
+	if ok, _ := pathExist(outpath); ok {
+		t.Fatal("cancelled read leaves the output")
+	}
+	if err = testEC.UpdateWithContext(ctx, inpath, inpath); err != context.Canceled {
+		t.Fatalf("cancelled update returns %v", err)
+	}
+	testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: 1})
+	if _, err = testEC.RecoverWithContext(ctx, &Options{}); err != context.Canceled {
+		t.Fatalf("cancelled recover returns %v", err)
+	}
+	if err = testEC.RemoveFileWithContext(ctx, inpath); err != context.Canceled {
+		t.Fatalf("cancelled remove returns %v", err)
+	}
+	//the file is intact
+	err = testEC.ReadFile(inpath, outpath, &Options{})
+	if err != nil {
+		t.Fatalf("read after cancellation fails for %s", err.Error())
+	}
+	if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+		t.Fatal("read after cancellation fails for hash check fail")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,155 @@
+// This test unit tests encoding and reading whole directory trees
+package grasure
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestEncodeDir(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	src := filepath.Join("input", "tree")
+	dst := filepath.Join("output", "tree")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	//the files of the tree, of various sizes and permissions
+	files := map[string]struct {
+		size int64
+		perm os.FileMode
+	}{
+		"a":          {300*KiB + 123, 0640},
+		"sub/b":      {17 * KiB, 0755},
+		"sub/deep/c": {1, 0600},
+		"sub/d":      {0, 0644},
+	}
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			testEC.Override = true
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			os.RemoveAll(src)
+			os.RemoveAll(dst)
+			if err = os.MkdirAll(filepath.Join(src, "empty"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for rel, f := range files {
+				path := filepath.Join(src, filepath.FromSlash(rel))
+				if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err = generateRandomFileBySize(path, f.size); err != nil {
+					t.Fatal(err)
+				}
+				if err = os.Chmod(path, f.perm); err != nil {
+					t.Fatal(err)
+				}
+			}
+			//the files are named by their paths relative to the tree, under the directory given
+			sum, err := testEC.EncodeDir(src, "backup/tree")
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode of the tree fails for %s", k, m, bs, N, err.Error())
+			}
+			if len(sum.Failed) != 0 || strings.Join(sum.Succeeded, " ") != "backup/tree/a backup/tree/sub/b backup/tree/sub/d backup/tree/sub/deep/c" {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the tree encoded %v, failed %v", k, m, bs, N, sum.Succeeded, sum.Failed)
+			}
+			if sum.Bytes != 300*KiB+123+17*KiB+1 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d bytes of the tree encoded", k, m, bs, N, sum.Bytes)
+			}
+			if stat, err := testEC.Stat("backup/tree/empty"); err != nil || !stat.IsDir() {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the empty directory is not made, %v", k, m, bs, N, err)
+			}
+			//the tree is read back with its permissions, even after a restart
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum, err = testEC.ReadDirTo("backup/tree", dst, &Options{})
+			if err != nil || len(sum.Failed) != 0 || len(sum.Succeeded) != len(files) {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of the tree fails for %v, failed %v", k, m, bs, N, err, sum)
+			}
+			for rel, f := range files {
+				inpath := filepath.Join(src, filepath.FromSlash(rel))
+				outpath := filepath.Join(dst, filepath.FromSlash(rel))
+				if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of %s fails for hash check fail", k, m, bs, N, rel)
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if info, err := os.Stat(outpath); err != nil || info.Mode().Perm() != f.perm {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s is read with permission %v, want %v", k, m, bs, N, rel, info.Mode().Perm(), f.perm)
+				}
+			}
+			if info, err := os.Stat(filepath.Join(dst, "empty")); err != nil || !info.IsDir() {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the empty directory is not read, %v", k, m, bs, N, err)
+			}
+			//a file encoded again keeps its permission
+			f, err := os.Open(filepath.Join(src, "a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = testEC.EncodeReader("backup/tree/a", f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat, _ := testEC.Stat("backup/tree/a"); stat.Mode() != files["a"].perm {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the file encoded again has permission %v", k, m, bs, N, stat.Mode())
+			}
+			if _, err = testEC.ReadDirTo("backup/tree/a", dst, &Options{}); err != errNotDir {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of a file as tree returns %v", k, m, bs, N, err)
+			}
+			//the files failed are reported without stopping the others
+			testEC.Override = false
+			if err = generateRandomFileBySize(filepath.Join(src, "empty", "e"), bs); err != nil {
+				t.Fatal(err)
+			}
+			sum, err = testEC.EncodeDir(src, "backup/tree")
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode of the tree fails for %s", k, m, bs, N, err.Error())
+			}
+			if len(sum.Failed) != len(files) || strings.Join(sum.Succeeded, " ") != "backup/tree/empty/e" {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the tree encoded %v, failed %v without override", k, m, bs, N, sum.Succeeded, sum.Failed)
+			}
+			//without a directory given, the tree is put at the root of the system
+			testEC.Override = true
+			sum, err = testEC.EncodeDir(src, "")
+			if err != nil || len(sum.Failed) != 0 || strings.Join(sum.Succeeded, " ") != "a empty/e sub/b sub/d sub/deep/c" {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the tree encoded %v at the root, failed %v, %v", k, m, bs, N, sum.Succeeded, sum.Failed, err)
+			}
+		}
+	}
+}
@@ -2,7 +2,9 @@
 package grasure
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"os"
@@ -437,6 +439,304 @@ func TestEncodeDecodeBitRot(t *testing.T) {
 
 }
 
+// Test read when real bytes of blocks are corrupted on disk
+func TestEncodeDecodeRealBitRot(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	tempFileSizes := generateRandomFileSize(1*KiB, 1*MiB, 10)
+	defer deleteTempFiles(tempFileSizes)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalDisk := len(testEC.diskInfos)
+	for _, k := range dataShards {
+		testEC.K = k
+		for _, m := range parityShards {
+			testEC.M = m
+			N := k + m + 1
+			if N > totalDisk {
+				continue
+			}
+			testEC.DiskNum = N
+			for _, bs := range blockSizesV1 {
+				testEC.BlockSize = bs
+				err = testEC.InitSystem(true)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				log.Printf("----k:%d,m:%d,bs:%d,N:%d----\n", k, m, bs, N)
+				for _, fileSize := range tempFileSizes {
+					inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+					outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+					err = generateRandomFileBySize(inpath, fileSize)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					err = testEC.ReadConfig()
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					_, err := testEC.EncodeFile(inpath)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+					}
+					//the checksums must survive the config round trip
+					err = testEC.WriteConfig()
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					err = testEC.ReadConfig()
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					intFi, _ := testEC.fileMap.Load(fileKey(inpath))
+					fi := intFi.(*fileInfo)
+					if len(fi.BlockSums) != len(fi.Distribution) {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d rows of checksums for %d stripes", k, m, bs, N, len(fi.BlockSums), len(fi.Distribution))
+					}
+					//flip a byte in up to m random blocks of every stripe
+					corrupted := 0
+					for stripeNo := range fi.Distribution {
+						for _, i := range genRandomArr(k+m, 0)[:rand.Intn(m+1)] {
+							diskId := fi.Distribution[stripeNo][i]
+							blobPath := filepath.Join(testEC.diskInfos[diskId].diskPath, fi.FileName, "BLOB")
+							f, err := os.OpenFile(blobPath, os.O_RDWR, 0666)
+							if err != nil {
+								t.Fatal(err)
+							}
+							pos := int64(fi.blockToOffset[stripeNo][i])*bs + rand.Int63n(testEC.blockSizeOf(fi, stripeNo))
+							b := make([]byte, 1)
+							f.ReadAt(b, pos)
+							b[0] ^= 0xff
+							f.WriteAt(b, pos)
+							f.Close()
+							corrupted++
+						}
+					}
+					for _, skipParity := range []bool{false, true} {
+						err = testEC.ReadFile(inpath, outpath, &Options{SkipParity: skipParity})
+						if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+						}
+						if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails when fileSize is %d, for hash check fail", k, m, bs, N, fileSize)
+						} else if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+						}
+					}
+					failed := 0
+					for stripeNo := range fi.blockInfos {
+						for i := range fi.blockInfos[stripeNo] {
+							if fi.blockInfos[stripeNo][i].bstat == blkFail {
+								failed++
+							}
+						}
+					}
+					if failed != corrupted {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d blocks corrupted but %d marked failed", k, m, bs, N, corrupted, failed)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Test the file hash is checked after reading
+func TestReadFileHashCheck(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+		K:               4,
+		M:               2,
+		DiskNum:         7,
+		BlockSize:       4 * KiB,
+	}
+	rand.Seed(100000007)
+	tempFileSizes := generateRandomFileSize(1*KiB, 1*MiB, 5)
+	defer deleteTempFiles(tempFileSizes)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.InitSystem(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileSize := range tempFileSizes {
+		inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+		outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+		err = generateRandomFileBySize(inpath, fileSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := testEC.EncodeFile(inpath)
+		if err != nil {
+			t.Fatalf("encode fails when fileSize is %d, for %s", fileSize, err.Error())
+		}
+		err = testEC.ReadFile(inpath, outpath, &Options{})
+		if err != nil {
+			t.Fatalf("read fails when fileSize is %d, for %s", fileSize, err.Error())
+		}
+		//a wrong hash must be reported by every reader covering the whole file
+		hash := fi.Hash
+		fi.Hash = fmt.Sprintf("%064x", 0)
+		if err := testEC.ReadFile(inpath, outpath, &Options{}); err != errFileIncompleted {
+			t.Fatalf("ReadFile returns %v for a wrong hash when fileSize is %d", err, fileSize)
+		}
+		if err := testEC.ReadFile(inpath, outpath, &Options{SkipParity: true}); err != errFileIncompleted {
+			t.Fatalf("ReadFile skipping parity returns %v for a wrong hash when fileSize is %d", err, fileSize)
+		}
+		if err := testEC.ReadFile(inpath, outpath, &Options{SkipHashCheck: true}); err != nil {
+			t.Fatalf("ReadFile skipping hash check returns %v when fileSize is %d", err, fileSize)
+		}
+		if err := testEC.ReadRange(inpath, 0, fileSize, io.Discard); err != errFileIncompleted {
+			t.Fatalf("ReadRange returns %v for a wrong hash when fileSize is %d", err, fileSize)
+		}
+		if err := testEC.ReadRange(inpath, 1, fileSize-1, io.Discard); err != nil {
+			t.Fatalf("partial ReadRange returns %v when fileSize is %d", err, fileSize)
+		}
+		f, err := testEC.Open(inpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, f); err != errFileIncompleted {
+			t.Fatalf("sequential Read returns %v for a wrong hash when fileSize is %d", err, fileSize)
+		}
+		f.Close()
+		fi.Hash = hash
+		//without block checksums, silent corruption is caught by the hash only
+		fi.BlockSums = nil
+		blobPath := filepath.Join(testEC.diskInfos[fi.Distribution[0][0]].diskPath, fi.FileName, "BLOB")
+		bf, err := os.OpenFile(blobPath, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos := int64(fi.blockToOffset[0][0]) * testEC.BlockSize
+		bf.WriteAt([]byte{^byte(0)}, pos)
+		bf.WriteAt([]byte{0}, pos+1)
+		bf.Close()
+		if err := testEC.ReadFile(inpath, outpath, &Options{}); err != errFileIncompleted {
+			t.Fatalf("ReadFile returns %v for a corrupted block when fileSize is %d", err, fileSize)
+		}
+	}
+}
+
+// Test corrupted blocks are written back in repair mode
+func TestReadRepair(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	tempFileSizes := generateRandomFileSize(1*KiB, 1*MiB, 5)
+	defer deleteTempFiles(tempFileSizes)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalDisk := len(testEC.diskInfos)
+	for _, k := range dataShards {
+		testEC.K = k
+		for _, m := range parityShards {
+			testEC.M = m
+			N := k + m + 1
+			if N > totalDisk {
+				continue
+			}
+			testEC.DiskNum = N
+			bs := blockSizesV1[0]
+			testEC.BlockSize = bs
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			for _, fileSize := range tempFileSizes {
+				for _, options := range []Options{{Repair: true}, {Repair: true, Degrade: true}, {Repair: true, SkipParity: true}} {
+					inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+					outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+					err = generateRandomFileBySize(inpath, fileSize)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					fi, err := testEC.EncodeFile(inpath)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+					}
+					//overwrite up to m random blocks of every stripe
+					for stripeNo := range fi.Distribution {
+						for _, i := range genRandomArr(k+m, 0)[:rand.Intn(m+1)] {
+							diskId := fi.Distribution[stripeNo][i]
+							blobPath := filepath.Join(testEC.diskInfos[diskId].diskPath, fi.FileName, "BLOB")
+							f, err := os.OpenFile(blobPath, os.O_RDWR, 0666)
+							if err != nil {
+								t.Fatal(err)
+							}
+							junk := make([]byte, testEC.blockSizeOf(fi, stripeNo))
+							fillRandom(junk)
+							f.WriteAt(junk, int64(fi.blockToOffset[stripeNo][i])*bs)
+							f.Close()
+						}
+					}
+					err = testEC.ReadFile(inpath, outpath, &options)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%+v read fails when fileSize is %d, for %s", k, m, bs, N, options, fileSize, err.Error())
+					}
+					if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%+v read fails when fileSize is %d, for hash check fail", k, m, bs, N, options, fileSize)
+					} else if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%+v read fails when fileSize is %d, for %s", k, m, bs, N, options, fileSize, err.Error())
+					}
+					//every corrupted block found must have been rewritten
+					ifs, _ := testEC.openBlobs(fi.FileName, os.O_RDONLY)
+					block := make([]byte, bs)
+					for stripeNo := range fi.Distribution {
+						for i := range fi.Distribution[stripeNo] {
+							if fi.blockInfos[stripeNo][i].bstat != blkOK {
+								t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%+v block %d of stripe %d is left failed", k, m, bs, N, options, i, stripeNo)
+							}
+							if options.SkipParity && i >= k {
+								//parity of healthy stripes is never read
+								continue
+							}
+							if err := testEC.readBlock(fi, ifs, stripeNo, i, block[:testEC.blockSizeOf(fi, stripeNo)]); err != nil {
+								t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%+v block %d of stripe %d is not repaired, for %s", k, m, bs, N, options, i, stripeNo, err.Error())
+							}
+						}
+					}
+					closeBlobs(ifs)
+				}
+			}
+		}
+	}
+}
+
 // Test degraded read when one disk fails
 func TestEncodeDecodeOneFailureDegraded(t *testing.T) {
 	//we generate temp data and encode it into real storage sytem
@@ -605,6 +905,183 @@ func TestEncodeDecodeTwoFailureDegraded(t *testing.T) {
 
 }
 
+// Test read skipping parity with up to m failed disks
+func TestEncodeDecodeSkipParity(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	tempFileSizes := generateRandomFileSize(1*KiB, 1*MiB, 10)
+	defer deleteTempFiles(tempFileSizes)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalDisk := len(testEC.diskInfos)
+	for _, k := range dataShards {
+		testEC.K = k
+		for _, m := range parityShards {
+			testEC.M = m
+			N := k + m + 1
+			if N > totalDisk {
+				continue
+			}
+			testEC.DiskNum = N
+			for _, bs := range blockSizesV1 {
+				testEC.BlockSize = bs
+				err = testEC.InitSystem(true)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				log.Printf("----k:%d,m:%d,bs:%d,N:%d----\n", k, m, bs, N)
+				err = testEC.ReadConfig()
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				for _, fileSize := range tempFileSizes {
+					inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+					outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+					err = generateRandomFileBySize(inpath, fileSize)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					_, err := testEC.EncodeFile(inpath)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+					}
+					for fn := 0; fn <= m; fn++ {
+						for i := range testEC.diskInfos {
+							testEC.diskInfos[i].available = i >= fn
+						}
+						err = testEC.ReadFile(inpath, outpath, &Options{SkipParity: true})
+						if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d read fails when fileSize is %d, for %s", k, m, bs, N, fn, fileSize, err.Error())
+						}
+						if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d read fails when fileSize is %d, for hash check fail", k, m, bs, N, fn, fileSize)
+						} else if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d read fails when fileSize is %d, for %s", k, m, bs, N, fn, fileSize, err.Error())
+						}
+					}
+					for i := range testEC.diskInfos {
+						testEC.diskInfos[i].available = true
+					}
+				}
+			}
+		}
+	}
+}
+
+// Test range read with up to m failed disks
+func TestReadRange(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	tempFileSizes := generateRandomFileSize(1*KiB, 1*MiB, 10)
+	defer deleteTempFiles(tempFileSizes)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalDisk := len(testEC.diskInfos)
+	for _, k := range dataShards {
+		testEC.K = k
+		for _, m := range parityShards {
+			testEC.M = m
+			N := k + m + 1
+			if N > totalDisk {
+				continue
+			}
+			testEC.DiskNum = N
+			for _, bs := range blockSizesV1 {
+				testEC.BlockSize = bs
+				err = testEC.InitSystem(true)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				log.Printf("----k:%d,m:%d,bs:%d,N:%d----\n", k, m, bs, N)
+				err = testEC.ReadConfig()
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				for _, fileSize := range tempFileSizes {
+					inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+					err = generateRandomFileBySize(inpath, fileSize)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					fi, err := testEC.EncodeFile(inpath)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+					}
+					want, err := os.ReadFile(inpath)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for fn := 0; fn <= m; fn++ {
+						for i := range testEC.diskInfos {
+							testEC.diskInfos[i].available = i >= fn
+						}
+						for r := 0; r < 10; r++ {
+							off := rand.Int63n(fileSize)
+							length := rand.Int63n(fileSize-off) + 1
+							buf := new(bytes.Buffer)
+							err = testEC.ReadRange(inpath, off, length, buf)
+							if err != nil {
+								t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d ReadRange(%d, %d) fails for %s", k, m, bs, N, fn, off, length, err.Error())
+							}
+							if !bytes.Equal(buf.Bytes(), want[off:off+length]) {
+								t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d ReadRange(%d, %d) returns wrong data", k, m, bs, N, fn, off, length)
+							}
+						}
+					}
+					for i := range testEC.diskInfos {
+						testEC.diskInfos[i].available = true
+					}
+					//a range inside one healthy block needs no other block of the stripe
+					off := rand.Int63n(fileSize)
+					stripeNo := int(off / testEC.dataStripeSize)
+					blockSize := testEC.blockSizeOf(fi, stripeNo)
+					blockNo := int(off % testEC.dataStripeSize / blockSize)
+					length := blockSize - off%testEC.dataStripeSize%blockSize
+					if off+length > fileSize {
+						length = fileSize - off
+					}
+					for i := range fi.blockInfos[stripeNo] {
+						if i != blockNo {
+							fi.blockInfos[stripeNo][i].bstat = blkFail
+						}
+					}
+					buf := new(bytes.Buffer)
+					err = testEC.ReadRange(inpath, off, length, buf)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d ReadRange(%d, %d) within a block fails for %s", k, m, bs, N, off, length, err.Error())
+					}
+					if !bytes.Equal(buf.Bytes(), want[off:off+length]) {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d ReadRange(%d, %d) within a block returns wrong data", k, m, bs, N, off, length)
+					}
+					if err := testEC.ReadRange(inpath, fileSize-1, 2, buf); err != errRangeOutOfFile {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d ReadRange past the end returns %v", k, m, bs, N, err)
+					}
+				}
+			}
+		}
+	}
+}
+
 // Test remove func
 func TestRemove(t *testing.T) {
 	genTempDir()
@@ -815,6 +1292,75 @@ func benchmarkEncodeDecodeWithFault(b *testing.B, dataShards, parityShards, disk
 	}
 }
 
+//benchmarkRead encodes the file once and measures ReadFile only
+func benchmarkRead(b *testing.B, dataShards, parityShards, diskNum int, blockSize, fileSize int64, skipParity bool) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      100,
+		Override:        true,
+		Quiet:           true,
+		K:               dataShards,
+		M:               parityShards,
+		DiskNum:         diskNum,
+		BlockSize:       blockSize,
+	}
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	err = generateRandomFileBySize(inpath, fileSize)
+	if err != nil {
+		b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+	}
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = testEC.InitSystem(true)
+	if err != nil {
+		b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+	}
+	_, err := testEC.EncodeFile(inpath)
+	if err != nil {
+		b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+	}
+	b.SetBytes(fileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = testEC.ReadFile(inpath, outpath, &Options{SkipParity: skipParity})
+		if err != nil {
+			b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+		}
+	}
+}
+
+func BenchmarkRead4x2x6x4096x10M(b *testing.B) {
+	benchmarkRead(b, 4, 2, 6, 4096, 10*MiB, false)
+}
+func BenchmarkRead4x2x6x4096x10MxSkipParity(b *testing.B) {
+	benchmarkRead(b, 4, 2, 6, 4096, 10*MiB, true)
+}
+
+func BenchmarkRead12x4x16x4096x10M(b *testing.B) {
+	benchmarkRead(b, 12, 4, 16, 4096, 10*MiB, false)
+}
+func BenchmarkRead12x4x16x4096x10MxSkipParity(b *testing.B) {
+	benchmarkRead(b, 12, 4, 16, 4096, 10*MiB, true)
+}
+
+func BenchmarkRead8x8x16x16384x10M(b *testing.B) {
+	benchmarkRead(b, 8, 8, 16, 16384, 10*MiB, false)
+}
+func BenchmarkRead8x8x16x16384x10MxSkipParity(b *testing.B) {
+	benchmarkRead(b, 8, 8, 16, 16384, 10*MiB, true)
+}
+
 func BenchmarkEncodeDecode2x1x3x512x1M(b *testing.B) {
 	benchmarkEncodeDecode(b, 2, 1, 3, 512, 1*MiB)
 }
@@ -0,0 +1,102 @@
+// This test unit tests hedged reads on slow disks
+package grasure
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestHedgedRead(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      10,
+		Override:        true,
+		Quiet:           true,
+		K:               4,
+		M:               2,
+		DiskNum:         6,
+		BlockSize:       4 * KiB,
+	}
+	fileSize := int64(30 * 4 * 4 * KiB)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	err = generateRandomFileBySize(inpath, fileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.InitSystem(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testEC.EncodeFile(inpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every stripe touches all 6 disks, so every batch of 10 stripes waits for the slow one
+	slowDown := 300 * time.Millisecond
+	testEC.Destroy(&SimOptions{Mode: "slowDisk", FailNum: 1, SlowDown: slowDown})
+	batches := 3
+	for _, options := range []Options{{}, {Degrade: true}, {SkipParity: true}} {
+		testEC.HedgeDelay = 20 * time.Millisecond
+		start := time.Now()
+		err = testEC.ReadFile(inpath, outpath, &options)
+		if err != nil {
+			t.Fatalf("%+v hedged read fails for %s", options, err.Error())
+		}
+		elapsed := time.Since(start)
+		if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+			t.Fatalf("%+v hedged read fails for hash check fail", options)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed >= slowDown*time.Duration(batches) {
+			t.Fatalf("%+v hedged read takes %v, the slow disk is waited for", options, elapsed)
+		}
+	}
+	//the slow disk is told apart by its latency, once the late reads finish
+	time.Sleep(2 * slowDown)
+	slow := -1
+	for i, stat := range testEC.DiskStats() {
+		if stat.Latency >= slowDown {
+			slow = i
+		}
+	}
+	if slow < 0 || testEC.diskInfos[slow].slowDown == 0 {
+		t.Fatalf("the slow disk is not found in %+v", testEC.DiskStats())
+	}
+	//once judged slow, the disk is avoided even without hedging
+	testEC.HedgeDelay = 0
+	testEC.SlowDiskLatency = slowDown / 2
+	if !testEC.DiskStats()[slow].Slow {
+		t.Fatalf("disk %d is not judged slow", slow)
+	}
+	start := time.Now()
+	err = testEC.ReadFile(inpath, outpath, &Options{})
+	if err != nil {
+		t.Fatalf("read avoiding the slow disk fails for %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed >= slowDown {
+		t.Fatalf("read avoiding the slow disk takes %v", elapsed)
+	}
+	if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+		t.Fatal("read avoiding the slow disk fails for hash check fail")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
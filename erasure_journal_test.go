@@ -0,0 +1,195 @@
+// This test unit tests the journaling of update
+package grasure
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestUpdateJournal(t *testing.T) {
+	genTempDir()
+	newEC := func() *Erasure {
+		e := &Erasure{
+			ConfigFile:      "conf.json",
+			DiskFilePath:    testDiskFilePath,
+			ReplicateFactor: 3,
+			ConStripes:      3,
+			Override:        true,
+			Quiet:           true,
+			K:               4,
+			M:               2,
+			DiskNum:         6,
+			BlockSize:       4 * KiB,
+		}
+		if err := e.ReadDiskPath(); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	testEC := newEC()
+	fileSize := int64(500 * KiB)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	oldpath := inpath + ".old"
+	err = generateRandomFileBySize(inpath, fileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = copyFile(inpath, oldpath); err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.InitSystem(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testEC.EncodeFile(inpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.WriteConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//keep the old blobs and config, as if the system crashed right after the update is committed
+	saved := make([]string, testEC.DiskNum)
+	defer func() {
+		for _, path := range append(saved, oldpath, "output/conf.json") {
+			os.Remove(path)
+		}
+	}()
+	for i, disk := range testEC.diskInfos[:testEC.DiskNum] {
+		saved[i] = filepath.Join("output", fmt.Sprintf("BLOB-%d", i))
+		if _, err = copyFile(filepath.Join(disk.diskPath, fileKey(inpath), "BLOB"), saved[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = copyFile("conf.json", "output/conf.json"); err != nil {
+		t.Fatal(err)
+	}
+	checkRead := func(e *Erasure, expected string) {
+		err = e.ReadFile(inpath, outpath, &Options{})
+		if err != nil {
+			t.Fatalf("read fails for %s", err.Error())
+		}
+		if ok, err := checkFileIfSame(expected, outpath); !ok && err == nil {
+			t.Fatalf("read fails for mismatching %s", expected)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, mode := range updateMode {
+		changeRandom(inpath, int(fileSize), int(fileSize/20), mode)
+		err = testEC.Update(inpath, inpath)
+		if err != nil {
+			t.Fatalf("mode:%d update fails for %s", mode, err.Error())
+		}
+		for i, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			if _, err = copyFile(saved[i], filepath.Join(disk.diskPath, fileKey(inpath), "BLOB")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = copyFile("output/conf.json", "conf.json"); err != nil {
+			t.Fatal(err)
+		}
+		for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			root := filepath.Join(disk.diskPath, journalDir)
+			if err = os.Rename(filepath.Join(root, fileKey(inpath)+".applied"), filepath.Join(root, fileKey(inpath)+".commit")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//the committed update is replayed at warm-up
+		replayEC := newEC()
+		err = replayEC.ReadConfig()
+		if err != nil {
+			t.Fatalf("mode:%d replay fails for %s", mode, err.Error())
+		}
+		checkRead(replayEC, inpath)
+		//and the journal is dropped once the config is written
+		err = replayEC.WriteConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(replayEC.journaled) != 0 {
+			t.Fatalf("mode:%d journals are kept after the config is written", mode)
+		}
+		//the next round starts over from the old version
+		replayEC.dropJournal(fileKey(inpath))
+		for i, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			if _, err = copyFile(saved[i], filepath.Join(disk.diskPath, fileKey(inpath), "BLOB")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = copyFile("output/conf.json", "conf.json"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = copyFile(oldpath, inpath); err != nil {
+			t.Fatal(err)
+		}
+		testEC = newEC()
+		err = testEC.ReadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRead(testEC, oldpath)
+	}
+	//an update interrupted before its commit is discarded
+	jn, err := testEC.newJournal(fileKey(inpath), testEC.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testEC.DiskNum; i++ {
+		if err = jn.log(i, 0, make([]byte, testEC.BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	discardEC := newEC()
+	err = discardEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRead(discardEC, oldpath)
+	for _, disk := range discardEC.diskInfos[:discardEC.DiskNum] {
+		if ok, _ := pathExist(filepath.Join(disk.diskPath, journalDir, fileKey(inpath)+".log")); ok {
+			t.Fatalf("the uncommitted journal is left in %s", disk.diskPath)
+		}
+	}
+	//an update interrupted after another one is applied leaves the applied version
+	p := make([]byte, 3*testEC.BlockSize)
+	fillRandom(p)
+	if _, err = discardEC.WriteAt(inpath, p, 1000); err != nil {
+		t.Fatal(err)
+	}
+	lf, err := os.OpenFile(inpath, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lf.WriteAt(p, 1000)
+	lf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jn, err = discardEC.newJournal(fileKey(inpath), discardEC.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < discardEC.DiskNum; i++ {
+		if err = jn.log(i, 0, make([]byte, discardEC.BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appliedEC := newEC()
+	err = appliedEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRead(appliedEC, inpath)
+}
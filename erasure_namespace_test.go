@@ -0,0 +1,226 @@
+// This test unit tests the hierarchical namespace of files
+package grasure
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestNamespace(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	fileSize := int64(300*KiB + 123)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	otherpath := inpath + ".other"
+	defer os.Remove(otherpath)
+	unsafeName := "c/we ird%20~v1/.hidden name"
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			checkRead := func(ec *Erasure, stage, name, path string) {
+				err = ec.ReadFile(name, outpath, &Options{})
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of %s fails for %s", k, m, bs, N, stage, name, err.Error())
+				}
+				if ok, err := checkFileIfSame(path, outpath); !ok && err == nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of %s fails for hash check fail", k, m, bs, N, stage, name)
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+			encode := func(name, path string) {
+				f, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				if _, err = testEC.EncodeReader(name, f); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode of %s fails for %s", k, m, bs, N, name, err.Error())
+				}
+			}
+			names := func(list []os.FileInfo) string {
+				var s []string
+				for _, fi := range list {
+					if fi.IsDir() {
+						s = append(s, fi.Name()+"/")
+					} else {
+						s = append(s, fi.Name())
+					}
+				}
+				return strings.Join(s, " ")
+			}
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			if err = generateRandomFileBySize(inpath, fileSize); err != nil {
+				t.Fatal(err)
+			}
+			if err = generateRandomFileBySize(otherpath, fileSize/3); err != nil {
+				t.Fatal(err)
+			}
+			//files of the same base name in different directories are apart
+			encode("a/report", inpath)
+			encode("/b/./x/../report", otherpath)
+			encode(unsafeName, inpath)
+			checkRead(testEC, "nested", "/a/report", inpath)
+			checkRead(testEC, "nested", "b/report", otherpath)
+			checkRead(testEC, "unsafe", unsafeName, inpath)
+			for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+				if ok, _ := pathExist(filepath.Join(disk.diskPath, fileKey(unsafeName), "BLOB")); !ok {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d the BLOB of %s is not under its key", k, m, bs, N, unsafeName)
+				}
+			}
+			//the directories are listed
+			if err = testEC.Mkdir("d/e"); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d mkdir fails for %s", k, m, bs, N, err.Error())
+			}
+			for dir, want := range map[string]string{
+				"/":              "a/ b/ c/ d/",
+				"a":              "report",
+				"c":              "we ird%20~v1/",
+				"c/we ird%20~v1": ".hidden name",
+				"d":              "e/",
+				"d/e":            "",
+			} {
+				list, err := testEC.ReadDir(dir)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of directory %s fails for %s", k, m, bs, N, dir, err.Error())
+				}
+				if names(list) != want {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d directory %s lists %q, want %q", k, m, bs, N, dir, names(list), want)
+				}
+			}
+			if stat, err := testEC.Stat("b/report"); err != nil || stat.IsDir() || stat.Size() != fileSize/3 || stat.Name() != "report" {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the stat of a file is %v, %v", k, m, bs, N, stat, err)
+			}
+			if stat, err := testEC.Stat("d"); err != nil || !stat.IsDir() {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the stat of a directory is %v, %v", k, m, bs, N, stat, err)
+			}
+			if _, err = testEC.Stat("nope"); err != errFileNotFound {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the stat of a missing path returns %v", k, m, bs, N, err)
+			}
+			//a directory implied only by files is gone with its last file
+			encode("g/h/only", otherpath)
+			if stat, err := testEC.Stat("g/h"); err != nil || !stat.IsDir() {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the stat of an implied directory is %v, %v", k, m, bs, N, stat, err)
+			}
+			if err = testEC.RemoveFile("g/h/only"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = testEC.Stat("g"); err != errFileNotFound {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the directory of a removed file is left, %v", k, m, bs, N, err)
+			}
+			//files and directories never take the place of one another
+			f, err := os.Open(inpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range map[string]error{"a": errIsDir, "a/report/x": errNotDir, "/": errInvalidFileName} {
+				if _, err = testEC.EncodeReader(name, f); err != want {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode of %s returns %v", k, m, bs, N, name, err)
+				}
+			}
+			f.Close()
+			if err = testEC.Mkdir("a/report/x"); err != errNotDir {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d mkdir under a file returns %v", k, m, bs, N, err)
+			}
+			if _, err = testEC.ReadDir("a/report"); err != errNotDir {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of a file as directory returns %v", k, m, bs, N, err)
+			}
+			//only empty directories are removed
+			if err = testEC.RemoveDir("d"); err != errDirNotEmpty {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d removal of a non-empty directory returns %v", k, m, bs, N, err)
+			}
+			if err = testEC.RemoveDir("d/e"); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d removal of a directory fails for %s", k, m, bs, N, err.Error())
+			}
+			//the namespace survives a restart
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if list, _ := testEC.ReadDir("d"); len(list) != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d a removed directory is listed", k, m, bs, N)
+			}
+			if err = testEC.RemoveDir("d"); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d removal of a directory fails for %s", k, m, bs, N, err.Error())
+			}
+			if _, err = testEC.ReadDir("d"); err != errPathNotFound {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of a removed directory returns %v", k, m, bs, N, err)
+			}
+			//a system of base names is migrated at warm-up, even if a base name looks like a key
+			if err = testEC.RemoveFile(unsafeName); err != nil {
+				t.Fatal(err)
+			}
+			for raw, name := range map[string]string{"a b": "a/report", "a%20b": "b/report"} {
+				intFi, _ := testEC.fileMap.Load(fileKey(name))
+				fi := *intFi.(*fileInfo)
+				for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+					if err = os.Rename(filepath.Join(disk.diskPath, fi.FileName), filepath.Join(disk.diskPath, raw)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				testEC.deleteFile(fi.FileName)
+				fi.FileName = raw
+				testEC.storeFile(&fi)
+			}
+			testEC.NameEscaped = false
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			migratedEC := &Erasure{
+				ConfigFile:      "conf.json",
+				DiskFilePath:    testDiskFilePath,
+				ReplicateFactor: 3,
+				ConStripes:      3,
+				Quiet:           true,
+			}
+			if err = migratedEC.ReadDiskPath(); err != nil {
+				t.Fatal(err)
+			}
+			if err = migratedEC.ReadConfig(); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d migration fails for %s", k, m, bs, N, err.Error())
+			}
+			checkRead(migratedEC, "migrated", "a b", inpath)
+			checkRead(migratedEC, "migrated", "a%20b", otherpath)
+			if !migratedEC.NameEscaped {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the migration is not recorded", k, m, bs, N)
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// This test unit tests packing small files into shared containers
+package grasure
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestPack(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	outpath := filepath.Join("output", "packed")
+	defer os.Remove(outpath)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := func(name string) int {
+		cnt := 0
+		for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			if ok, _ := pathExist(filepath.Join(disk.diskPath, name)); ok {
+				cnt++
+			}
+		}
+		return cnt
+	}
+	revive := func() {
+		for i := range testEC.diskInfos {
+			testEC.diskInfos[i].available = true
+		}
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			testEC.PackThreshold = 2 * bs
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			//the content every file is expected to have
+			contents := make(map[string][]byte)
+			encode := func(name string, size int64) {
+				p := make([]byte, size)
+				fillRandom(p)
+				if _, err := testEC.EncodeReader(name, bytes.NewReader(p)); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode of %s fails for %s", k, m, bs, N, name, err.Error())
+				}
+				contents[name] = p
+			}
+			checkRead := func(stage, name string) {
+				for _, options := range []Options{{}, {Degrade: true}} {
+					err = testEC.ReadFile(name, outpath, &options)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of %s fails for %s", k, m, bs, N, stage, name, err.Error())
+					}
+					if data, _ := os.ReadFile(outpath); !bytes.Equal(data, contents[name]) {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of %s fails for hash check fail", k, m, bs, N, stage, name)
+					}
+				}
+				//a range of a packed file maps into its container
+				size := int64(len(contents[name]))
+				var buf bytes.Buffer
+				if err = testEC.ReadRange(name, size/3, size/2, &buf); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s range read of %s fails for %s", k, m, bs, N, stage, name, err.Error())
+				}
+				if !bytes.Equal(buf.Bytes(), contents[name][size/3:size/3+size/2]) {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s range read of %s mismatches", k, m, bs, N, stage, name)
+				}
+			}
+			isPacked := func(name string) bool {
+				intFi, ok := testEC.fileMap.Load(fileKey(name))
+				return ok && intFi.(*fileInfo).Pack != nil
+			}
+			//small files take no directory of their own, large ones are striped as usual
+			for i := 0; i < 24; i++ {
+				encode(fmt.Sprintf("small/%d", i), bs/2+rand.Int63n(3*bs/2))
+			}
+			encode("empty", 0)
+			encode("large", 5*bs+123)
+			for name := range contents {
+				if small := name != "large"; isPacked(name) != small || (dirs(fileKey(name)) == 0) != small {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s is packed: %t, has %d directories", k, m, bs, N, name, isPacked(name), dirs(fileKey(name)))
+				}
+			}
+			for name := range contents {
+				checkRead("packed", name)
+			}
+			//containers are not hashed, so packing never reads them back
+			intSmall, _ := testEC.fileMap.Load(fileKey("small/0"))
+			if intPack, ok := testEC.fileMap.Load(packName(intSmall.(*fileInfo).Pack.Container)); !ok || intPack.(*fileInfo).Hash != "" {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the container of small/0 has a hash", k, m, bs, N)
+			}
+			if list, _ := testEC.ReadDir("/"); len(list) != 3 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the root lists %d entries, want 3", k, m, bs, N, len(list))
+			}
+			//the blocks of containers are reconstructed on failed disks
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+			checkRead("degraded", "small/3")
+			revive()
+			//a packed file is changed by packing it again
+			p := []byte("changed")
+			if _, err = testEC.WriteAt("small/0", p, 1); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d write fails for %s", k, m, bs, N, err.Error())
+			}
+			copy(contents["small/0"][1:], p)
+			if _, err = testEC.Append("small/1", bytes.NewReader(p)); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d append fails for %s", k, m, bs, N, err.Error())
+			}
+			contents["small/1"] = append(contents["small/1"], p...)
+			//until it outgrows the threshold
+			q := make([]byte, 2*bs)
+			fillRandom(q)
+			if _, err = testEC.Append("small/2", bytes.NewReader(q)); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d append fails for %s", k, m, bs, N, err.Error())
+			}
+			contents["small/2"] = append(contents["small/2"], q...)
+			if isPacked("small/2") {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d a file grown beyond the threshold is still packed", k, m, bs, N)
+			}
+			if err = testEC.Copy("small/3", "copied"); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d copy fails for %s", k, m, bs, N, err.Error())
+			}
+			contents["copied"] = contents["small/3"]
+			if err = testEC.Rename("small/4", "renamed"); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d rename fails for %s", k, m, bs, N, err.Error())
+			}
+			contents["renamed"] = contents["small/4"]
+			delete(contents, "small/4")
+			for _, name := range []string{"small/0", "small/1", "small/2", "copied", "renamed"} {
+				checkRead("changed", name)
+			}
+			//most files are removed, so the container is compacted
+			for i := 3; i < 24; i++ {
+				name := fmt.Sprintf("small/%d", i)
+				if i == 4 {
+					continue
+				}
+				if err = testEC.RemoveFile(name); err != nil {
+					t.Fatal(err)
+				}
+				delete(contents, name)
+			}
+			intFi, _ := testEC.fileMap.Load(fileKey("copied"))
+			old := intFi.(*fileInfo).Pack.Container
+			if err = testEC.CompactPacks(); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d compaction fails for %s", k, m, bs, N, err.Error())
+			}
+			if _, ok := testEC.fileMap.Load(packName(old)); ok {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the container is not compacted", k, m, bs, N)
+			}
+			//its directories are removed once the config is written, and the files are found after a restart
+			if dirs(packName(old)) != N {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the container is removed before the config is written", k, m, bs, N)
+			}
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dirs(packName(old)) != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the container compacted is left on disks", k, m, bs, N)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name := range contents {
+				checkRead("compacted", name)
+			}
+			f, err := testEC.Open("copied")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := io.ReadAll(f); err != nil || !bytes.Equal(data, contents["copied"]) {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the opened packed file reads %v", k, m, bs, N, err)
+			}
+			f.Close()
+		}
+	}
+}
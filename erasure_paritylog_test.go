@@ -0,0 +1,227 @@
+// This test unit tests the parity logging of updates
+package grasure
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestParityLog(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	fileSize := int64(300*KiB + 123)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logSize := func() int64 {
+		intFi, _ := testEC.fileMap.Load(fileKey(inpath))
+		size := int64(0)
+		for _, s := range intFi.(*fileInfo).ParityLogSizes {
+			size += s
+		}
+		return size
+	}
+	logFiles := func() int {
+		cnt := 0
+		for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			if ok, _ := pathExist(filepath.Join(disk.diskPath, parityLogDir, fileKey(inpath))); ok {
+				cnt++
+			}
+		}
+		return cnt
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			//the deltas are logged only, until merged by hand
+			testEC.ParityLogSize = 1 << 40
+			readOnce := func(stage string, options *Options) {
+				err = testEC.ReadFile(inpath, outpath, options)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for %s", k, m, bs, N, stage, err.Error())
+				}
+				if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for hash check fail", k, m, bs, N, stage)
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkRead := func(stage string) {
+				for _, options := range []Options{{}, {Degrade: true}} {
+					readOnce(stage, &options)
+					//reconstruction needs the pending parity deltas
+					testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+				}
+				for i := range testEC.diskInfos {
+					testEC.diskInfos[i].available = true
+				}
+			}
+			writeRandom := func(size int64) {
+				p := make([]byte, size)
+				fillRandom(p)
+				off := rand.Int63n(fileSize - size + 1)
+				if _, err := testEC.WriteAt(inpath, p, off); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d write of %d bytes at %d fails for %s", k, m, bs, N, size, off, err.Error())
+				}
+				lf, err := os.OpenFile(inpath, os.O_WRONLY, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = lf.WriteAt(p, off)
+				lf.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = generateRandomFileBySize(inpath, fileSize)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			_, err = testEC.EncodeFile(inpath)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			//small writes and updates log their parity deltas
+			for _, size := range []int64{1, 100, bs + 1, 3*bs + 7} {
+				writeRandom(size)
+			}
+			if err = changeRandom(inpath, int(fileSize), 20, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err = testEC.Update(inpath, inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d update fails for %s", k, m, bs, N, err.Error())
+			}
+			if logSize() == 0 || logFiles() == 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d parity deltas are not logged", k, m, bs, N)
+			}
+			checkRead("logged")
+			//the pending deltas survive a restart
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if testEC.pendingParity(fileKey(inpath)) == nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d parity deltas are not loaded at restart", k, m, bs, N)
+			}
+			checkRead("restarted")
+			//merging clears the logs
+			if err = testEC.MergeParityLogs(); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d merge fails for %s", k, m, bs, N, err.Error())
+			}
+			if logSize() != 0 || logFiles() != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d parity logs are left after merging", k, m, bs, N)
+			}
+			checkRead("merged")
+			//the logs are merged once they reach the threshold
+			testEC.ParityLogSize = 4 * (bs + 8)
+			for i := 0; i < 10; i++ {
+				writeRandom(rand.Int63n(2*bs) + 1)
+				if size := logSize(); size >= testEC.ParityLogSize {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d parity logs of %d bytes are not merged", k, m, bs, N, size)
+				}
+			}
+			checkRead("threshold")
+			//the disks are recovered with deltas pending
+			testEC.ParityLogSize = 1 << 40
+			writeRandom(bs)
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+			if _, err = testEC.Recover(&Options{}); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d recover fails for %s", k, m, bs, N, err.Error())
+			}
+			checkRead("recovered")
+			if err = testEC.MergeParityLogs(); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d merge after recovery fails for %s", k, m, bs, N, err.Error())
+			}
+			checkRead("recovered and merged")
+			//an update with disks holding pending deltas failed merges the rest, leaving those blocks stale
+			writeRandom(3*bs + 7)
+			failed := 0
+			for diskId, deltas := range testEC.pendingParity(fileKey(inpath)).deltas {
+				if len(deltas) > 0 && failed < m {
+					testEC.diskInfos[diskId].available = false
+					failed++
+				}
+			}
+			if failed == 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d no parity delta is pending", k, m, bs, N)
+			}
+			if err = changeRandom(inpath, int(fileSize), 20, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err = testEC.Update(inpath, inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d degraded update with deltas pending fails for %s", k, m, bs, N, err.Error())
+			}
+			writeRandom(bs + 1)
+			intFi, _ := testEC.fileMap.Load(fileKey(inpath))
+			if logSize() != 0 || len(intFi.(*fileInfo).RepairList) == 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the deltas of failed disks are not left stale", k, m, bs, N)
+			}
+			readOnce("degraded", &Options{})
+			//the stale blocks are not read once the disks are back
+			for i := range testEC.diskInfos {
+				testEC.diskInfos[i].available = true
+			}
+			readOnce("revived", &Options{})
+			if err = testEC.RepairStale(); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d repair fails for %s", k, m, bs, N, err.Error())
+			}
+			checkRead("repaired")
+			//restore diskConfigFile to previous content
+			if err := os.Rename(testDiskFilePath+".old", testDiskFilePath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadDiskPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+			//the deltas of a file encoded again are forgotten
+			writeRandom(bs)
+			err = generateRandomFileBySize(inpath, fileSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = testEC.EncodeFile(inpath)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			if testEC.pendingParity(fileKey(inpath)) != nil || logFiles() != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d parity deltas are left after encoding again", k, m, bs, N)
+			}
+			checkRead("encoded again")
+		}
+	}
+}
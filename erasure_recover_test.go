@@ -89,8 +89,8 @@ func TestRecover(t *testing.T) {
 						// check if the resumed blobs are consistent with former ones
 						for old, new := range rm {
 							for _, fileSize := range tempFileSizes {
-								oldPath := filepath.Join(old, fmt.Sprintf("temp-%d", fileSize), "BLOB")
-								newPath := filepath.Join(new, fmt.Sprintf("temp-%d", fileSize), "BLOB")
+								oldPath := filepath.Join(old, fileKey(fmt.Sprintf("input/temp-%d", fileSize)), "BLOB")
+								newPath := filepath.Join(new, fileKey(fmt.Sprintf("input/temp-%d", fileSize)), "BLOB")
 								if ok, err := checkFileIfSame(newPath, oldPath); !ok && err == nil {
 									t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
 								} else if err != nil {
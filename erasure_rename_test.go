@@ -0,0 +1,287 @@
+// This test unit tests renaming and copying files inside the system
+package grasure
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestRenameCopy(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+		Versioning:      true,
+	}
+	rand.Seed(100000007)
+	fileSize := int64(300*KiB + 123)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	oldpath := inpath + ".old"
+	copypath := inpath + ".copy"
+	defer os.Remove(oldpath)
+	defer os.Remove(copypath)
+	renamed := "renamed-" + filepath.Base(inpath)
+	copied := "copied-" + filepath.Base(inpath)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := func(name string) int {
+		cnt := 0
+		for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			if ok, _ := pathExist(filepath.Join(disk.diskPath, name)); ok {
+				cnt++
+			}
+		}
+		return cnt
+	}
+	revive := func() {
+		for i := range testEC.diskInfos {
+			testEC.diskInfos[i].available = true
+		}
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			checkRead := func(stage, name, path string, versionID int) {
+				for _, options := range []Options{{}, {Degrade: true}} {
+					if versionID < 0 {
+						err = testEC.ReadFile(name, outpath, &options)
+					} else {
+						err = testEC.ReadFileVersion(name, versionID, outpath, &options)
+					}
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for %s", k, m, bs, N, stage, err.Error())
+					}
+					if ok, err := checkFileIfSame(path, outpath); !ok && err == nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for hash check fail", k, m, bs, N, stage)
+					} else if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = generateRandomFileBySize(inpath, fileSize)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			_, err = testEC.EncodeFile(inpath)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			if _, err = copyFile(inpath, oldpath); err != nil {
+				t.Fatal(err)
+			}
+			if err = changeRandom(inpath, int(fileSize), 20, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err = testEC.Update(inpath, inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d update fails for %s", k, m, bs, N, err.Error())
+			}
+			versions, _ := testEC.ListVersions(inpath)
+			//the file is renamed along with its old version
+			if err = testEC.Rename(inpath, renamed); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d rename fails for %s", k, m, bs, N, err.Error())
+			}
+			if err = testEC.ReadFile(inpath, outpath, &Options{}); err != errFileNotFound {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of the old name returns %v", k, m, bs, N, err)
+			}
+			if dirs(fileKey(inpath)) != 0 || dirs(renamed) != N || dirs(versionName(renamed, versions[0].ID)) != N {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the directories are not renamed", k, m, bs, N)
+			}
+			checkRead("renamed", renamed, inpath, -1)
+			checkRead("renamed version", renamed, oldpath, versions[0].ID)
+			//a file is never renamed onto a directory or under a file
+			if err = testEC.Mkdir("dir"); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range map[string]error{"dir": errIsDir, renamed + "/x": errNotDir, "/": errInvalidFileName} {
+				if err = testEC.Rename(renamed, name); err != want {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d rename to %s returns %v", k, m, bs, N, name, err)
+				}
+			}
+			//the copy is changed independently
+			if err = testEC.Copy(renamed, copied); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d copy fails for %s", k, m, bs, N, err.Error())
+			}
+			checkRead("copied", copied, inpath, -1)
+			p := make([]byte, 3*bs)
+			fillRandom(p)
+			if _, err = testEC.WriteAt(copied, p, bs/2); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d write fails for %s", k, m, bs, N, err.Error())
+			}
+			if _, err = copyFile(inpath, copypath); err != nil {
+				t.Fatal(err)
+			}
+			cf, err := os.OpenFile(copypath, os.O_WRONLY, 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cf.WriteAt(p, bs/2)
+			cf.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRead("written copy", copied, copypath, -1)
+			checkRead("copy source", renamed, inpath, -1)
+			//the copy onto a file keeps its former version, the one written as well, and survives a restart
+			if err = testEC.Copy(renamed, copied); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d copy fails for %s", k, m, bs, N, err.Error())
+			}
+			if versions, _ = testEC.ListVersions(copied); len(versions) != 3 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d versions of the copy, want 3", k, m, bs, N, len(versions))
+			}
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRead("copied again", copied, inpath, -1)
+			checkRead("copy version", copied, inpath, versions[0].ID)
+			checkRead("written version", copied, copypath, versions[1].ID)
+			//the blocks on failed disks are repaired later
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+			if err = testEC.Copy(renamed, copied); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d degraded copy fails for %s", k, m, bs, N, err.Error())
+			}
+			intFi, _ := testEC.fileMap.Load(copied)
+			if len(intFi.(*fileInfo).RepairList) == 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d no block is left stale by a degraded copy", k, m, bs, N)
+			}
+			checkRead("degraded copy", copied, inpath, -1)
+			revive()
+			if err = testEC.RepairStale(); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d repair fails for %s", k, m, bs, N, err.Error())
+			}
+			for i := 0; i < 3; i++ {
+				testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+				checkRead("repaired copy", copied, inpath, -1)
+				revive()
+			}
+			//renaming onto a file needs Override
+			testEC.Override = false
+			if err = testEC.Rename(copied, renamed); err == nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d rename replaces a file without override", k, m, bs, N)
+			}
+			testEC.Override = true
+			//a failed rename onto a file leaves both files as they were
+			intFi, _ = testEC.fileMap.Load(copied)
+			copyVersions := intFi.(*fileInfo).Versions
+			blocked := filepath.Join(testEC.diskInfos[N-1].diskPath, versionName(renamed, copyVersions[len(copyVersions)-1]))
+			if err = os.MkdirAll(filepath.Join(blocked, "blocker"), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err = testEC.Rename(copied, renamed); err == nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d rename onto a blocked directory succeeds", k, m, bs, N)
+			}
+			os.RemoveAll(blocked)
+			if len(testEC.ListTrash()) != 0 || dirs(renamed) != N || dirs(copied) != N {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the files are not put back after a failed rename", k, m, bs, N)
+			}
+			checkRead("put back", renamed, inpath, -1)
+			checkRead("put back copy", copied, inpath, -1)
+			if err = testEC.Rename(copied, renamed); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d rename fails for %s", k, m, bs, N, err.Error())
+			}
+			if _, ok := testEC.fileMap.Load(copied); ok || dirs(copied) != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the copy is left after renaming", k, m, bs, N)
+			}
+			checkRead("renamed copy", renamed, inpath, -1)
+			//the file replaced is removed once the config is written
+			if len(testEC.ListTrash()) != 0 || dirs(trashDir) != N {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the file replaced is not kept aside until the config is written", k, m, bs, N)
+			}
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+				if entries, _ := os.ReadDir(filepath.Join(disk.diskPath, trashDir)); len(entries) != 0 {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d the file replaced is left in %s", k, m, bs, N, disk.diskPath)
+				}
+			}
+			checkRecords := func(stage string) {
+				for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+					if matches, _ := filepath.Glob(filepath.Join(disk.diskPath, journalDir, "*.renamed")); len(matches) != 0 {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s rename is still recorded in %s after the config is written", k, m, bs, N, stage, disk.diskPath)
+					}
+				}
+			}
+			checkRecords("finished")
+			//a rename onto a file not yet in the config survives a crash
+			if err = testEC.Copy(renamed, copied); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d copy fails for %s", k, m, bs, N, err.Error())
+			}
+			if err = testEC.WriteConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if err = testEC.Rename(renamed, copied); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d rename fails for %s", k, m, bs, N, err.Error())
+			}
+			if err = testEC.ReadConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := testEC.fileMap.Load(renamed); ok || dirs(renamed) != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the former name is back after a crash", k, m, bs, N)
+			}
+			checkRead("crashed rename", copied, inpath, -1)
+			if err = testEC.WriteConfig(); err != nil {
+				t.Fatal(err)
+			}
+			checkRecords("crashed")
+			for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+				if entries, _ := os.ReadDir(filepath.Join(disk.diskPath, trashDir)); len(entries) != 0 {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d the file replaced is left in %s after a crash", k, m, bs, N, disk.diskPath)
+				}
+			}
+			//a rename interrupted halfway is finished at warm-up, on the disks it has not reached
+			rc := &renameRecord{From: []string{copied}, To: []string{renamed}}
+			record := renamed + ".1.renamed"
+			if err = testEC.writeRenamed(record, rc); err != nil {
+				t.Fatal(err)
+			}
+			for _, disk := range testEC.diskInfos[:testEC.DiskNum/2] {
+				if err = os.Rename(filepath.Join(disk.diskPath, copied), filepath.Join(disk.diskPath, renamed)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = testEC.ReadConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := testEC.fileMap.Load(copied); ok || dirs(copied) != 0 || dirs(renamed) != N {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the interrupted rename is not finished", k, m, bs, N)
+			}
+			checkRead("interrupted rename", renamed, inpath, -1)
+			if err = testEC.WriteConfig(); err != nil {
+				t.Fatal(err)
+			}
+			checkRecords("interrupted")
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// This test unit tests scaling the system to new erasure parameters, interrupted and resumed
+package grasure
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestScale(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	outpath := filepath.Join("output", "scale")
+	defer os.Remove(outpath)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []int{2, 4} {
+		for _, m := range []int{1, 2} {
+			//the system parameters are changed by scaling
+			testEC.K = k
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			testEC.Class = ""
+			testEC.Classes = nil
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			newK, newM := N-2, 2
+			hot := StorageClass{K: 2, M: 1, BlockSize: 1 * KiB}
+			if err = testEC.DefineClass("hot", hot.K, hot.M, hot.BlockSize); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d define class fails for %s", k, m, bs, N, err.Error())
+			}
+			//files of full stripes and of a shortened tail, and one of a storage class kept as it is
+			contents := map[string][]byte{
+				"scale_full": make([]byte, 3*int64(k*newK)*bs),
+				"scale_tail": make([]byte, 5*int64(k)*bs+rand.Int63n(int64(k)*bs)),
+				"scale_hot":  make([]byte, 4*int64(k)*bs+rand.Int63n(int64(k)*bs)),
+			}
+			for name, content := range contents {
+				fillRandom(content)
+				if name == "scale_hot" {
+					testEC.Class = "hot"
+				}
+				_, err = testEC.EncodeReader(name, bytes.NewReader(content))
+				testEC.Class = ""
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode of %s fails for %s", k, m, bs, N, name, err.Error())
+				}
+			}
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			intFi, _ := testEC.fileMap.Load(fileKey("scale_full"))
+			oldFi := intFi.(*fileInfo)
+			oldDist := oldFi.Distribution
+			blockAt := func(diskId, offset int) []byte {
+				f, err := os.Open(filepath.Join(testEC.diskInfos[diskId].diskPath, fileKey("scale_full"), "BLOB"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				block := make([]byte, bs)
+				if _, err = f.ReadAt(block, int64(offset)*bs); err != nil {
+					t.Fatal(err)
+				}
+				return block
+			}
+			//the data blocks as they lie in the BLOBs before scaling
+			oldBlocks := make([][][]byte, len(oldDist))
+			for stripeNo := range oldDist {
+				oldBlocks[stripeNo] = make([][]byte, k)
+				for i := 0; i < k; i++ {
+					oldBlocks[stripeNo][i] = blockAt(oldDist[stripeNo][i], oldFi.blockToOffset[stripeNo][i])
+				}
+			}
+			if err = testEC.Scale(N, 1); err != errTooFewDisksAlive {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the system is scaled beyond the disks, %v", k, m, bs, N, err)
+			}
+			checkRead := func(stage string) {
+				for name, content := range contents {
+					for _, options := range []Options{{}, {Degrade: true}} {
+						err = testEC.ReadFile(name, outpath, &options)
+						if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of %s fails for %s", k, m, bs, N, stage, name, err.Error())
+						}
+						if data, _ := os.ReadFile(outpath); !bytes.Equal(data, content) {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of %s fails for hash check fail", k, m, bs, N, stage, name)
+						}
+					}
+				}
+			}
+			//an interrupted scaling leaves the files in both layouts, all readable
+			if err = testEC.beginScale(newK, newM); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d scaling fails for %s", k, m, bs, N, err.Error())
+			}
+			if err = testEC.restripe(fileKey("scale_full")); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d re-striping fails for %s", k, m, bs, N, err.Error())
+			}
+			//the data blocks staying on their disks keep their offsets and bytes, and are not journaled
+			intFi, _ = testEC.fileMap.Load(fileKey("scale_full"))
+			newFi := intFi.(*fileInfo)
+			stay := 0
+			for stripeNo, dist := range newFi.Distribution {
+				for i := 0; i < newK; i++ {
+					j := stripeNo*newK + i
+					if dist[i] != oldDist[j/k][j%k] {
+						continue
+					}
+					stay++
+					if offset := newFi.blockToOffset[stripeNo][i]; offset != oldFi.blockToOffset[j/k][j%k] {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d block %d of stripe %d staying on disk %d is moved from offset %d to %d",
+							k, m, bs, N, i, stripeNo, dist[i], oldFi.blockToOffset[j/k][j%k], offset)
+					}
+					if !bytes.Equal(blockAt(dist[i], newFi.blockToOffset[stripeNo][i]), oldBlocks[j/k][j%k]) {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d block %d of stripe %d staying on disk %d is changed", k, m, bs, N, i, stripeNo, dist[i])
+					}
+				}
+			}
+			if stay == 0 || newK == k && stay != len(newFi.Distribution)*newK {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d data blocks stay on their disks", k, m, bs, N, stay)
+			}
+			logged := int64(0)
+			for _, disk := range testEC.diskInfos[:N] {
+				info, err := os.Stat(filepath.Join(disk.diskPath, journalDir, fileKey("scale_full")+".log"))
+				if err == nil {
+					logged += info.Size() / (8 + bs)
+				} else if !os.IsNotExist(err) {
+					t.Fatal(err)
+				}
+			}
+			if want := int64(len(newFi.Distribution)*(newK+newM) - stay); logged != want {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d blocks are journaled, want %d", k, m, bs, N, logged, want)
+			}
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			if testEC.Scaling == nil || testEC.K != newK || testEC.M != newM {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the scaling is not recorded in the config", k, m, bs, N)
+			}
+			checkRead("interrupted")
+			if err = testEC.Scale(1, 1); err != errScalingInProgress {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d another scaling begins before the last is done, %v", k, m, bs, N, err)
+			}
+			if err = testEC.Scale(newK, newM); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d resumed scaling fails for %s", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			if testEC.Scaling != nil || testEC.K != newK || testEC.M != newM {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the system is %d+%d after scaling, %v left", k, m, bs, N, testEC.K, testEC.M, testEC.Scaling)
+			}
+			for name := range contents {
+				intFi, _ := testEC.fileMap.Load(fileKey(name))
+				fi := intFi.(*fileInfo)
+				want := StorageClass{K: newK, M: newM, BlockSize: bs}
+				if name == "scale_hot" {
+					want = hot
+				}
+				if got := (StorageClass{K: fi.K, M: fi.M, BlockSize: fi.BlockSize}); got != want {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d file %s has parameters %v after scaling, want %v", k, m, bs, N, name, got, want)
+				}
+				//every BLOB ends with its last block, the offsets left free by the blocks staying aside
+				total := int64(0)
+				sizes := testEC.blobSizes(fi)
+				for i := range testEC.diskInfos[:testEC.DiskNum] {
+					info, err := os.Stat(filepath.Join(testEC.diskInfos[i].diskPath, fi.FileName, "BLOB"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if info.Size() != sizes[i] {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d the BLOB of %s on disk %d takes %d bytes, want %d", k, m, bs, N, name, i, info.Size(), sizes[i])
+					}
+					total += info.Size()
+				}
+				if want := testEC.codecOf(fi).stripedFileSize(fi.FileSize); total < want {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d the BLOBs of %s take %d bytes, want at least %d", k, m, bs, N, name, total, want)
+				}
+			}
+			//with k unchanged, every data block stays on its disk
+			if newK == k {
+				intFi, _ := testEC.fileMap.Load(fileKey("scale_full"))
+				for stripeNo, dist := range intFi.(*fileInfo).Distribution {
+					for i := 0; i < k; i++ {
+						if dist[i] != oldDist[stripeNo][i] {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d block %d of stripe %d is moved from disk %d to %d",
+								k, m, bs, N, i, stripeNo, oldDist[stripeNo][i], dist[i])
+						}
+					}
+				}
+			}
+			checkRead("scaled")
+			//the blocks kept in place stay where they are as the file changes
+			tail := make([]byte, 2*int64(newK)*bs+7)
+			fillRandom(tail)
+			if _, err = testEC.Append("scale_full", bytes.NewReader(tail)); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d append after scaling fails for %s", k, m, bs, N, err.Error())
+			}
+			contents["scale_full"] = append(contents["scale_full"], tail...)
+			size := int64(len(contents["scale_full"])) - int64(newK)*bs - 3
+			if err = testEC.Truncate("scale_full", size); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d truncate after scaling fails for %s", k, m, bs, N, err.Error())
+			}
+			contents["scale_full"] = contents["scale_full"][:size]
+			checkRead("changed")
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: 1})
+			checkRead("degraded")
+			for i := range testEC.diskInfos {
+				testEC.diskInfos[i].available = true
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// This test unit tests the staging and commit of encoding
+package grasure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//failReader fails once `n` bytes are read
+type failReader struct {
+	r io.Reader
+	n int64
+}
+
+var errReaderFail = errors.New("reader fails on purpose")
+
+func (fr *failReader) Read(p []byte) (int, error) {
+	if fr.n <= 0 {
+		return 0, errReaderFail
+	}
+	if int64(len(p)) > fr.n {
+		p = p[:fr.n]
+	}
+	n, err := fr.r.Read(p)
+	fr.n -= int64(n)
+	return n, err
+}
+
+//-------------------------TEST UNIT----------------------------
+
+func TestStagedEncode(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+		K:               4,
+		M:               2,
+		DiskNum:         6,
+		BlockSize:       4 * KiB,
+	}
+	fileSize := int64(1 * MiB)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	baseName := fileKey(inpath)
+	err = generateRandomFileBySize(inpath, fileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.InitSystem(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStagingEmpty := func() {
+		for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			entries, _ := os.ReadDir(filepath.Join(disk.diskPath, stagingDir))
+			if len(entries) != 0 {
+				t.Fatalf("staging directory of %s is not empty", disk.diskPath)
+			}
+		}
+	}
+	checkIntact := func() {
+		err = testEC.ReadFile(inpath, outpath, &Options{})
+		if err != nil {
+			t.Fatalf("read fails for %s", err.Error())
+		}
+		if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+			t.Fatal("read fails for hash check fail")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = testEC.EncodeFile(inpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStagingEmpty()
+	//a failed override keeps the former version
+	f, err := os.Open(inpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testEC.EncodeReader(inpath, &failReader{f, fileSize / 2})
+	f.Close()
+	if err != errReaderFail {
+		t.Fatalf("failed override returns %v", err)
+	}
+	checkStagingEmpty()
+	checkIntact()
+	//an encode interrupted by a crash is swept at warm-up
+	w, err := testEC.Create("crashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(make([]byte, 10*testEC.dataStripeSize)); err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.WriteConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStagingEmpty()
+	for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+		if ok, _ := pathExist(filepath.Join(disk.diskPath, "crashed")); ok {
+			t.Fatalf("the crashed encode is visible in %s", disk.diskPath)
+		}
+	}
+	if _, ok := testEC.fileMap.Load("crashed"); ok {
+		t.Fatal("the crashed encode is recorded in fileMap")
+	}
+	checkIntact()
+	//a file named after the staging directory is kept apart from it
+	if _, err = testEC.EncodeReader(stagingDir, io.LimitReader(zeroReader{}, 100)); err != nil {
+		t.Fatalf("encoding %s fails for %s", stagingDir, err.Error())
+	}
+	checkStagingEmpty()
+	if err = testEC.RemoveFile(stagingDir); err != nil {
+		t.Fatal(err)
+	}
+	//without override, an existing directory is not touched
+	testEC.Override = false
+	fi, _ := testEC.fileMap.Load(baseName)
+	testEC.deleteFile(baseName)
+	_, err = testEC.EncodeFile(inpath)
+	if err != errDataDirExist {
+		t.Fatalf("encoding over an existing directory without override returns %v", err)
+	}
+	testEC.storeFile(fi.(*fileInfo))
+	checkStagingEmpty()
+	checkIntact()
+	testEC.Override = true
+	checkRecords := func() {
+		for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			matches, _ := filepath.Glob(filepath.Join(disk.diskPath, journalDir, baseName+".*"))
+			if len(matches) != 0 {
+				t.Fatalf("the commit is still recorded in %s after the config is written", disk.diskPath)
+			}
+		}
+	}
+	//an override committed but not yet in the config survives a crash
+	err = testEC.WriteConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = generateRandomFileBySize(inpath, fileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testEC.EncodeFile(inpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIntact()
+	err = testEC.WriteConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecords()
+	//a commit interrupted halfway is finished at warm-up, on the disks it has not reached
+	err = generateRandomFileBySize(inpath, fileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testEC.EncodeReader("halfway", mustOpen(t, inpath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	intFi, _ := testEC.fileMap.Load(fileKey("halfway"))
+	testEC.deleteFile(fileKey("halfway"))
+	newFi := *intFi.(*fileInfo)
+	newFi.FileName = baseName
+	sc := &stagedCommit{File: &newFi, Dirs: make([]string, testEC.DiskNum)}
+	for i, disk := range testEC.diskInfos[:testEC.DiskNum] {
+		sc.Dirs[i] = "halfway.staged"
+		if err = os.Rename(filepath.Join(disk.diskPath, fileKey("halfway")), filepath.Join(disk.diskPath, stagingDir, sc.Dirs[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, disk := range testEC.diskInfos[:testEC.DiskNum] {
+		if err = writeRecord(filepath.Join(disk.diskPath, journalDir), baseName+".staged", data); err != nil {
+			t.Fatal(err)
+		}
+		if i >= testEC.DiskNum/2 {
+			continue
+		}
+		staged := filepath.Join(disk.diskPath, stagingDir, sc.Dirs[i])
+		if err = os.Rename(filepath.Join(disk.diskPath, baseName), staged+".old"); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(staged, filepath.Join(disk.diskPath, baseName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStagingEmpty()
+	checkIntact()
+	err = testEC.WriteConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecords()
+}
+
+//mustOpen opens file `path` for reading, and fails the test if it can't.
+//The file is closed when the test finishes.
+func mustOpen(t *testing.T, path string) *os.File {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
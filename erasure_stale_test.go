@@ -0,0 +1,180 @@
+// This test unit tests the degraded updates and the repair of stale blocks
+package grasure
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestDegradedUpdate(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	fileSize := int64(300*KiB + 123)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repairList := func() [][2]int {
+		intFi, _ := testEC.fileMap.Load(fileKey(inpath))
+		return intFi.(*fileInfo).RepairList
+	}
+	revive := func() {
+		for i := range testEC.diskInfos {
+			testEC.diskInfos[i].available = true
+		}
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			checkRead := func(stage string) {
+				for _, options := range []Options{{}, {Degrade: true}} {
+					err = testEC.ReadFile(inpath, outpath, &options)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for %s", k, m, bs, N, stage, err.Error())
+					}
+					if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for hash check fail", k, m, bs, N, stage)
+					} else if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			//updates, appends to and truncates the file with up to m disks failed
+			update := func() {
+				for _, mode := range updateMode {
+					stat, err := os.Stat(inpath)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err = changeRandom(inpath, int(stat.Size()), int(fileSize/20), mode); err != nil {
+						t.Fatal(err)
+					}
+					if err = testEC.Update(inpath, inpath); err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d mode:%d degraded update fails for %s", k, m, bs, N, mode, err.Error())
+					}
+				}
+				p := make([]byte, 3*int64(k)*bs+5)
+				fillRandom(p)
+				if _, err := testEC.Append(inpath, bytes.NewReader(p)); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d degraded append fails for %s", k, m, bs, N, err.Error())
+				}
+				lf, err := os.OpenFile(inpath, os.O_RDWR|os.O_APPEND, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer lf.Close()
+				if _, err = lf.Write(p); err != nil {
+					t.Fatal(err)
+				}
+				stat, err := lf.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				newSize := stat.Size() - int64(k)*bs - 7
+				if err = testEC.Truncate(inpath, newSize); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d degraded truncate fails for %s", k, m, bs, N, err.Error())
+				}
+				if err = lf.Truncate(newSize); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = generateRandomFileBySize(inpath, fileSize)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			_, err = testEC.EncodeFile(inpath)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			//more failures than tolerated are refused
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m + 1})
+			if err = testEC.Update(inpath, inpath); err != errTooFewDisksAlive {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d update with %d disks failed returns %v", k, m, bs, N, m+1, err)
+			}
+			revive()
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+			update()
+			if len(repairList()) == 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d no block is left stale", k, m, bs, N)
+			}
+			checkRead("degraded")
+			//the stale blocks are not read once the disks are back, even after a restart
+			revive()
+			checkRead("revived")
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(repairList()) == 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the repair list is lost at restart", k, m, bs, N)
+			}
+			checkRead("restarted")
+			//the repaired blocks serve reads when other disks fail
+			if err = testEC.RepairStale(); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d repair fails for %s", k, m, bs, N, err.Error())
+			}
+			if len(repairList()) != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d stale blocks are left after repairing", k, m, bs, N)
+			}
+			for i := 0; i < 3; i++ {
+				testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+				checkRead("repaired")
+				revive()
+			}
+			//the stale blocks of failed disks are restored by recovery
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+			update()
+			if _, err = testEC.Recover(&Options{}); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d recover fails for %s", k, m, bs, N, err.Error())
+			}
+			if len(repairList()) != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d stale blocks are left after recovery", k, m, bs, N)
+			}
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+			checkRead("recovered")
+			revive()
+			//restore diskConfigFile to previous content
+			if err := os.Rename(testDiskFilePath+".old", testDiskFilePath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadDiskPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
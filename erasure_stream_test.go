@@ -0,0 +1,254 @@
+// This test unit tests the streaming interfaces
+package grasure
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestEncodeReader(t *testing.T) {
+	//we pipe the temp data into the system, so the length is unknown to the encoder
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	tempFileSizes := append(generateRandomFileSize(1*KiB, 1*MiB, 20), 0, 1)
+	defer deleteTempFiles(tempFileSizes)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalDisk := len(testEC.diskInfos)
+	for _, k := range []int{2, 3, 4, 6} {
+		testEC.K = k
+		for _, m := range []int{1, 2, 3} {
+			testEC.M = m
+			N := min(k+m+2, totalDisk)
+			testEC.DiskNum = N
+			for _, bs := range []int64{4 * KiB, 16 * KiB} {
+				testEC.BlockSize = bs
+				err = testEC.InitSystem(true)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				log.Printf("----k:%d,m:%d,bs:%d,N:%d----\n", k, m, bs, N)
+				err = testEC.ReadConfig()
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				for _, fileSize := range tempFileSizes {
+					inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+					outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+					err = generateRandomFileBySize(inpath, fileSize)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					f, err := os.Open(inpath)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+					}
+					pr, pw := io.Pipe()
+					go func() {
+						_, err := io.Copy(pw, f)
+						pw.CloseWithError(err)
+					}()
+					fi, err := testEC.EncodeReader(inpath, pr)
+					f.Close()
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+					}
+					if fi.FileSize != fileSize {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d file size %d recorded as %d", k, m, bs, N, fileSize, fi.FileSize)
+					}
+					err = testEC.ReadFile(inpath, outpath, &Options{})
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+					}
+					if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails when fileSize is %d, for hash check fail", k, m, bs, N, fileSize)
+					} else if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+					}
+					rf, _ := os.Open(inpath)
+					hash, _ := hashStr(rf)
+					rf.Close()
+					if hash != fi.Hash {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d hash of file sized %d mismatches", k, m, bs, N, fileSize)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      2,
+		Override:        true,
+		Quiet:           true,
+		K:               4,
+		M:               2,
+		DiskNum:         8,
+		BlockSize:       4 * KiB,
+	}
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.InitSystem(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := testEC.Create("created.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//write in odd-sized chunks that straddle stripes and batches
+	data := make([]byte, 333*KiB+7)
+	fillRandom(data)
+	for p := data; len(p) > 0; {
+		n := min(len(p), 10007)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if _, ok := testEC.fileMap.Load("created.file"); ok {
+		t.Fatal("file is visible before Close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != errFileClosed {
+		t.Fatalf("write after close returns %v", err)
+	}
+	intFi, ok := testEC.fileMap.Load("created.file")
+	if !ok {
+		t.Fatal("file is not published after Close")
+	}
+	fi := intFi.(*fileInfo)
+	if fi.FileSize != int64(len(data)) {
+		t.Fatalf("file size %d recorded as %d", len(data), fi.FileSize)
+	}
+	if len(fi.Distribution) != int(ceilFracInt64(fi.FileSize, testEC.dataStripeSize)) {
+		t.Fatalf("%d stripes for %d bytes", len(fi.Distribution), fi.FileSize)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      100,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	tempFileSizes := generateRandomFileSize(1*KiB, 1*MiB, 10)
+	defer deleteTempFiles(tempFileSizes)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []int{2, 4, 6} {
+		testEC.K = k
+		for _, m := range []int{2, 3} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			for _, fileSize := range tempFileSizes {
+				inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+				err = generateRandomFileBySize(inpath, fileSize)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				_, err := testEC.EncodeFile(inpath)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode fails when fileSize is %d, for %s", k, m, bs, N, fileSize, err.Error())
+				}
+				want, err := os.ReadFile(inpath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				//read with up to m failed disks
+				for fn := 0; fn <= m; fn++ {
+					for i := range testEC.diskInfos {
+						testEC.diskInfos[i].available = i >= fn
+					}
+					f, err := testEC.Open(inpath)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d open fails for %s", k, m, bs, N, fn, err.Error())
+					}
+					if st, _ := f.Stat(); st.Size() != fileSize {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d Stat reports %d bytes for %d", k, m, bs, N, st.Size(), fileSize)
+					}
+					//random ranges
+					for r := 0; r < 20; r++ {
+						off := rand.Int63n(fileSize)
+						p := make([]byte, rand.Int63n(fileSize-off)+1)
+						n, err := f.ReadAt(p, off)
+						if err != nil || n != len(p) {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d ReadAt(%d, %d) returns %d, %v", k, m, bs, N, fn, len(p), off, n, err)
+						}
+						if !bytes.Equal(p, want[off:off+int64(n)]) {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d ReadAt(%d, %d) returns wrong data", k, m, bs, N, fn, len(p), off)
+						}
+					}
+					//read past the end
+					if n, err := f.ReadAt(make([]byte, 10), fileSize-5); n != 5 || err != io.EOF {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d ReadAt at the end returns %d, %v", k, m, bs, N, fn, n, err)
+					}
+					//sequential read after seek
+					off := fileSize / 3
+					if _, err := f.Seek(off, io.SeekStart); err != nil {
+						t.Fatal(err)
+					}
+					got, err := io.ReadAll(f)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d ReadAll fails for %s", k, m, bs, N, fn, err.Error())
+					}
+					if !bytes.Equal(got, want[off:]) {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d,fn:%d sequential read returns wrong data", k, m, bs, N, fn)
+					}
+					f.Close()
+				}
+				for i := range testEC.diskInfos {
+					testEC.diskInfos[i].available = true
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// This test unit tests shortening the last stripe of files
+package grasure
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestTailStripe(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	name := "tail"
+	inpath := filepath.Join("input", "tail")
+	outpath := filepath.Join("output", "tail")
+	defer os.Remove(inpath)
+	defer os.Remove(outpath)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revive := func() {
+		for i := range testEC.diskInfos {
+			testEC.diskInfos[i].available = true
+		}
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			stripeSize := int64(k) * bs
+			var content []byte
+			//the BLOBs take no more than the blocks the file needs
+			checkBlobs := func(stage string) {
+				intFi, _ := testEC.fileMap.Load(fileKey(name))
+				fi := intFi.(*fileInfo)
+				if want := testEC.codecOf(fi).tailBlockSize(fi.FileSize); fi.TailBlockSize != want {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s the tail block size is %d, want %d", k, m, bs, N, stage, fi.TailBlockSize, want)
+				}
+				total := int64(0)
+				for i, size := range testEC.blobSizes(fi) {
+					info, err := os.Stat(filepath.Join(testEC.diskInfos[i].diskPath, fi.FileName, "BLOB"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if info.Size() != size {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s the BLOB of disk %d has %d bytes, want %d", k, m, bs, N, stage, i, info.Size(), size)
+					}
+					total += size
+				}
+				if total != testEC.codecOf(fi).stripedFileSize(fi.FileSize) {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s the BLOBs take %d bytes, want %d", k, m, bs, N, stage, total, testEC.codecOf(fi).stripedFileSize(fi.FileSize))
+				}
+			}
+			checkRead := func(stage string) {
+				for _, options := range []Options{{}, {Degrade: true}, {SkipParity: true}} {
+					err = testEC.ReadFile(name, outpath, &options)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for %s", k, m, bs, N, stage, err.Error())
+					}
+					if data, _ := os.ReadFile(outpath); !bytes.Equal(data, content) {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for hash check fail", k, m, bs, N, stage)
+					}
+				}
+				size := int64(len(content))
+				var buf bytes.Buffer
+				if err = testEC.ReadRange(name, size-stripeSize/2, stripeSize/2, &buf); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s range read fails for %s", k, m, bs, N, stage, err.Error())
+				}
+				if !bytes.Equal(buf.Bytes(), content[size-stripeSize/2:]) {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s range read mismatches", k, m, bs, N, stage)
+				}
+			}
+			//a file just over a stripe boundary takes little more than a stripe
+			content = make([]byte, 3*stripeSize+1)
+			fillRandom(content)
+			if _, err = testEC.EncodeReader(name, bytes.NewReader(content)); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode fails for %s", k, m, bs, N, err.Error())
+			}
+			if testEC.sysCodec().stripedFileSize(int64(len(content))) != 3*int64(k+m)*bs+int64(k+m) {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the striped size is %d", k, m, bs, N, testEC.sysCodec().stripedFileSize(int64(len(content))))
+			}
+			checkBlobs("encoded")
+			checkRead("encoded")
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+			checkRead("degraded")
+			revive()
+			//the last stripe is changed in place, and grows or shrinks along with the tail
+			p := []byte("changed")
+			if _, err = testEC.WriteAt(name, p, int64(len(content)-len(p))); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d write fails for %s", k, m, bs, N, err.Error())
+			}
+			copy(content[len(content)-len(p):], p)
+			if _, err = testEC.Append(name, bytes.NewReader(p[:4])); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d append fails for %s", k, m, bs, N, err.Error())
+			}
+			content = append(content, p[:4]...)
+			checkBlobs("written")
+			checkRead("written")
+			q := make([]byte, stripeSize-bs/2)
+			fillRandom(q)
+			if _, err = testEC.Append(name, bytes.NewReader(q)); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d append fails for %s", k, m, bs, N, err.Error())
+			}
+			content = append(content, q...)
+			checkBlobs("appended")
+			checkRead("appended")
+			if err = testEC.Truncate(name, 2*stripeSize+bs+5); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d truncate fails for %s", k, m, bs, N, err.Error())
+			}
+			content = content[:2*stripeSize+bs+5]
+			checkBlobs("truncated")
+			checkRead("truncated")
+			for _, size := range []int64{2*stripeSize + bs + 5, 2 * stripeSize, 4*stripeSize - 1} {
+				content = make([]byte, size)
+				fillRandom(content)
+				if err = os.WriteFile(inpath, content, 0666); err != nil {
+					t.Fatal(err)
+				}
+				if err = testEC.Update(name, inpath); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d update to %d bytes fails for %s", k, m, bs, N, size, err.Error())
+				}
+				checkBlobs("updated")
+				checkRead("updated")
+			}
+			//the short blocks of a failed disk are restored as they were
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: 1})
+			rm, err := testEC.Recover(&Options{})
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d recover fails for %s", k, m, bs, N, err.Error())
+			}
+			for old, new := range rm {
+				oldPath := filepath.Join(old, fileKey(name), "BLOB")
+				newPath := filepath.Join(new, fileKey(name), "BLOB")
+				if ok, err := checkFileIfSame(newPath, oldPath); err != nil || !ok {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d the BLOB recovered differs, %v", k, m, bs, N, err)
+				}
+			}
+			checkBlobs("recovered")
+			checkRead("recovered")
+			if err := os.Rename(testDiskFilePath+".old", testDiskFilePath); err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadDiskPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
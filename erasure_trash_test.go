@@ -0,0 +1,167 @@
+// This test unit tests the trash and undeletion of files
+package grasure
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestTrash(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+		Versioning:      true,
+		Trash:           true,
+	}
+	rand.Seed(100000007)
+	fileSize := int64(300*KiB + 123)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	oldpath := inpath + ".old"
+	defer os.Remove(oldpath)
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashDirs := func() int {
+		cnt := 0
+		for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			entries, _ := os.ReadDir(filepath.Join(disk.diskPath, trashDir))
+			cnt += len(entries)
+		}
+		return cnt
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			checkRead := func(stage, path string, versionID int) {
+				for _, options := range []Options{{}, {Degrade: true}} {
+					err = testEC.ReadFileVersion(inpath, versionID, outpath, &options)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for %s", k, m, bs, N, stage, err.Error())
+					}
+					if ok, err := checkFileIfSame(path, outpath); !ok && err == nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read fails for hash check fail", k, m, bs, N, stage)
+					} else if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			encode := func() {
+				err = generateRandomFileBySize(inpath, fileSize)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				_, err = testEC.EncodeFile(inpath)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+			}
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			//the file is removed along with its old version
+			encode()
+			if _, err = copyFile(inpath, oldpath); err != nil {
+				t.Fatal(err)
+			}
+			encode()
+			if err = testEC.RemoveFile(inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d remove fails for %s", k, m, bs, N, err.Error())
+			}
+			if err = testEC.ReadFile(inpath, outpath, &Options{}); err != errFileNotFound {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of a removed file returns %v", k, m, bs, N, err)
+			}
+			if trash := testEC.ListTrash(); len(trash) != 1 || trash[0].Name != inpath || trash[0].Size != fileSize {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the trash lists %v", k, m, bs, N, trash)
+			}
+			//the trash survives a restart
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = testEC.Undelete(inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d undelete fails for %s", k, m, bs, N, err.Error())
+			}
+			if len(testEC.ListTrash()) != 0 || trashDirs() != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the trash is not emptied by undeletion", k, m, bs, N)
+			}
+			versions, err := testEC.ListVersions(inpath)
+			if err != nil || len(versions) != 2 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the versions are not undeleted", k, m, bs, N)
+			}
+			checkRead("undeleted", inpath, versions[1].ID)
+			checkRead("undeleted version", oldpath, versions[0].ID)
+			//the latest removed file is undeleted first, and replaces the file of the same name only with Override
+			if err = testEC.RemoveFile(inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d remove fails for %s", k, m, bs, N, err.Error())
+			}
+			encode()
+			if _, err = copyFile(inpath, oldpath); err != nil {
+				t.Fatal(err)
+			}
+			if err = testEC.RemoveFile(inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d remove fails for %s", k, m, bs, N, err.Error())
+			}
+			encode()
+			testEC.Override = false
+			if err = testEC.Undelete(inpath); err == nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d undelete replaces a file without override", k, m, bs, N)
+			}
+			testEC.Override = true
+			if err = testEC.Undelete(inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d undelete fails for %s", k, m, bs, N, err.Error())
+			}
+			versions, _ = testEC.ListVersions(inpath)
+			checkRead("undeleted again", oldpath, versions[len(versions)-1].ID)
+			if trash := testEC.ListTrash(); len(trash) != 2 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d files are in the trash, want 2", k, m, bs, N, len(trash))
+			}
+			//purging frees the blocks
+			if err = testEC.PurgeTrash(time.Hour); err != nil || len(testEC.ListTrash()) != 2 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d recent files are purged", k, m, bs, N)
+			}
+			if err = testEC.PurgeTrash(0); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d purge fails for %s", k, m, bs, N, err.Error())
+			}
+			if len(testEC.ListTrash()) != 0 || trashDirs() != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the trash is not emptied by purging", k, m, bs, N)
+			}
+			//without trash, removal is irreversible
+			testEC.Trash = false
+			if err = testEC.RemoveFile(inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d remove fails for %s", k, m, bs, N, err.Error())
+			}
+			if err = testEC.Undelete(inpath); err != errFileNotFound {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d undelete of a deleted file returns %v", k, m, bs, N, err)
+			}
+			testEC.Trash = true
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// This test unit tests the versioning of files
+package grasure
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestVersioning(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+		Versioning:      true,
+	}
+	rand.Seed(100000007)
+	fileSize := int64(300*KiB + 123)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	//the local copy of every version
+	savedPath := func(id int) string {
+		return filepath.Join("input", fmt.Sprintf("temp-%d.v%d", fileSize, id))
+	}
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	versionDirs := func() int {
+		cnt := 0
+		for _, disk := range testEC.diskInfos[:testEC.DiskNum] {
+			matches, _ := filepath.Glob(filepath.Join(disk.diskPath, fileKey(inpath)+"~v*"))
+			cnt += len(matches)
+		}
+		return cnt
+	}
+	for _, k := range []int{2, 4} {
+		testEC.K = k
+		for _, m := range []int{1, 2} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			bs := int64(4 * KiB)
+			testEC.BlockSize = bs
+			testEC.MaxVersions = 0
+			var saved []int
+			defer func() {
+				for _, id := range saved {
+					os.Remove(savedPath(id))
+				}
+			}()
+			save := func() {
+				versions, err := testEC.ListVersions(inpath)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d list fails for %s", k, m, bs, N, err.Error())
+				}
+				id := versions[len(versions)-1].ID
+				if _, err := copyFile(inpath, savedPath(id)); err != nil {
+					t.Fatal(err)
+				}
+				saved = append(saved, id)
+			}
+			checkVersions := func(stage string) {
+				versions, err := testEC.ListVersions(inpath)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s list fails for %s", k, m, bs, N, stage, err.Error())
+				}
+				for _, v := range versions {
+					for _, options := range []Options{{}, {Degrade: true}} {
+						err = testEC.ReadFileVersion(inpath, v.ID, outpath, &options)
+						if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of version %d fails for %s", k, m, bs, N, stage, v.ID, err.Error())
+						}
+						if ok, err := checkFileIfSame(savedPath(v.ID), outpath); !ok && err == nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d %s read of version %d fails for hash check fail", k, m, bs, N, stage, v.ID)
+						} else if err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+			}
+			err = testEC.InitSystem(true)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = generateRandomFileBySize(inpath, fileSize)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			_, err = testEC.EncodeFile(inpath)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			save()
+			//every update and encode makes a new version
+			for _, mode := range updateMode {
+				stat, err := os.Stat(inpath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = changeRandom(inpath, int(stat.Size()), int(fileSize/20), mode); err != nil {
+					t.Fatal(err)
+				}
+				if err = testEC.Update(inpath, inpath); err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d mode:%d update fails for %s", k, m, bs, N, mode, err.Error())
+				}
+				save()
+			}
+			err = generateRandomFileBySize(inpath, fileSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = testEC.EncodeFile(inpath)
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			save()
+			versions, _ := testEC.ListVersions(inpath)
+			if len(versions) != len(updateMode)+2 || !versions[len(versions)-1].Current {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d versions are listed, want %d", k, m, bs, N, len(versions), len(updateMode)+2)
+			}
+			checkVersions("updated")
+			if err = testEC.ReadFileVersion(inpath, -1, outpath, &Options{}); err != errFileVersionNotFound {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of a missing version returns %v", k, m, bs, N, err)
+			}
+			//a file named like an old version is not taken for one
+			if _, err = testEC.EncodeReader(inpath+"~v1", bytes.NewReader([]byte("x"))); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d encode of a version name fails for %s", k, m, bs, N, err.Error())
+			}
+			if versions, _ = testEC.ListVersions(inpath); len(versions) != len(updateMode)+2 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d versions are listed, want %d", k, m, bs, N, len(versions), len(updateMode)+2)
+			}
+			if err = testEC.RemoveFile(inpath + "~v1"); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d remove fails for %s", k, m, bs, N, err.Error())
+			}
+			//the versions survive a restart and disk failures
+			err = testEC.WriteConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testEC.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkVersions("restarted")
+			testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+			checkVersions("failed")
+			if _, err = testEC.Recover(&Options{}); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d recover fails for %s", k, m, bs, N, err.Error())
+			}
+			checkVersions("recovered")
+			//restoring keeps the replaced version
+			first := versions[0].ID
+			if err = testEC.RestoreVersion(inpath, first); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d restore fails for %s", k, m, bs, N, err.Error())
+			}
+			if _, err = copyFile(savedPath(first), inpath); err != nil {
+				t.Fatal(err)
+			}
+			save()
+			checkVersions("restored")
+			err = testEC.ReadFile(inpath, outpath, &Options{})
+			if err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of the restored file fails for %s", k, m, bs, N, err.Error())
+			}
+			if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d read of the restored file fails for hash check fail", k, m, bs, N)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			//the pruned versions free their blocks once the config no longer refers to them
+			if err = testEC.PruneVersions(inpath, 1); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d prune fails for %s", k, m, bs, N, err.Error())
+			}
+			if versions, _ = testEC.ListVersions(inpath); len(versions) != 2 || versionDirs() <= N {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d versions are left after pruning, or their blocks freed early", k, m, bs, N, len(versions))
+			}
+			if err = testEC.WriteConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if versionDirs() != N {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d the pruned versions are left on disks", k, m, bs, N)
+			}
+			checkVersions("pruned")
+			//writing, appending and truncating make new versions as well
+			testEC.MaxVersions = 2
+			for i := 0; i < 4; i++ {
+				switch i {
+				case 0:
+					if err = changeRandom(inpath, int(fileSize), 20, 1); err != nil {
+						t.Fatal(err)
+					}
+					err = testEC.Update(inpath, inpath)
+				case 1:
+					p := make([]byte, bs+7)
+					fillRandom(p)
+					off := rand.Int63n(fileSize - int64(len(p)))
+					_, err = testEC.WriteAt(inpath, p, off)
+					if err == nil {
+						err = writeLocalAt(inpath, p, off)
+					}
+				case 2:
+					p := make([]byte, 2*bs+3)
+					fillRandom(p)
+					_, err = testEC.Append(inpath, bytes.NewReader(p))
+					if err == nil {
+						err = writeLocalAt(inpath, p, -1)
+					}
+				case 3:
+					if err = testEC.Truncate(inpath, fileSize/2); err == nil {
+						err = os.Truncate(inpath, fileSize/2)
+					}
+				}
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d change %d fails for %s", k, m, bs, N, i, err.Error())
+				}
+				save()
+			}
+			if err = testEC.WriteConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if versions, _ = testEC.ListVersions(inpath); len(versions) != 3 || versionDirs() != 2*N {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d %d versions are kept beyond the limit", k, m, bs, N, len(versions))
+			}
+			checkVersions("limited")
+			//the old versions go along with the file
+			if err = testEC.RemoveFile(inpath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d remove fails for %s", k, m, bs, N, err.Error())
+			}
+			if err = testEC.WriteConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if versionDirs() != 0 {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d old versions are left after removal", k, m, bs, N)
+			}
+			//restore diskConfigFile to previous content
+			if err := os.Rename(testDiskFilePath+".old", testDiskFilePath); err != nil {
+				t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+			}
+			err = testEC.ReadDiskPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+//writeLocalAt writes `p` into local file `path` at offset `off`, or appends it if `off` is negative
+func writeLocalAt(path string, p []byte, off int64) error {
+	flag := os.O_WRONLY
+	if off < 0 {
+		flag |= os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if off < 0 {
+		_, err = f.Write(p)
+	} else {
+		_, err = f.WriteAt(p, off)
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+// This test unit tests the byte-granular writes
+package grasure
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-------------------------TEST UNIT----------------------------
+
+func TestWriteAt(t *testing.T) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      3,
+		Override:        true,
+		Quiet:           true,
+	}
+	rand.Seed(100000007)
+	fileSize := int64(300*KiB + 123)
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := filepath.Join("input", fmt.Sprintf("temp-%d", fileSize))
+	outpath := filepath.Join("output", fmt.Sprintf("temp-%d", fileSize))
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []int{2, 4, 6} {
+		testEC.K = k
+		for _, m := range []int{1, 2, 3} {
+			testEC.M = m
+			N := k + m + 1
+			testEC.DiskNum = N
+			for _, bs := range []int64{4 * KiB, 16 * KiB} {
+				testEC.BlockSize = bs
+				err = testEC.InitSystem(true)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				err = testEC.ReadConfig()
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				err = generateRandomFileBySize(inpath, fileSize)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				_, err = testEC.EncodeFile(inpath)
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d,%s\n", k, m, bs, N, err.Error())
+				}
+				//the local file is written alike
+				lf, err := os.OpenFile(inpath, os.O_RDWR, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				//small writes, writes crossing blocks and stripes, and writes at both ends
+				for _, size := range []int64{1, 100, bs, bs + 1, 3*bs + 7, 2*int64(k)*bs + 5, fileSize} {
+					for _, off := range []int64{0, rand.Int63n(fileSize - size + 1), fileSize - size} {
+						p := make([]byte, size)
+						fillRandom(p)
+						n, err := testEC.WriteAt(inpath, p, off)
+						if err != nil {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d write of %d bytes at %d fails for %s", k, m, bs, N, size, off, err.Error())
+						}
+						if n != len(p) {
+							t.Fatalf("k:%d,m:%d,bs:%d,N:%d write of %d bytes at %d returns %d", k, m, bs, N, size, off, n)
+						}
+						if _, err = lf.WriteAt(p, off); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				lf.Close()
+				//parity is kept consistent, so both normal and degraded reads see the writes
+				for _, options := range []Options{{}, {Degrade: true}} {
+					err = testEC.ReadFile(inpath, outpath, &options)
+					if err != nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails for %s", k, m, bs, N, err.Error())
+					}
+					if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+						t.Fatalf("k:%d,m:%d,bs:%d,N:%d read fails for hash check fail", k, m, bs, N)
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					testEC.Destroy(&SimOptions{Mode: "diskFail", FailNum: m})
+				}
+				for i := range testEC.diskInfos {
+					testEC.diskInfos[i].available = true
+				}
+				//the writes survive a restart
+				err = testEC.WriteConfig()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = testEC.ReadConfig()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = testEC.ReadFile(inpath, outpath, &Options{})
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d read after restart fails for %s", k, m, bs, N, err.Error())
+				}
+				if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d read after restart fails for hash check fail", k, m, bs, N)
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				//the file hash is dropped, while a corrupted data block is still caught by its checksum
+				intFi, _ := testEC.fileMap.Load(fileKey(inpath))
+				fi := intFi.(*fileInfo)
+				if fi.Hash != "" {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d the written file keeps hash %q", k, m, bs, N, fi.Hash)
+				}
+				bf, err := os.OpenFile(filepath.Join(testEC.diskInfos[fi.Distribution[0][0]].diskPath, fi.FileName, "BLOB"), os.O_RDWR, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = bf.WriteAt([]byte{0x5a, 0xa5}, int64(fi.blockToOffset[0][0])*bs)
+				bf.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = testEC.ReadFile(inpath, outpath, &Options{SkipParity: true})
+				if err != nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d read skipping parity fails for %s", k, m, bs, N, err.Error())
+				}
+				if ok, err := checkFileIfSame(inpath, outpath); !ok && err == nil {
+					t.Fatalf("k:%d,m:%d,bs:%d,N:%d read skipping parity fails for hash check fail", k, m, bs, N)
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	//bytes out of the file are not written
+	if _, err = testEC.WriteAt(inpath, []byte{0}, fileSize); err != errRangeOutOfFile {
+		t.Fatalf("write beyond the file returns %v", err)
+	}
+	if _, err = testEC.WriteAt(inpath, []byte{0}, -1); err != errNegativeOffset {
+		t.Fatalf("write at negative offset returns %v", err)
+	}
+}
+
+func benchmarkWriteAt(b *testing.B, dataShards, parityShards, diskNum int, blockSize, fileSize, writeSize int64) {
+	genTempDir()
+	testEC := &Erasure{
+		ConfigFile:      "conf.json",
+		DiskFilePath:    testDiskFilePath,
+		ReplicateFactor: 3,
+		ConStripes:      100,
+		Override:        true,
+		Quiet:           true,
+		K:               dataShards,
+		M:               parityShards,
+		DiskNum:         diskNum,
+		BlockSize:       blockSize,
+	}
+	defer deleteTempFiles([]int64{fileSize})
+	inpath := fmt.Sprintf("./input/temp-%d", fileSize)
+	err = generateRandomFileBySize(inpath, fileSize)
+	if err != nil {
+		b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+	}
+	err = testEC.ReadDiskPath()
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = testEC.InitSystem(true)
+	if err != nil {
+		b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+	}
+	err = testEC.ReadConfig()
+	if err != nil {
+		b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+	}
+	_, err = testEC.EncodeFile(inpath)
+	if err != nil {
+		b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d, %s\n", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+	}
+	p := make([]byte, writeSize)
+	fillRandom(p)
+	b.SetBytes(writeSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := rand.Int63n(fileSize - writeSize + 1)
+		if _, err := testEC.WriteAt(inpath, p, off); err != nil {
+			b.Fatalf("k:%d,m:%d,bs:%d,N:%d,fs:%d write fails for %s", dataShards, parityShards, blockSize, diskNum, fileSize, err.Error())
+		}
+	}
+}
+
+//compare with BenchmarkUpdate2x3x6x4096x1M, which updates 10% of the bytes via the whole file
+func BenchmarkWriteAt2x3x6x4096x1Mx4K(b *testing.B) {
+	benchmarkWriteAt(b, 2, 3, 6, 4096, 1*MiB, 4*KiB)
+}
+
+func BenchmarkWriteAt4x2x6x1024x1Mx100(b *testing.B) {
+	benchmarkWriteAt(b, 4, 2, 6, 1024, 1*MiB, 100)
+}
+
+//compare with BenchmarkUpdate8x4x16x16384x10M
+func BenchmarkWriteAt8x4x16x16384x10Mx4K(b *testing.B) {
+	benchmarkWriteAt(b, 8, 4, 16, 16384, 10*MiB, 4*KiB)
+}
+
+func BenchmarkWriteAt8x4x16x16384x10Mx1M(b *testing.B) {
+	benchmarkWriteAt(b, 8, 4, 16, 16384, 10*MiB, 1*MiB)
+}
+
+//compare with BenchmarkUpdate12x4x18x8192x10M
+func BenchmarkWriteAt12x4x18x8192x10Mx4K(b *testing.B) {
+	benchmarkWriteAt(b, 12, 4, 18, 8192, 10*MiB, 4*KiB)
+}
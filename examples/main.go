@@ -7,10 +7,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"syscall"
 	"time"
 
 	grasure "github.com/DurantVivado/Grasure"
@@ -23,6 +28,28 @@ var failOnErr = func(mode string, e error) {
 	}
 }
 
+//printSummary prints the files done and failed of a directory tree
+var printSummary = func(sum *grasure.DirSummary) {
+	if sum == nil {
+		return
+	}
+	for name, err := range sum.Failed {
+		fmt.Printf("failed: %s: %s\n", name, err.Error())
+	}
+	fmt.Printf("%d files (%d bytes) done, %d failed\n", len(sum.Succeeded), sum.Bytes, len(sum.Failed))
+}
+
+//flagPassed tells if any of the flags `names` is given on the command line
+var flagPassed = func(names ...string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			passed = passed || f.Name == name
+		}
+	})
+	return passed
+}
+
 //if you want to enable cpu,memory or block profile functionality
 //set profileEnable as true, otherwise false
 //it's strongly advised to close this in production
@@ -54,10 +81,19 @@ func main() {
 		Override:        override,
 		Quiet:           quiet,
 		ReplicateFactor: replicateFactor,
+		HedgeDelay:      hedgeDelay,
+		SlowDiskLatency: slowLatency,
+		ParityLogSize:   parityLogSize,
+		Versioning:      versioning,
+		MaxVersions:     maxVersions,
+		Trash:           trash,
+		PackThreshold:   packThreshold,
+		Class:           class,
 	}
+	//Ctrl-C cancels the operation, leaving the system as it was
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	//We read the config file
-	// ctx, _ := context.WithCancel(context.Background())
-	// go monitorCancel(cancel)
 	start := time.Now()
 	err = erasure.ReadDiskPath()
 	failOnErr(mode, err)
@@ -74,15 +110,33 @@ func main() {
 			FailNum:  failNum,
 			FailDisk: failDisk,
 			FileName: filePath,
+			SlowDown: slowDown,
 		})
-		err = erasure.ReadFile(filePath, savePath, &grasure.Options{})
-		failOnErr(mode, err)
+		if savePath == "-" {
+			//stream the file to stdout
+			var f *grasure.File
+			if versionID >= 0 {
+				f, err = erasure.OpenVersion(filePath, versionID)
+			} else {
+				f, err = erasure.Open(filePath)
+			}
+			failOnErr(mode, err)
+			_, err = io.Copy(os.Stdout, f)
+			failOnErr(mode, err)
+			f.Close()
+		} else if versionID >= 0 {
+			err = erasure.ReadFileVersionWithContext(ctx, filePath, versionID, savePath, &grasure.Options{Degrade: degrade, SkipParity: skipParity, Repair: repair})
+			failOnErr(mode, err)
+		} else {
+			err = erasure.ReadFileWithContext(ctx, filePath, savePath, &grasure.Options{Degrade: degrade, SkipParity: skipParity, Repair: repair})
+			failOnErr(mode, err)
+		}
 
 	case "encode":
 		//encode a file
 		err = erasure.ReadConfig()
 		failOnErr(mode, err)
-		_, err := erasure.EncodeFile(filePath)
+		_, err := erasure.EncodeFileWithContext(ctx, filePath)
 		failOnErr(mode, err)
 		err = erasure.WriteConfig()
 		failOnErr(mode, err)
@@ -90,7 +144,7 @@ func main() {
 		//update an old file with a new version
 		err = erasure.ReadConfig()
 		failOnErr(mode, err)
-		err = erasure.Update(filePath, newFilePath)
+		err = erasure.UpdateWithContext(ctx, filePath, newFilePath)
 		failOnErr(mode, err)
 		err = erasure.WriteConfig()
 		failOnErr(mode, err)
@@ -103,22 +157,175 @@ func main() {
 			FailNum:  failNum,
 			FailDisk: failDisk,
 			FileName: filePath,
+			SlowDown: slowDown,
 		})
-		_, err = erasure.Recover(&grasure.Options{})
+		_, err = erasure.RecoverWithContext(ctx, &grasure.Options{})
 		failOnErr(mode, err)
 
-	// case "scale":
-	// 	//scaling the system, ALERT: this is a system-level operation and irreversible
-	// 	e.ReadConfig()
-	// 	scaling(new_k, new_m)
+	case "repair":
+		//bring the blocks left stale by degraded updates up to date
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.RepairStaleWithContext(ctx)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "merge":
+		//merge the pending parity deltas into the parity blocks
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.MergeParityLogs()
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "versions":
+		//list the versions of a file
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		versions, err := erasure.ListVersions(filePath)
+		failOnErr(mode, err)
+		for _, v := range versions {
+			fmt.Printf("version:%d, size:%d, hash:%s, modTime:%s, current:%t\n",
+				v.ID, v.Size, v.Hash, v.ModTime.Format(time.RFC3339), v.Current)
+		}
+	case "restore":
+		//make an old version of a file current again
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.RestoreVersionWithContext(ctx, filePath, versionID)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "prune":
+		//remove the old versions of a file beyond maxVersions
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.PruneVersions(filePath, maxVersions)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "scale":
+		//scaling the system, ALERT: this is a system-level operation and irreversible,
+		//an interrupted scaling is resumed by running it again
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.ScaleWithContext(ctx, new_k, new_m)
+		failOnErr(mode, err)
 	case "delete":
 		//delete a file
 		err = erasure.ReadConfig()
 		failOnErr(mode, err)
-		err = erasure.RemoveFile(filePath)
+		err = erasure.RemoveFileWithContext(ctx, filePath)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "rename":
+		//rename a file inside the system
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.Rename(filePath, newFilePath)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "copy":
+		//copy a file inside the system
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.CopyWithContext(ctx, filePath, newFilePath)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "trash":
+		//list the files in the trash
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		for _, f := range erasure.ListTrash() {
+			fmt.Printf("file:%s, size:%d, deletedAt:%s\n", f.Name, f.Size, f.DeletedAt.Format(time.RFC3339))
+		}
+	case "undelete":
+		//bring a removed file back from the trash
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.Undelete(filePath)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "purge":
+		//remove the files in the trash for good,
+		//emptying the whole trash takes an explicit -ot 0 or -o
+		if !flagPassed("ot", "olderThan") && !override {
+			log.Fatalf("%s: pass -ot {duration}, or -ot 0 (or -o) to empty the whole trash", mode)
+		}
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.PurgeTrash(olderThan)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "mkdir":
+		//make a directory in the system
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.Mkdir(filePath)
 		failOnErr(mode, err)
 		err = erasure.WriteConfig()
 		failOnErr(mode, err)
+	case "rmdir":
+		//remove an empty directory in the system
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.RemoveDir(filePath)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "ls":
+		//list a directory in the system
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		list, err := erasure.ReadDir(filePath)
+		failOnErr(mode, err)
+		for _, fi := range list {
+			fmt.Printf("%s %12d %s %s\n", fi.Mode(), fi.Size(), fi.ModTime().Format(time.RFC3339), fi.Name())
+		}
+	case "stat":
+		//describe a file or directory in the system
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		fi, err := erasure.Stat(filePath)
+		failOnErr(mode, err)
+		fmt.Printf("name:%s, size:%d, mode:%s, modTime:%s\n", fi.Name(), fi.Size(), fi.Mode(), fi.ModTime().Format(time.RFC3339))
+	case "compact":
+		//reclaim the room of packed files removed or replaced
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.CompactPacksWithContext(ctx)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "defineClass":
+		//define storage class `class` of k+m blocks of bs bytes
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		err = erasure.DefineClass(class, k, m, blockSize)
+		failOnErr(mode, err)
+		err = erasure.WriteConfig()
+		failOnErr(mode, err)
+	case "encodeDir":
+		//encode a local directory tree into directory newFilePath of the system, the root if not given
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		sum, err := erasure.EncodeDirWithContext(ctx, filePath, newFilePath)
+		printSummary(sum)
+		//the files encoded are kept even if the rest is given up
+		failOnErr(mode, erasure.WriteConfig())
+		failOnErr(mode, err)
+	case "readDir":
+		//read a directory in the system into a local directory
+		err = erasure.ReadConfig()
+		failOnErr(mode, err)
+		sum, err := erasure.ReadDirToWithContext(ctx, filePath, savePath, &grasure.Options{Degrade: degrade, SkipParity: skipParity, Repair: repair})
+		printSummary(sum)
+		failOnErr(mode, err)
 	default:
 		log.Fatalf("Can't parse the parameters, please check %s!", mode)
 	}
@@ -147,14 +354,27 @@ var (
 	replicateFactor int
 	quiet           bool
 	degrade         bool
+	skipParity      bool
+	repair          bool
+	hedgeDelay      time.Duration
+	slowLatency     time.Duration
+	slowDown        time.Duration
+	parityLogSize   int64
+	versioning      bool
+	maxVersions     int
+	versionID       int
+	trash           bool
+	olderThan       time.Duration
+	packThreshold   int64
+	class           string
 	// recoveredDiskPath string
 )
 
 //the parameter lists, with fullname or abbreviation
 func flag_init() {
 
-	flag.StringVar(&mode, "md", "encode", "the mode of ec system, one of (encode, decode, update, scaling, recover)")
-	flag.StringVar(&mode, "mode", "encode", "the mode of ec system, one of (encode, decode, update, scaling, recover)")
+	flag.StringVar(&mode, "md", "encode", "the mode of ec system, one of (encode, decode, update, scale, recover)")
+	flag.StringVar(&mode, "mode", "encode", "the mode of ec system, one of (encode, decode, update, scale, recover)")
 
 	flag.IntVar(&k, "k", 12, "the number of data shards(<256)")
 	flag.IntVar(&k, "dataNum", 12, "the number of data shards(<256)")
@@ -177,8 +397,8 @@ func flag_init() {
 	flag.StringVar(&newFilePath, "nf", "", "the local new file path")
 	flag.StringVar(&newFilePath, "newFilePath", "", "the local new file path")
 
-	flag.StringVar(&savePath, "sp", "file.save", "the local saving path(local path)")
-	flag.StringVar(&savePath, "savePath", "file.save", "the local saving path(local path)")
+	flag.StringVar(&savePath, "sp", "file.save", "the local saving path(local path), \"-\" for stdout")
+	flag.StringVar(&savePath, "savePath", "file.save", "the local saving path(local path), \"-\" for stdout")
 
 	flag.IntVar(&new_k, "new_k", 32, "the new number of data shards(<256)")
 	flag.IntVar(&new_k, "newDataNum", 32, "the new number of data shards(<256)")
@@ -198,8 +418,8 @@ func flag_init() {
 	flag.BoolVar(&conReads, "cr", true, "whether or not to enable concurrent read, default is false")
 	flag.BoolVar(&conReads, "conReads", true, "whether or not to enable concurrent read, default is false")
 
-	flag.StringVar(&failMode, "fmd", "diskFail", "simulate [diskFail] or [bitRot] mode")
-	flag.StringVar(&failMode, "failMode", "diskFail", "simulate [diskFail] or [bitRot] mode")
+	flag.StringVar(&failMode, "fmd", "diskFail", "simulate [diskFail], [bitRot] or [slowDisk] mode")
+	flag.StringVar(&failMode, "failMode", "diskFail", "simulate [diskFail], [bitRot] or [slowDisk] mode")
 
 	flag.IntVar(&failNum, "fn", 0, "simulate multiple disk failure, provides the fail number of disks")
 	flag.IntVar(&failNum, "failNum", 0, "simulate multiple disk failure, provides the fail number of disks")
@@ -216,4 +436,43 @@ func flag_init() {
 	flag.BoolVar(&degrade, "dg", false, "whether degraded read is enabled. In this way, only data shards are recovered.")
 	flag.BoolVar(&degrade, "degrade", false, "whether degraded read is enabled. In this way, only data shards are recovered.")
 
+	flag.BoolVar(&skipParity, "sk", false, "whether healthy stripes are read without parity, the file hash is checked instead.")
+	flag.BoolVar(&skipParity, "skipParity", false, "whether healthy stripes are read without parity, the file hash is checked instead.")
+
+	flag.BoolVar(&repair, "rp", false, "whether reconstructed blocks are written back to available disks during reading.")
+	flag.BoolVar(&repair, "repair", false, "whether reconstructed blocks are written back to available disks during reading.")
+
+	flag.DurationVar(&hedgeDelay, "hd", 0, "how long a block read may take before spare blocks are read instead (e.g., 20ms), 0 disables hedging.")
+	flag.DurationVar(&hedgeDelay, "hedgeDelay", 0, "how long a block read may take before spare blocks are read instead (e.g., 20ms), 0 disables hedging.")
+
+	flag.DurationVar(&slowLatency, "sl", 0, "the average block read latency above which a disk is avoided as slow (e.g., 50ms), 0 disables the check.")
+	flag.DurationVar(&slowLatency, "slowLatency", 0, "the average block read latency above which a disk is avoided as slow (e.g., 50ms), 0 disables the check.")
+
+	flag.DurationVar(&slowDown, "sd", 100*time.Millisecond, "the delay added to every block read of a simulated slow disk.")
+	flag.DurationVar(&slowDown, "slowDown", 100*time.Millisecond, "the delay added to every block read of a simulated slow disk.")
+
+	flag.Int64Var(&parityLogSize, "pl", 0, "the size in bytes the parity logs of a file reach before being merged, 0 disables parity logging.")
+	flag.Int64Var(&parityLogSize, "parityLogSize", 0, "the size in bytes the parity logs of a file reach before being merged, 0 disables parity logging.")
+
+	flag.BoolVar(&versioning, "vs", false, "whether the former version of a file is kept when it's encoded again or updated.")
+	flag.BoolVar(&versioning, "versioning", false, "whether the former version of a file is kept when it's encoded again or updated.")
+
+	flag.IntVar(&maxVersions, "mv", 0, "how many old versions of a file are kept, 0 keeps all.")
+	flag.IntVar(&maxVersions, "maxVersions", 0, "how many old versions of a file are kept, 0 keeps all.")
+
+	flag.IntVar(&versionID, "vid", -1, "the version of the file to read or restore, -1 for the current one.")
+	flag.IntVar(&versionID, "versionID", -1, "the version of the file to read or restore, -1 for the current one.")
+
+	flag.BoolVar(&trash, "tr", false, "whether removed files are moved into the trash rather than deleted.")
+	flag.BoolVar(&trash, "trash", false, "whether removed files are moved into the trash rather than deleted.")
+
+	flag.DurationVar(&olderThan, "ot", 0, "the files removed longer ago than it are purged from the trash (e.g., 72h), 0 purges all, required by purge unless -o is given.")
+	flag.DurationVar(&olderThan, "olderThan", 0, "the files removed longer ago than it are purged from the trash (e.g., 72h), 0 purges all, required by purge unless -o is given.")
+
+	flag.Int64Var(&packThreshold, "pt", 0, "files smaller than it in bytes are packed into shared containers, 0 disables packing.")
+	flag.Int64Var(&packThreshold, "packThreshold", 0, "files smaller than it in bytes are packed into shared containers, 0 disables packing.")
+
+	flag.StringVar(&class, "cl", "", "the storage class files are encoded with, or defined by defineClass, empty for the system parameters.")
+	flag.StringVar(&class, "class", "", "the storage class files are encoded with, or defined by defineClass, empty for the system parameters.")
+
 }